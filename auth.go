@@ -0,0 +1,152 @@
+package gesxi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/subosito/gotenv"
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// Environment variables read by NewEsxiServiceFromEnv, and by the CLI
+const (
+	EnvHost       = "ESXI_HOST"
+	EnvUser       = "ESXI_USER"
+	EnvPass       = "ESXI_PASS"
+	EnvThumbprint = "ESXI_THUMBPRINT"
+	EnvCAFile     = "ESXI_CA_FILE"
+	EnvInsecure   = "ESXI_INSECURE"
+)
+
+// LoadEnvFiles sets the variables in each .env style file that aren't
+// already set in the environment. Missing files are skipped.
+func LoadEnvFiles(files ...string) error {
+	for _, f := range files {
+		err := gotenv.Load(f)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("env file %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// NewEsxiServiceFromEnv is NewEsxiService with the host and credentials
+// taken from ESXI_HOST, ESXI_USER and ESXI_PASS, after loading envFiles
+// (e.g. ".env") with LoadEnvFiles. TLS settings left empty in opts come
+// from ESXI_THUMBPRINT, ESXI_CA_FILE and ESXI_INSECURE=true.
+func NewEsxiServiceFromEnv(ctx context.Context, opts Options, envFiles ...string) (*EsxiService, error) {
+	if err := LoadEnvFiles(envFiles...); err != nil {
+		return nil, err
+	}
+	host := os.Getenv(EnvHost)
+	if host == "" {
+		return nil, fmt.Errorf("%s is not set", EnvHost)
+	}
+	if opts.Thumbprint == "" {
+		opts.Thumbprint = os.Getenv(EnvThumbprint)
+	}
+	if opts.CAFile == "" {
+		opts.CAFile = os.Getenv(EnvCAFile)
+	}
+	if !opts.Insecure {
+		opts.Insecure = os.Getenv(EnvInsecure) == "true"
+	}
+	return NewEsxiService(ctx, host, os.Getenv(EnvUser), os.Getenv(EnvPass), opts)
+}
+
+// TokenLoginParams picks the SAML token LoginByToken presents
+type TokenLoginParams struct {
+	// SAML token (the assertion XML) issued elsewhere, e.g. to a CI job.
+	// When empty the vCenter STS issues one for the service's user and
+	// password
+	Token string
+	// Certificate and key a holder-of-key token is bound to; requests are
+	// signed with it. Without one the token is a bearer token
+	Certificate *tls.Certificate
+	// Lifetime of tokens issued by the STS, default 10 minutes
+	Lifetime time.Duration
+}
+
+// LoginByToken logs in to vCenter with a SAML token from vCenter SSO
+// instead of Login's password. When the session later expires, a token the
+// STS issued is issued again; a given Token is presented again as is.
+func (s *EsxiService) LoginByToken(ctx context.Context, p TokenLoginParams) error {
+	if s.EsxiClient.ServiceContent.About.ApiType != "VirtualCenter" {
+		return errors.New("token login needs vCenter")
+	}
+	signer := func(ctx context.Context) (*sts.Signer, error) {
+		if p.Token != "" {
+			return &sts.Signer{Token: p.Token, Certificate: p.Certificate}, nil
+		}
+		c, err := sts.NewClient(ctx, s.EsxiClient.Client)
+		if err != nil {
+			return nil, err
+		}
+		lifetime := p.Lifetime
+		if lifetime == 0 {
+			lifetime = 10 * time.Minute
+		}
+		return c.Issue(ctx, sts.TokenRequest{
+			Userinfo:    s.EsxiClient.Userinfo,
+			Certificate: p.Certificate,
+			Lifetime:    lifetime,
+			Renewable:   true,
+		})
+	}
+	login := func(ctx context.Context) error {
+		signed, err := signer(ctx)
+		if err != nil {
+			return fmt.Errorf("issue token: %w", err)
+		}
+		header := soap.Header{Security: signed}
+		return s.EsxiClient.SessionManager.LoginByToken(s.EsxiClient.WithHeader(ctx, header))
+	}
+	if err := login(ctx); err != nil {
+		return err
+	}
+	s.EsxiClient.sessions.setLogin(login)
+	// The REST API takes the same token, signing the login request with it
+	s.EsxiClient.setRestLogin(ctx, func(ctx context.Context, rc *rest.Client) error {
+		signed, err := signer(ctx)
+		if err != nil {
+			return fmt.Errorf("issue token: %w", err)
+		}
+		return rc.LoginByToken(rc.WithSigner(ctx, signed))
+	})
+	return nil
+}
+
+// AcquireCloneTicket returns a one-time ticket another process can hand to
+// LoginByCloneTicket to join this session without credentials. The ticket
+// expires after a short while.
+func (s *EsxiService) AcquireCloneTicket(ctx context.Context) (string, error) {
+	return s.EsxiClient.SessionManager.AcquireCloneTicket(ctx)
+}
+
+// LoginByCloneTicket joins the session a ticket from AcquireCloneTicket
+// was issued for. Expired sessions are only renewed if the service was
+// created with a password.
+func (s *EsxiService) LoginByCloneTicket(ctx context.Context, ticket string) error {
+	if err := s.EsxiClient.SessionManager.CloneSession(ctx, ticket); err != nil {
+		return err
+	}
+	var login func(context.Context) error
+	if pass, _ := s.EsxiClient.Userinfo.Password(); pass != "" {
+		u := s.EsxiClient.Userinfo
+		login = func(ctx context.Context) error {
+			return s.EsxiClient.SessionManager.Login(ctx, u)
+		}
+	}
+	s.EsxiClient.sessions.setLogin(login)
+	s.EsxiClient.setRestLogin(ctx, nil)
+	if s.EsxiClient.keepalive != nil {
+		s.EsxiClient.keepalive.Start()
+	}
+	return nil
+}
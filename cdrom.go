@@ -0,0 +1,165 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// The question a running VM asks when a CD-ROM is disconnected while the
+// guest holds the tray locked
+const cdromLockedQuestion = "msg.cdromdisconnect.locked"
+
+// AddCdromToVm adds a CD-ROM described by c to vm, creating an IDE or SATA
+// controller for it when the VM has no free slot.
+func (s *EsxiService) AddCdromToVm(ctx context.Context, vm mo.VirtualMachine, c CdromSpec) error {
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+	cdrom, added, err := newCdrom(devices, c)
+	if err != nil {
+		return fmt.Errorf("add cdrom to %s: %w", vm.Name, err)
+	}
+	deviceChange, err := append(object.VirtualDeviceList(added), cdrom).ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return err
+	}
+	return s.reconfigDevices(ctx, vm, deviceChange)
+}
+
+// MountIso inserts the datastore ISO at isoPath (e.g.
+// "[datastore1] ISOs/ubuntu.iso") into a CD-ROM of vm and connects it.
+// device is the CD-ROM's name, e.g. cdrom-3000; empty picks the first one.
+func (s *EsxiService) MountIso(ctx context.Context, vm mo.VirtualMachine, device, isoPath string) error {
+	return s.editCdrom(ctx, vm, device, func(devices object.VirtualDeviceList, cdrom *types.VirtualCdrom) {
+		devices.InsertIso(cdrom, isoPath)
+		setConnected(cdrom, true)
+	})
+}
+
+// SetCdromClientDevice backs a CD-ROM of vm with the remote client's
+// drive, i.e. whatever the console user attaches. A connected drive stays
+// connected, now to the client; use EjectCdrom to disconnect it.
+func (s *EsxiService) SetCdromClientDevice(ctx context.Context, vm mo.VirtualMachine, device string) error {
+	return s.editCdrom(ctx, vm, device, func(_ object.VirtualDeviceList, cdrom *types.VirtualCdrom) {
+		cdrom.Backing = clientCdromBacking()
+	})
+}
+
+// SetCdromHostDevice backs a CD-ROM of vm with the host's physical drive
+// hostDevice, e.g. /vmfs/devices/cdrom/mpx.vmhba0:C0:T0:L0.
+func (s *EsxiService) SetCdromHostDevice(ctx context.Context, vm mo.VirtualMachine, device, hostDevice string) error {
+	if hostDevice == "" {
+		return fmt.Errorf("cdrom on %s: host device is required", vm.Name)
+	}
+	return s.editCdrom(ctx, vm, device, func(_ object.VirtualDeviceList, cdrom *types.VirtualCdrom) {
+		cdrom.Backing = &types.VirtualCdromAtapiBackingInfo{
+			VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{
+				DeviceName:    hostDevice,
+				UseAutoDetect: types.NewBool(false),
+			},
+		}
+		setConnected(cdrom, true)
+	})
+}
+
+// EjectCdrom removes the media from a CD-ROM of vm, leaving it as an empty
+// disconnected client device. On a running VM whose guest has locked the
+// tray, the lock is overridden.
+func (s *EsxiService) EjectCdrom(ctx context.Context, vm mo.VirtualMachine, device string) error {
+	return s.editCdrom(ctx, vm, device, func(_ object.VirtualDeviceList, cdrom *types.VirtualCdrom) {
+		cdrom.Backing = clientCdromBacking()
+		setConnected(cdrom, false)
+	})
+}
+
+// editCdrom applies edit to the CD-ROM named device (or the first one) and
+// reconfigures vm with it.
+func (s *EsxiService) editCdrom(ctx context.Context, vm mo.VirtualMachine, device string, edit func(object.VirtualDeviceList, *types.VirtualCdrom)) error {
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+	cdrom, err := devices.FindCdrom(device)
+	if err != nil {
+		return fmt.Errorf("cdrom on %s: %w", vm.Name, err)
+	}
+	cdrom = copyDevice(cdrom).(*types.VirtualCdrom)
+	edit(devices, cdrom)
+	deviceChange, err := object.VirtualDeviceList{cdrom}.ConfigSpec(types.VirtualDeviceConfigSpecOperationEdit)
+	if err != nil {
+		return err
+	}
+	return s.reconfigDevices(ctx, vm, deviceChange)
+}
+
+// reconfigDevices applies deviceChange to vm. While the task runs, the
+// locked CD-ROM question is answered so a guest holding the tray can't
+// stall it.
+func (s *EsxiService) reconfigDevices(ctx context.Context, vm mo.VirtualMachine, deviceChange []types.BaseVirtualDeviceConfigSpec) error {
+	watchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go s.answerCdromLocked(watchCtx, vm.Reference())
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{DeviceChange: deviceChange})
+}
+
+// answerCdromLocked answers yes to the locked CD-ROM question whenever vm
+// asks it, until ctx is done.
+func (s *EsxiService) answerCdromLocked(ctx context.Context, vm types.ManagedObjectReference) {
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	_ = property.Wait(ctx, pc, vm, []string{"runtime.question"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			q, ok := c.Val.(types.VirtualMachineQuestionInfo)
+			if !ok {
+				continue
+			}
+			for _, m := range q.Message {
+				if m.Id != cdromLockedQuestion {
+					continue
+				}
+				if yes, ok := yesChoice(q); ok {
+					_, _ = methods.AnswerVM(ctx, s.EsxiClient.Client, &types.AnswerVM{
+						This:         vm,
+						QuestionId:   q.Id,
+						AnswerChoice: yes,
+					})
+				}
+				break
+			}
+		}
+		return false
+	})
+}
+
+// yesChoice returns the key of q's "yes" choice. Keys differ between host
+// versions, so the choice is found by its label.
+func yesChoice(q types.VirtualMachineQuestionInfo) (string, bool) {
+	for _, c := range q.Choice.ChoiceInfo {
+		d := c.GetElementDescription()
+		for _, l := range []string{d.Label, d.Key} {
+			if strings.EqualFold(l, "yes") || strings.EqualFold(l, "button.yes") {
+				return d.Key, true
+			}
+		}
+	}
+	return "", false
+}
+
+func clientCdromBacking() types.BaseVirtualDeviceBackingInfo {
+	return &types.VirtualCdromRemotePassthroughBackingInfo{
+		VirtualDeviceRemoteDeviceBackingInfo: types.VirtualDeviceRemoteDeviceBackingInfo{
+			UseAutoDetect: types.NewBool(false),
+		},
+	}
+}
+
+func setConnected(d types.BaseVirtualDevice, connected bool) {
+	dev := d.GetVirtualDevice()
+	info := types.VirtualDeviceConnectInfo{AllowGuestControl: true}
+	if dev.Connectable != nil {
+		info = *dev.Connectable
+	}
+	info.Connected, info.StartConnected = connected, connected
+	dev.Connectable = &info
+}
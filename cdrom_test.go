@@ -0,0 +1,35 @@
+package gesxi
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestYesChoice(t *testing.T) {
+	choice := func(key, label string) types.BaseElementDescription {
+		return &types.ElementDescription{Key: key, Description: types.Description{Label: label}}
+	}
+	tests := []struct {
+		name    string
+		choices []types.BaseElementDescription
+		want    string
+		ok      bool
+	}{
+		{"yes first", []types.BaseElementDescription{choice("0", "Yes"), choice("1", "No")}, "0", true},
+		{"yes second", []types.BaseElementDescription{choice("0", "No"), choice("1", "Yes")}, "1", true},
+		{"message key label", []types.BaseElementDescription{choice("1", "button.no"), choice("2", "button.yes")}, "2", true},
+		{"named key", []types.BaseElementDescription{choice("no", ""), choice("yes", "")}, "yes", true},
+		{"no yes", []types.BaseElementDescription{choice("0", "OK"), choice("1", "Cancel")}, "", false},
+		{"no choices", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := types.VirtualMachineQuestionInfo{Choice: types.ChoiceOption{ChoiceInfo: tt.choices}}
+			got, ok := yesChoice(q)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("got %q %v, want %q %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type CloneVmParams struct {
+	// BIOS uuid of the VM to clone
+	SourceUuid string
+	Name       string
+	// Default the source VM's folder and resource pool. Templates have no
+	// pool, so cloning one needs RsrcPool, e.g. from GetPlacement
+	DcVmFolder types.ManagedObjectReference
+	RsrcPool   types.ManagedObjectReference
+	// Default the source VM's datastore
+	DatastoreName string
+	// Clone the source as it was at this snapshot (name, path or id, see
+	// RevertToSnapshot) instead of its current state
+	Snapshot string
+	// Share the snapshot's disks through delta disks instead of copying
+	// them. Uses the current snapshot unless Snapshot is set. vCenter only
+	Linked  bool
+	PowerOn bool
+	// Override the source's vCPUs and memory
+	NumCpus  int32
+	MemoryMB int64
+	// Replace the source's NICs with these
+	Nics []NicSpec
+}
+
+// CloneVm copies the VM with uuid p.SourceUuid to a new VM named p.Name.
+// vCenter clones with CloneVM_Task. Standalone ESXi can't, so the disks
+// are copied with the VirtualDiskManager and a new VM is created around
+// them with the source's hardware; the source should be powered off
+// there, or cloned from a snapshot, since running disks are locked.
+func (s *EsxiService) CloneVm(ctx context.Context, p CloneVmParams) (mo.VirtualMachine, error) {
+	var vm mo.VirtualMachine
+	if p.Name == "" {
+		return vm, fmt.Errorf("clone %s: name is required", p.SourceUuid)
+	}
+	src, err := s.GetVmByUuid(ctx, p.SourceUuid)
+	if err != nil {
+		return vm, err
+	}
+	if src.Config == nil {
+		return vm, fmt.Errorf("clone %s: source has no config", src.Name)
+	}
+	if p.DcVmFolder.Value == "" && src.Parent != nil {
+		p.DcVmFolder = *src.Parent
+	}
+	if p.RsrcPool.Value == "" && src.ResourcePool != nil {
+		p.RsrcPool = *src.ResourcePool
+	}
+	if p.RsrcPool.Value == "" && src.Config.Template {
+		return vm, fmt.Errorf("clone %s: templates have no resource pool, set RsrcPool, e.g. from GetPlacement", src.Name)
+	}
+	if p.DatastoreName == "" {
+		var dsPath object.DatastorePath
+		dsPath.FromString(src.Config.Files.VmPathName)
+		p.DatastoreName = dsPath.Datastore
+	}
+	var snapshot *types.ManagedObjectReference
+	switch {
+	case p.Snapshot != "":
+		snap, err := s.findSnapshot(ctx, src, p.Snapshot)
+		if err != nil {
+			return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+		}
+		snapshot = &snap.Ref
+	case p.Linked:
+		if src.Snapshot == nil || src.Snapshot.CurrentSnapshot == nil {
+			return vm, fmt.Errorf("clone %s: a linked clone needs a snapshot", src.Name)
+		}
+		snapshot = src.Snapshot.CurrentSnapshot
+	}
+	if s.EsxiClient.ServiceContent.About.ApiType == "HostAgent" {
+		if p.Linked {
+			return vm, fmt.Errorf("clone %s: linked clones need vCenter", src.Name)
+		}
+		return s.copyVm(ctx, src, snapshot, p)
+	}
+
+	ds, err := s.FindDatastore(ctx, p.DatastoreName)
+	if err != nil {
+		return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+	}
+	dsRef := ds.Self
+	spec := types.VirtualMachineCloneSpec{
+		Location: types.VirtualMachineRelocateSpec{
+			Datastore: &dsRef,
+		},
+		PowerOn:  p.PowerOn,
+		Snapshot: snapshot,
+		Config: &types.VirtualMachineConfigSpec{
+			NumCPUs:  p.NumCpus,
+			MemoryMB: p.MemoryMB,
+		},
+	}
+	if p.RsrcPool.Value != "" {
+		pool := p.RsrcPool
+		spec.Location.Pool = &pool
+	}
+	if p.Linked {
+		spec.Location.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	}
+	if len(p.Nics) > 0 {
+		devices := object.VirtualDeviceList(src.Config.Hardware.Device)
+		nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+		remove, err := nics.ConfigSpec(types.VirtualDeviceConfigSpecOperationRemove)
+		if err != nil {
+			return vm, err
+		}
+		add, err := s.nicChanges(ctx, devices, p.Nics)
+		if err != nil {
+			return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+		}
+		spec.Config.DeviceChange = append(remove, add...)
+	}
+	task, err := methods.CloneVM_Task(ctx, s.EsxiClient.Client, &types.CloneVM_Task{
+		This:   src.Self,
+		Folder: p.DcVmFolder,
+		Name:   p.Name,
+		Spec:   spec,
+	})
+	if err != nil {
+		return vm, err
+	}
+	result, err := s.waitTask(ctx, task.Returnval)
+	if err != nil {
+		return vm, err
+	}
+	vmRef, ok := result.(types.ManagedObjectReference)
+	if !ok {
+		return vm, fmt.Errorf("clone %s: unexpected task result %T", src.Name, result)
+	}
+	return s.getVmByMo(ctx, vmRef)
+}
+
+// copyVm is CloneVm for standalone ESXi: the source's disks (or the
+// snapshot's) are copied to a folder named after the clone, then a VM is
+// created with the source's hardware pointing at the copies.
+func (s *EsxiService) copyVm(ctx context.Context, src mo.VirtualMachine, snapshot *types.ManagedObjectReference, p CloneVmParams) (vm mo.VirtualMachine, err error) {
+	config := *src.Config
+	if snapshot != nil {
+		var snap mo.VirtualMachineSnapshot
+		pc := property.DefaultCollector(s.EsxiClient.Client)
+		err := pc.RetrieveOne(ctx, *snapshot, []string{"config"}, &snap)
+		if err != nil {
+			return vm, err
+		}
+		config = snap.Config
+	}
+	devices := object.VirtualDeviceList(config.Hardware.Device)
+	dir := fmt.Sprintf("[%s] %s", p.DatastoreName, p.Name)
+	_, err = methods.MakeDirectory(ctx, s.EsxiClient.Client, &types.MakeDirectory{
+		This: s.EsxiClient.ServiceContent.FileManager.Reference(),
+		Name: dir,
+	})
+	if err != nil {
+		return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+	}
+	// Until the new VM exists, a failure leaves only the directory and the
+	// disks copied so far, which would otherwise stay on the datastore
+	created := false
+	defer func() {
+		if err != nil && !created {
+			s.removeDatastoreDir(dir, src.Self)
+		}
+	}()
+	// Copy each disk, remembering where it went by its device key
+	copies := map[int32]string{}
+	for i, d := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		backing, ok := d.GetVirtualDevice().Backing.(types.BaseVirtualDeviceFileBackingInfo)
+		if !ok {
+			return vm, fmt.Errorf("clone %s: disk %s isn't file backed", src.Name, devices.Name(d))
+		}
+		dst := fmt.Sprintf("%s/%s.vmdk", dir, p.Name)
+		if i > 0 {
+			dst = fmt.Sprintf("%s/%s_%d.vmdk", dir, p.Name, i)
+		}
+		task, err := methods.CopyVirtualDisk_Task(ctx, s.EsxiClient.Client, &types.CopyVirtualDisk_Task{
+			This:       *s.EsxiClient.ServiceContent.VirtualDiskManager,
+			SourceName: backing.GetVirtualDeviceFileBackingInfo().FileName,
+			DestName:   dst,
+			DestSpec: &types.VirtualDiskSpec{
+				DiskType:    string(types.VirtualDiskTypeThin),
+				AdapterType: string(diskAdapterType(devices, d)),
+			},
+		})
+		if err != nil {
+			return vm, err
+		}
+		if _, err = s.waitTask(ctx, task.Returnval); err != nil {
+			return vm, err
+		}
+		copies[d.GetVirtualDevice().Key] = dst
+	}
+	deviceChange, err := copyDevices(devices, copies, len(p.Nics) == 0)
+	if err != nil {
+		return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+	}
+	if len(p.Nics) > 0 {
+		add, err := s.nicChanges(ctx, devices, p.Nics)
+		if err != nil {
+			return vm, fmt.Errorf("clone %s: %w", src.Name, err)
+		}
+		deviceChange = append(deviceChange, add...)
+	}
+	spec := types.VirtualMachineConfigSpec{
+		Name:              p.Name,
+		GuestId:           config.GuestId,
+		Annotation:        config.Annotation,
+		Firmware:          config.Firmware,
+		NumCPUs:           config.Hardware.NumCPU,
+		NumCoresPerSocket: config.Hardware.NumCoresPerSocket,
+		MemoryMB:          int64(config.Hardware.MemoryMB),
+		Files: &types.VirtualMachineFileInfo{
+			VmPathName: fmt.Sprintf("%s/%s.vmx", dir, p.Name),
+		},
+		DeviceChange: deviceChange,
+	}
+	if config.BootOptions != nil {
+		// The boot order points at the source's device keys
+		boot := *config.BootOptions
+		boot.BootOrder = nil
+		spec.BootOptions = &boot
+	}
+	if p.NumCpus > 0 {
+		spec.NumCPUs, spec.NumCoresPerSocket = p.NumCpus, 0
+	}
+	if p.MemoryMB > 0 {
+		spec.MemoryMB = p.MemoryMB
+	}
+	if vm, err = s.createVm(ctx, p.DcVmFolder, p.RsrcPool, types.ManagedObjectReference{}, spec); err != nil {
+		return vm, err
+	}
+	created = true
+	if p.PowerOn {
+		if err = s.powerTask(ctx, PowerOn, vm.Self); err != nil {
+			return vm, err
+		}
+		return s.getVmByMo(ctx, vm.Self)
+	}
+	return vm, nil
+}
+
+// diskAdapterType is the adapter type a copy of disk records for the
+// controller disk is on. The API only knows ide, busLogic and lsiLogic;
+// disks on the other SCSI, SATA and NVMe controllers are lsiLogic.
+func diskAdapterType(devices object.VirtualDeviceList, disk types.BaseVirtualDevice) types.VirtualDiskAdapterType {
+	ctrl := devices.FindByKey(disk.GetVirtualDevice().ControllerKey)
+	if ctrl == nil {
+		return types.VirtualDiskAdapterTypeLsiLogic
+	}
+	switch controllerType(devices, ctrl) {
+	case ControllerIDE:
+		return types.VirtualDiskAdapterTypeIde
+	case ControllerBusLogic:
+		return types.VirtualDiskAdapterTypeBusLogic
+	}
+	return types.VirtualDiskAdapterTypeLsiLogic
+}
+
+// removeDatastoreDir deletes dir, e.g. "[ds1] web01", and everything in
+// it. near is an object in the same datacenter, which vCenter needs to
+// resolve the path. It runs on its own context since the caller's may be
+// done, and is best effort: the caller is already reporting an error.
+func (s *EsxiService) removeDatastoreDir(dir string, near types.ManagedObjectReference) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req := &types.DeleteDatastoreFile_Task{
+		This: *s.EsxiClient.ServiceContent.FileManager,
+		Name: dir,
+	}
+	if dc, err := s.datacenterOf(ctx, near); err == nil {
+		req.Datacenter = &dc.Self
+	}
+	task, err := methods.DeleteDatastoreFile_Task(ctx, s.EsxiClient.Client, req)
+	if err != nil {
+		return
+	}
+	s.waitTask(ctx, task.Returnval)
+}
+
+// copyDevices builds add specs recreating the storage controllers, disks,
+// CD-ROMs and (with nics) NICs of devices on a new VM. Disks are attached
+// to the files in copies; NICs get new generated MACs. The default IDE
+// controllers and other built-in devices come with the new VM.
+func copyDevices(devices object.VirtualDeviceList, copies map[int32]string, nics bool) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	var added object.VirtualDeviceList
+	keys := map[int32]int32{}
+	newKey := func(d types.BaseVirtualDevice) types.BaseVirtualDevice {
+		dev := copyDevice(d)
+		vd := dev.GetVirtualDevice()
+		key := append(devices, added...).NewKey()
+		keys[vd.Key] = key
+		vd.Key = key
+		vd.DeviceInfo = nil
+		vd.SlotInfo = nil
+		return dev
+	}
+	controllerKey := func(key int32) int32 {
+		if k, ok := keys[key]; ok {
+			return k
+		}
+		return key
+	}
+	for _, d := range devices {
+		switch ctrl := d.(type) {
+		case *types.VirtualIDEController:
+			// Every VM is created with IDE controllers 200 and 201
+			if ctrl.Key == 200 || ctrl.Key == 201 {
+				continue
+			}
+		case types.BaseVirtualSCSIController, *types.VirtualAHCIController, *types.VirtualNVMEController:
+		default:
+			continue
+		}
+		c := newKey(d)
+		c.(types.BaseVirtualController).GetVirtualController().Device = nil
+		added = append(added, c)
+	}
+	for _, d := range devices {
+		switch src := d.(type) {
+		case *types.VirtualDisk:
+			file, ok := copies[src.Key]
+			if !ok {
+				return nil, fmt.Errorf("disk %s wasn't copied", devices.Name(d))
+			}
+			disk := newKey(d).(*types.VirtualDisk)
+			disk.ControllerKey = controllerKey(disk.ControllerKey)
+			disk.Backing = &types.VirtualDiskFlatVer2BackingInfo{
+				DiskMode:        string(types.VirtualDiskModePersistent),
+				ThinProvisioned: types.NewBool(true),
+				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+					FileName: file,
+				},
+			}
+			// No capacity marks the disk as an existing file to attach
+			disk.CapacityInKB, disk.CapacityInBytes = 0, 0
+			disk.Shares = nil
+			disk.StorageIOAllocation = nil
+			added = append(added, disk)
+		case *types.VirtualCdrom:
+			cdrom := newKey(d)
+			cdrom.GetVirtualDevice().ControllerKey = controllerKey(cdrom.GetVirtualDevice().ControllerKey)
+			added = append(added, cdrom)
+		case types.BaseVirtualEthernetCard:
+			if !nics {
+				continue
+			}
+			nic := newKey(d)
+			card := nic.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+			card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+			card.MacAddress = ""
+			card.ExternalId = ""
+			added = append(added, nic)
+		}
+	}
+	return added.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+}
+
+// nicChanges builds add specs for nics, keyed clear of devices.
+func (s *EsxiService) nicChanges(ctx context.Context, devices object.VirtualDeviceList, nics []NicSpec) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	networks, err := s.GetNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var added object.VirtualDeviceList
+	for _, n := range nics {
+		nic, err := s.newNic(ctx, networks, n)
+		if err != nil {
+			return nil, err
+		}
+		nic.GetVirtualDevice().Key = append(devices, added...).NewKey()
+		added = append(added, nic)
+	}
+	return added.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+}
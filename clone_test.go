@@ -0,0 +1,266 @@
+package gesxi
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// testVm returns the VM called name.
+func testVm(t *testing.T, esx *EsxiService, name string) mo.VirtualMachine {
+	t.Helper()
+	vms, err := esx.GetVms(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range vms {
+		if vm.Name == name {
+			return vm
+		}
+	}
+	t.Fatalf("no vm %s", name)
+	return mo.VirtualMachine{}
+}
+
+func TestCloneVm(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.VPX())
+	src := testVm(t, esx, "DC0_H0_VM0")
+
+	vm, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "clone0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "clone0" || vm.Self == src.Self {
+		t.Fatalf("got %s (%s), want a new vm clone0", vm.Name, vm.Self.Value)
+	}
+	if vm.ResourcePool == nil || *vm.ResourcePool != *src.ResourcePool {
+		t.Errorf("clone pool %v, want the source's %v", vm.ResourcePool, *src.ResourcePool)
+	}
+	if vm.Parent == nil || *vm.Parent != *src.Parent {
+		t.Errorf("clone folder %v, want the source's %v", vm.Parent, *src.Parent)
+	}
+}
+
+func TestCloneVmTemplate(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.VPX())
+	src := testVm(t, esx, "DC0_C0_RP0_VM0")
+	if err := esx.Power(ctx, PowerParams{Action: PowerOff, Ref: src.Self}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := methods.MarkAsTemplate(ctx, esx.EsxiClient.Client, &types.MarkAsTemplate{This: src.Self}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "nopool"})
+	if err == nil || !strings.Contains(err.Error(), "RsrcPool") {
+		t.Fatalf("clone without a pool: got %v, want an error asking for one", err)
+	}
+
+	place, err := esx.GetPlacement(ctx, "DC0_C0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "fromtemplate", RsrcPool: place.RsrcPool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ResourcePool == nil || *vm.ResourcePool != place.RsrcPool {
+		t.Fatalf("clone pool %v, want %v", vm.ResourcePool, place.RsrcPool)
+	}
+	if vm.Config.Template {
+		t.Fatal("clone of a template is a template")
+	}
+}
+
+func TestCloneVmLinked(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.VPX())
+	src := testVm(t, esx, "DC0_H0_VM0")
+
+	_, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "linked", Linked: true})
+	if err == nil || !strings.Contains(err.Error(), "needs a snapshot") {
+		t.Fatalf("linked clone without snapshots: got %v", err)
+	}
+	if _, err = esx.CreateSnapshot(ctx, src, SnapshotParams{Name: "golden"}); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "linked", Linked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "linked" {
+		t.Fatalf("got %s, want linked", vm.Name)
+	}
+	vm, err = esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "linked-golden", Linked: true, Snapshot: "golden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "linked-golden" {
+		t.Fatalf("got %s, want linked-golden", vm.Name)
+	}
+}
+
+func TestCloneVmStandalone(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.ESX())
+	vms, err := esx.GetVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := vms[0]
+	if err := esx.Power(ctx, PowerParams{Action: PowerOff, Ref: src.Self}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "linked", Linked: true})
+	if err == nil {
+		t.Fatal("linked clone on standalone esxi succeeded")
+	}
+	vm, err := esx.CloneVm(ctx, CloneVmParams{SourceUuid: src.Config.Uuid, Name: "copy0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDisks := object.VirtualDeviceList(src.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+	disks := object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) != len(srcDisks) {
+		t.Fatalf("copy has %d disks, want %d", len(disks), len(srcDisks))
+	}
+	for _, d := range disks {
+		file := d.GetVirtualDevice().Backing.(types.BaseVirtualDeviceFileBackingInfo).GetVirtualDeviceFileBackingInfo().FileName
+		if !strings.Contains(file, "copy0/copy0") {
+			t.Errorf("copy's disk %s isn't in its own folder", file)
+		}
+	}
+}
+
+func TestDiskAdapterType(t *testing.T) {
+	var devices object.VirtualDeviceList
+	for i, ct := range []ControllerType{ControllerIDE, ControllerBusLogic, ControllerLsiLogic, ControllerPVSCSI, ControllerSATA, ControllerNVMe} {
+		devices = append(devices, testController(t, devices, ct, int32(100+i)))
+	}
+	tests := []struct {
+		ctrlKey int32
+		want    types.VirtualDiskAdapterType
+	}{
+		{100, types.VirtualDiskAdapterTypeIde},
+		{101, types.VirtualDiskAdapterTypeBusLogic},
+		{102, types.VirtualDiskAdapterTypeLsiLogic},
+		{103, types.VirtualDiskAdapterTypeLsiLogic},
+		{104, types.VirtualDiskAdapterTypeLsiLogic},
+		{105, types.VirtualDiskAdapterTypeLsiLogic},
+		// A controller missing from the list
+		{999, types.VirtualDiskAdapterTypeLsiLogic},
+	}
+	for _, tt := range tests {
+		disk := &types.VirtualDisk{VirtualDevice: types.VirtualDevice{Key: 2000, ControllerKey: tt.ctrlKey}}
+		if got := diskAdapterType(devices, disk); got != tt.want {
+			t.Errorf("controller %d: got %s, want %s", tt.ctrlKey, got, tt.want)
+		}
+	}
+}
+
+func TestCopyDevices(t *testing.T) {
+	unit := func(u int32) *int32 { return &u }
+	ide0 := &types.VirtualIDEController{VirtualController: types.VirtualController{VirtualDevice: types.VirtualDevice{Key: 200}}}
+	ide1 := &types.VirtualIDEController{VirtualController: types.VirtualController{VirtualDevice: types.VirtualDevice{Key: 201}, BusNumber: 1}}
+	scsi := &types.ParaVirtualSCSIController{VirtualSCSIController: types.VirtualSCSIController{
+		VirtualController: types.VirtualController{VirtualDevice: types.VirtualDevice{Key: 1000}, Device: []int32{2000, 2001}},
+	}}
+	disk0 := &types.VirtualDisk{
+		VirtualDevice: types.VirtualDevice{
+			Key: 2000, ControllerKey: 1000, UnitNumber: unit(0),
+			Backing:    &types.VirtualDiskFlatVer2BackingInfo{VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds] src/src.vmdk"}},
+			DeviceInfo: &types.Description{Label: "Hard disk 1"},
+		},
+		CapacityInKB: 1024,
+	}
+	disk1 := &types.VirtualDisk{
+		VirtualDevice: types.VirtualDevice{
+			Key: 2001, ControllerKey: 1000, UnitNumber: unit(1),
+			Backing: &types.VirtualDiskFlatVer2BackingInfo{VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds] src/src_1.vmdk"}},
+		},
+		CapacityInKB: 2048,
+	}
+	cdrom := &types.VirtualCdrom{VirtualDevice: types.VirtualDevice{Key: 3000, ControllerKey: 201, UnitNumber: unit(0)}}
+	nic := &types.VirtualVmxnet3{VirtualVmxnet: types.VirtualVmxnet{VirtualEthernetCard: types.VirtualEthernetCard{
+		VirtualDevice: types.VirtualDevice{Key: 4000},
+		AddressType:   string(types.VirtualEthernetCardMacTypeAssigned),
+		MacAddress:    "00:50:56:01:02:03",
+	}}}
+	video := &types.VirtualMachineVideoCard{VirtualDevice: types.VirtualDevice{Key: 500}}
+	devices := object.VirtualDeviceList{ide0, ide1, scsi, disk0, disk1, cdrom, nic, video}
+	copies := map[int32]string{2000: "[ds] dst/dst.vmdk", 2001: "[ds] dst/dst_1.vmdk"}
+
+	specs, err := copyDevices(devices, copies, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var added []types.BaseVirtualDevice
+	for _, s := range specs {
+		spec := s.GetVirtualDeviceConfigSpec()
+		if spec.Operation != types.VirtualDeviceConfigSpecOperationAdd {
+			t.Fatalf("operation %s, want add", spec.Operation)
+		}
+		added = append(added, spec.Device)
+	}
+	var gotTypes []string
+	for _, d := range added {
+		gotTypes = append(gotTypes, reflect.TypeOf(d).Elem().Name())
+	}
+	want := []string{"ParaVirtualSCSIController", "VirtualDisk", "VirtualDisk", "VirtualCdrom", "VirtualVmxnet3"}
+	if !reflect.DeepEqual(gotTypes, want) {
+		t.Fatalf("added %v, want %v", gotTypes, want)
+	}
+
+	newScsi := added[0].(*types.ParaVirtualSCSIController)
+	if newScsi.Key >= 0 || newScsi.Device != nil {
+		t.Errorf("controller key %d devices %v, want a new key and no devices", newScsi.Key, newScsi.Device)
+	}
+	for i, d := range added[1:3] {
+		disk := d.(*types.VirtualDisk)
+		if disk.ControllerKey != newScsi.Key {
+			t.Errorf("disk %d on controller %d, want the new %d", i, disk.ControllerKey, newScsi.Key)
+		}
+		if disk.Key >= 0 || disk.DeviceInfo != nil {
+			t.Errorf("disk %d key %d info %v, want a new key and no info", i, disk.Key, disk.DeviceInfo)
+		}
+		if disk.CapacityInKB != 0 {
+			t.Errorf("disk %d capacity %d, want 0 to attach the copy", i, disk.CapacityInKB)
+		}
+		file := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName
+		if file != copies[int32(2000+i)] {
+			t.Errorf("disk %d backed by %s, want %s", i, file, copies[int32(2000+i)])
+		}
+	}
+	if got := added[3].GetVirtualDevice().ControllerKey; got != 201 {
+		t.Errorf("cdrom on controller %d, want the built-in 201", got)
+	}
+	card := added[4].(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+	if card.MacAddress != "" || card.AddressType != string(types.VirtualEthernetCardMacTypeGenerated) {
+		t.Errorf("nic mac %q %s, want a generated one", card.MacAddress, card.AddressType)
+	}
+	// The source's devices are left alone
+	if disk0.Key != 2000 || disk0.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName != "[ds] src/src.vmdk" || nic.MacAddress == "" {
+		t.Error("copyDevices changed the source's devices")
+	}
+
+	specs, err = copyDevices(devices, copies, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 4 {
+		t.Errorf("without nics: %d devices added, want 4", len(specs))
+	}
+	if _, err = copyDevices(devices, map[int32]string{2000: "[ds] dst/dst.vmdk"}, true); err == nil {
+		t.Error("a disk missing from copies was attached")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+// cdromFlags registers the flags every cdrom command takes.
+func cdromFlags(fs *flag.FlagSet) (uuid, device *string) {
+	uuid = fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	device = fs.String("device", "", "cdrom device `name`, e.g. cdrom-3000 (default: the first cdrom)")
+	return uuid, device
+}
+
+func runCdromAdd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("cdrom add")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	ctrl := fs.String("controller", "ide", "`controller` type: ide or sata")
+	iso := fs.String("iso", "", "datastore `path` of an ISO to mount, e.g. \"[datastore1] ISOs/os.iso\"")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "cdrom add", *uuid)
+	if err != nil {
+		return err
+	}
+	err = a.esx.AddCdromToVm(ctx, vm, gesxi.CdromSpec{
+		Controller: gesxi.ControllerType(*ctrl),
+		IsoPath:    *iso,
+	})
+	if err != nil {
+		return err
+	}
+	return a.status("added cdrom to %s", vm.Name)
+}
+
+func runCdromMount(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("cdrom mount")
+	uuid, device := cdromFlags(fs)
+	iso := fs.String("iso", "", "datastore `path` of the ISO, e.g. \"[datastore1] ISOs/os.iso\" (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *iso == "" {
+		return errors.New("cdrom mount: -iso is required")
+	}
+	vm, err := a.vmByUuid(ctx, "cdrom mount", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.MountIso(ctx, vm, *device, *iso); err != nil {
+		return err
+	}
+	return a.status("mounted %s on %s", *iso, vm.Name)
+}
+
+func runCdromClient(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("cdrom client")
+	uuid, device := cdromFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "cdrom client", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.SetCdromClientDevice(ctx, vm, *device); err != nil {
+		return err
+	}
+	return a.status("cdrom on %s set to client device", vm.Name)
+}
+
+func runCdromHost(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("cdrom host")
+	uuid, device := cdromFlags(fs)
+	hostDevice := fs.String("host-device", "", "host drive `path`, e.g. /vmfs/devices/cdrom/mpx.vmhba0:C0:T0:L0 (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "cdrom host", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.SetCdromHostDevice(ctx, vm, *device, *hostDevice); err != nil {
+		return err
+	}
+	return a.status("cdrom on %s set to host device %s", vm.Name, *hostDevice)
+}
+
+func runCdromEject(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("cdrom eject")
+	uuid, device := cdromFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "cdrom eject", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.EjectCdrom(ctx, vm, *device); err != nil {
+		return err
+	}
+	return a.status("ejected cdrom on %s", vm.Name)
+}
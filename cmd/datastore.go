@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+func runDsMkdir(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("ds mkdir")
+	path := fs.String("path", "", "directory `path` on the datastore, e.g. /ISOs (required)")
+	datastore := fs.String("datastore", "", "datastore `name` (default: the host's datastore)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("ds mkdir: -path is required")
+	}
+	dc, err := a.esx.GetDatacenter(ctx)
+	if err != nil {
+		return err
+	}
+	dcRef := dc.Reference()
+	if err := a.esx.MkDir(ctx, gesxi.MkDirParams{PathName: *path, DsName: *datastore, DcRef: &dcRef}); err != nil {
+		return err
+	}
+	return a.status("created %s", *path)
+}
+
+func runDsUpload(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("ds upload")
+	var (
+		file      = fs.String("file", "", "local `file` to upload (required)")
+		dir       = fs.String("dir", "", "datastore `directory` to upload into")
+		remote    = fs.String("remote", "", "remote file `name` (default: local file name)")
+		datastore = fs.String("datastore", "", "datastore `name` (default: the host's datastore)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("ds upload: -file is required")
+	}
+	dc, err := a.esx.GetDatacenter(ctx)
+	if err != nil {
+		return err
+	}
+	if *datastore == "" {
+		ds, err := a.esx.GetDatastore(ctx)
+		if err != nil {
+			return err
+		}
+		*datastore = ds.Name
+	}
+	err = a.esx.CpFileToDatastore(ctx, gesxi.CpFileParams{
+		DcName:         dc.Name,
+		DsName:         *datastore,
+		LocalFilePath:  filepath.Dir(*file),
+		FileName:       filepath.Base(*file),
+		DatastoreDir:   strings.Trim(*dir, "/"),
+		RemoteFileName: *remote,
+	})
+	if err != nil {
+		return err
+	}
+	return a.status("uploaded %s to [%s] %s", filepath.Base(*file), *datastore, *dir)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+func runVmDevices(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm devices")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "vm devices", *uuid)
+	if err != nil {
+		return err
+	}
+	devices, err := a.esx.GetVmDevices(ctx, vm)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "LABEL", "TYPE", "CONTROLLER", "DETAILS", "CONNECTED"}, data: devices}
+	for _, d := range devices {
+		var details []string
+		if d.CapacityKB > 0 {
+			details = append(details, strconv.FormatInt(d.CapacityKB/1024/1024, 10)+" GB")
+		}
+		if d.Network != "" {
+			details = append(details, d.Network, d.MacAddress)
+		}
+		if d.FileName != "" {
+			details = append(details, d.FileName)
+		}
+		connected := ""
+		if d.Connected != nil {
+			connected = strconv.FormatBool(*d.Connected)
+		}
+		t.rows = append(t.rows, []string{d.Name, d.Label, d.Type, d.Controller, strings.Join(details, " "), connected})
+	}
+	return a.render(t)
+}
+
+func runVmRemoveDisk(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm remove-disk")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	disk := fs.String("disk", "", "disk `name` or label, e.g. disk-1000-1 or \"Hard disk 2\" (required)")
+	del := fs.Bool("delete", false, "delete the vmdk as well (default: keep it on the datastore)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *disk == "" {
+		return errors.New("vm remove-disk: -disk is required")
+	}
+	vm, err := a.vmByUuid(ctx, "vm remove-disk", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.RemoveDisk(ctx, vm, *disk, *del); err != nil {
+		return err
+	}
+	return a.status("removed %s from %s", *disk, vm.Name)
+}
+
+func runVmGrowDisk(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm grow-disk")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	disk := fs.String("disk", "", "disk `name` or label (required)")
+	size := fs.Int64("size", 0, "new size in `GB` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *disk == "" || *size <= 0 {
+		return errors.New("vm grow-disk: -disk and -size are required")
+	}
+	vm, err := a.vmByUuid(ctx, "vm grow-disk", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.GrowDisk(ctx, vm, *disk, *size); err != nil {
+		return err
+	}
+	return a.status("grew %s on %s to %d GB", *disk, vm.Name, *size)
+}
+
+func runVmRemoveNic(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm remove-nic")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	nic := fs.String("nic", "", "nic `name` or label, e.g. ethernet-0 or \"Network adapter 1\" (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *nic == "" {
+		return errors.New("vm remove-nic: -nic is required")
+	}
+	vm, err := a.vmByUuid(ctx, "vm remove-nic", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.RemoveNic(ctx, vm, *nic); err != nil {
+		return err
+	}
+	return a.status("removed %s from %s", *nic, vm.Name)
+}
+
+func runVmSetNic(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm set-nic")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	nic := fs.String("nic", "", "nic `name` or label (required)")
+	network := fs.String("network", "", "move the nic to this port group `name`")
+	connect := fs.Bool("connect", false, "connect the nic")
+	disconnect := fs.Bool("disconnect", false, "disconnect the nic")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *nic == "" {
+		return errors.New("vm set-nic: -nic is required")
+	}
+	if *connect && *disconnect {
+		return errors.New("vm set-nic: -connect and -disconnect are exclusive")
+	}
+	if *network == "" && !*connect && !*disconnect {
+		return errors.New("vm set-nic: nothing to change, give -network, -connect or -disconnect")
+	}
+	vm, err := a.vmByUuid(ctx, "vm set-nic", *uuid)
+	if err != nil {
+		return err
+	}
+	if *network != "" {
+		if err := a.esx.SetNicNetwork(ctx, vm, *nic, *network); err != nil {
+			return err
+		}
+	}
+	if *connect || *disconnect {
+		// The network change bumped the config, so look the VM up again
+		if vm, err = a.esx.GetVmByUuid(ctx, *uuid); err != nil {
+			return err
+		}
+		if err := a.esx.SetNicConnected(ctx, vm, *nic, *connect); err != nil {
+			return err
+		}
+	}
+	return a.status("updated %s on %s", *nic, vm.Name)
+}
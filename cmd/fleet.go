@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+type fleetRow struct {
+	Host   string          `json:"host"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// runFleet runs cmd on each of the -hosts, -parallel at a time, and
+// prints each host's output under its name once they're all done.
+func (a *app) runFleet(ctx context.Context, cmd command, args []string) error {
+	if a.session != "" || a.auth.ticket != "" {
+		return errors.New("-hosts can't be used with -session-file or -ticket, they belong to a single host")
+	}
+	if err := a.checkUser(); err != nil {
+		return err
+	}
+	hosts, err := parseHosts(a.hosts)
+	if err != nil {
+		return err
+	}
+	fleet, connected := gesxi.ConnectFleet(ctx, gesxi.FleetConfig{
+		Hosts:       hosts,
+		User:        a.user,
+		Pass:        a.pass,
+		Options:     a.tls,
+		Concurrency: a.parallel,
+		Login: func(ctx context.Context, esx *gesxi.EsxiService) error {
+			a.showProgress(esx, esx.EsxHostIp+": ")
+			login, err := a.login(esx)
+			if err != nil {
+				return err
+			}
+			return login(ctx)
+		},
+	})
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		fleet.Logout(ctx)
+	}()
+	ran := fleet.Run(ctx, nil, func(ctx context.Context, esx *gesxi.EsxiService) (interface{}, error) {
+		var buf bytes.Buffer
+		h := *a
+		h.host, h.hosts, h.out, h.esx = esx.EsxHostIp, "", &buf, esx
+		err := cmd.run(ctx, &h, args)
+		return buf.Bytes(), err
+	})
+
+	byHost := map[string]gesxi.HostResult{}
+	for _, res := range append(connected.Failed(), ran...) {
+		byHost[res.Host] = res
+	}
+	rows := make([]fleetRow, len(hosts))
+	failed := 0
+	for i, host := range hosts {
+		res := byHost[host]
+		rows[i].Host = host
+		if out, ok := res.Value.([]byte); ok {
+			rows[i].Result = bytes.TrimSpace(out)
+		}
+		if res.Err != nil {
+			rows[i].Error = res.Err.Error()
+			failed++
+		}
+	}
+	if err := a.renderFleet(rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(hosts))
+	}
+	return nil
+}
+
+func (a *app) renderFleet(rows []fleetRow) error {
+	if a.output == "json" {
+		for i := range rows {
+			if len(rows[i].Result) > 0 && !json.Valid(rows[i].Result) {
+				rows[i].Result = nil
+			}
+		}
+		return a.render(table{data: rows})
+	}
+	for i, r := range rows {
+		if i > 0 {
+			fmt.Fprintln(a.out)
+		}
+		fmt.Fprintf(a.out, "== %s ==\n", r.Host)
+		if len(r.Result) > 0 {
+			fmt.Fprintf(a.out, "%s\n", r.Result)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(a.out, "error: %s\n", r.Error)
+		}
+	}
+	return nil
+}
+
+// parseHosts splits a -hosts value, either a comma separated list or
+// @file naming a file with one host per line. Blank lines and lines
+// starting with # are skipped. A host listed twice is an error, as each
+// host's output is reported once under its name.
+func parseHosts(v string) ([]string, error) {
+	var hosts listFlag
+	if name := strings.TrimPrefix(v, "@"); name != v {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				hosts = append(hosts, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		hosts.Set(v)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts in -hosts %q", v)
+	}
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		key := strings.ToLower(h)
+		if seen[key] {
+			return nil, fmt.Errorf("host %s is listed more than once in -hosts", h)
+		}
+		seen[key] = true
+	}
+	return hosts, nil
+}
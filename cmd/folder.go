@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type folderRow struct {
+	Name   string `json:"name"`
+	Ref    string `json:"ref"`
+	Parent string `json:"parent"`
+	Items  int    `json:"items"`
+}
+
+func runFolderList(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("folder list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	folders, err := a.esx.ListVmFolders(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "PARENT", "ITEMS"}}
+	rows := make([]folderRow, 0, len(folders))
+	for _, f := range folders {
+		r := folderRow{Name: f.Name, Ref: f.Self.Value, Items: len(f.ChildEntity)}
+		if f.Parent != nil {
+			r.Parent = f.Parent.Value
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{r.Name, r.Ref, r.Parent, strconv.Itoa(r.Items)})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+func runFolderCreate(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("folder create")
+	path := fs.String("path", "", "inventory `path` of the new folder, e.g. /DC1/vm/lab (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("folder create: -path is required")
+	}
+	f, err := a.esx.CreateFolder(ctx, *path)
+	if err != nil {
+		return err
+	}
+	return a.status("created %s (%s)", *path, f.Self.Value)
+}
+
+func runFolderMove(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("folder move")
+	path := fs.String("path", "", "inventory `path` of the folder (required)")
+	var uuids listFlag
+	fs.Var(&uuids, "uuid", "BIOS `uuid` of a VM to move (repeatable or comma separated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" || len(uuids) == 0 {
+		return errors.New("folder move: -path and -uuid are required")
+	}
+	f, err := a.esx.FindFolder(ctx, *path)
+	if err != nil {
+		return err
+	}
+	var refs []types.ManagedObjectReference
+	for _, uuid := range uuids {
+		vm, err := a.esx.GetVmByUuid(ctx, uuid)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, vm.Self)
+	}
+	if err := a.esx.MoveToFolder(ctx, f.Self, refs...); err != nil {
+		return err
+	}
+	return a.status("moved %d VMs to %s", len(refs), *path)
+}
+
+func runFolderRename(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("folder rename")
+	path := fs.String("path", "", "inventory `path` of the folder (required)")
+	name := fs.String("name", "", "new folder `name` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" || *name == "" {
+		return errors.New("folder rename: -path and -name are required")
+	}
+	f, err := a.esx.FindFolder(ctx, *path)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.RenameFolder(ctx, f.Self, *name); err != nil {
+		return err
+	}
+	return a.status("renamed %s to %s", *path, *name)
+}
+
+func runFolderRemove(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("folder remove")
+	path := fs.String("path", "", "inventory `path` of the folder (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("folder remove: -path is required")
+	}
+	f, err := a.esx.FindFolder(ctx, *path)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.RemoveFolder(ctx, f.Self); err != nil {
+		return err
+	}
+	return a.status("removed %s", *path)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ApogeeNetworking/gesxi"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type hostRow struct {
+	Name            string `json:"name"`
+	Ref             string `json:"ref"`
+	Product         string `json:"product"`
+	CpuModel        string `json:"cpuModel"`
+	Cores           int16  `json:"cores"`
+	MemoryMB        int64  `json:"memoryMB"`
+	ConnectionState string `json:"connectionState"`
+}
+
+func runHosts(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("hosts")
+	clusterName := fs.String("cluster", "", "only hosts in this cluster `name` or inventory path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var hosts []mo.HostSystem
+	if *clusterName != "" {
+		cluster, err := a.esx.FindCluster(ctx, *clusterName)
+		if err != nil {
+			return err
+		}
+		if hosts, err = a.esx.GetClusterHosts(ctx, cluster); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if hosts, err = a.esx.GetHosts(ctx); err != nil {
+			return err
+		}
+	}
+	t := table{header: []string{"NAME", "REF", "PRODUCT", "CPU", "CORES", "MEMORY MB", "STATE"}}
+	rows := make([]hostRow, 0, len(hosts))
+	for _, h := range hosts {
+		r := hostRow{Name: h.Summary.Config.Name, Ref: h.Self.Value}
+		if h.Summary.Config.Product != nil {
+			r.Product = h.Summary.Config.Product.FullName
+		}
+		if hw := h.Summary.Hardware; hw != nil {
+			r.CpuModel = hw.CpuModel
+			r.Cores = hw.NumCpuCores
+			r.MemoryMB = hw.MemorySize / 1024 / 1024
+		}
+		if h.Summary.Runtime != nil {
+			r.ConnectionState = string(h.Summary.Runtime.ConnectionState)
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{
+			r.Name, r.Ref, r.Product, r.CpuModel,
+			strconv.Itoa(int(r.Cores)), strconv.FormatInt(r.MemoryMB, 10), r.ConnectionState,
+		})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+type vmRow struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	Ref        string `json:"ref"`
+	PowerState string `json:"powerState"`
+	NumCpus    int32  `json:"numCpus"`
+	MemoryMB   int32  `json:"memoryMB"`
+	GuestOS    string `json:"guestOs"`
+}
+
+func newVmRow(vm mo.VirtualMachine) vmRow {
+	return vmRow{
+		Name:       vm.Summary.Config.Name,
+		UUID:       vm.Summary.Config.Uuid,
+		Ref:        vm.Self.Value,
+		PowerState: string(vm.Summary.Runtime.PowerState),
+		NumCpus:    vm.Summary.Config.NumCpu,
+		MemoryMB:   vm.Summary.Config.MemorySizeMB,
+		GuestOS:    vm.Summary.Config.GuestFullName,
+	}
+}
+
+func vmTable(vms ...mo.VirtualMachine) table {
+	t := table{header: []string{"NAME", "UUID", "REF", "POWER", "CPUS", "MEMORY MB", "GUEST OS"}}
+	rows := make([]vmRow, 0, len(vms))
+	for _, vm := range vms {
+		r := newVmRow(vm)
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{
+			r.Name, r.UUID, r.Ref, r.PowerState,
+			strconv.Itoa(int(r.NumCpus)), strconv.Itoa(int(r.MemoryMB)), r.GuestOS,
+		})
+	}
+	t.data = rows
+	return t
+}
+
+func runVms(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vms")
+	var q gesxi.VmQuery
+	var power string
+	var props listFlag
+	fs.StringVar(&q.Name, "name", "", "only VMs whose name matches this glob, e.g. web-*")
+	fs.StringVar(&power, "power", "", "only VMs in this power state: poweredOn, poweredOff or suspended")
+	fs.StringVar(&q.Annotation, "annotation", "", "only VMs whose notes contain this text")
+	fs.StringVar(&q.Tag, "tag", "", "only VMs with this vSphere tag (vCenter)")
+	fs.Var(&props, "props", "property paths to retrieve instead of the summary's (comma separated or repeated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q.PowerState = types.VirtualMachinePowerState(power)
+	q.Props = props
+	vms, err := a.esx.ListVms(ctx, q)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "UUID", "REF", "POWER", "CPUS", "MEMORY MB", "GUEST OS", "IPS", "HOST"}}
+	for _, vm := range vms {
+		t.rows = append(t.rows, []string{
+			vm.Name, vm.Uuid, vm.Ref.Value, string(vm.PowerState),
+			strconv.Itoa(int(vm.NumCpus)), strconv.Itoa(int(vm.MemoryMB)), vm.GuestOS,
+			strings.Join(vm.IPs, ","), vm.Host,
+		})
+	}
+	t.data = vms
+	return a.render(t)
+}
+
+type networkRow struct {
+	Name       string `json:"name"`
+	Ref        string `json:"ref"`
+	Type       string `json:"type"`
+	Accessible bool   `json:"accessible"`
+}
+
+func runNetworks(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("networks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	networks, err := a.esx.GetNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "TYPE", "ACCESSIBLE"}}
+	rows := make([]networkRow, 0, len(networks))
+	for _, n := range networks {
+		r := networkRow{Name: n.Name, Ref: n.Self.Value, Type: n.Self.Type}
+		if n.Summary != nil {
+			r.Accessible = n.Summary.GetNetworkSummary().Accessible
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{r.Name, r.Ref, r.Type, strconv.FormatBool(r.Accessible)})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+type datacenterRow struct {
+	Name string `json:"name"`
+	Ref  string `json:"ref"`
+}
+
+func runDatacenters(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("datacenters")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dcs, err := a.esx.ListDatacenters(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF"}}
+	rows := make([]datacenterRow, 0, len(dcs))
+	for _, dc := range dcs {
+		rows = append(rows, datacenterRow{Name: dc.Name, Ref: dc.Self.Value})
+		t.rows = append(t.rows, []string{dc.Name, dc.Self.Value})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+type datastoreRow struct {
+	Name       string `json:"name"`
+	Ref        string `json:"ref"`
+	Type       string `json:"type"`
+	CapacityGB int64  `json:"capacityGB"`
+	FreeGB     int64  `json:"freeGB"`
+	Accessible bool   `json:"accessible"`
+}
+
+func runDatastores(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("datastores")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dss, err := a.esx.ListDatastores(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "TYPE", "CAPACITY GB", "FREE GB", "ACCESSIBLE"}}
+	rows := make([]datastoreRow, 0, len(dss))
+	for _, ds := range dss {
+		r := datastoreRow{
+			Name:       ds.Name,
+			Ref:        ds.Self.Value,
+			Type:       ds.Summary.Type,
+			CapacityGB: ds.Summary.Capacity / 1024 / 1024 / 1024,
+			FreeGB:     ds.Summary.FreeSpace / 1024 / 1024 / 1024,
+			Accessible: ds.Summary.Accessible,
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{
+			r.Name, r.Ref, r.Type, strconv.FormatInt(r.CapacityGB, 10),
+			strconv.FormatInt(r.FreeGB, 10), strconv.FormatBool(r.Accessible),
+		})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+type poolRow struct {
+	Name   string `json:"name"`
+	Ref    string `json:"ref"`
+	Parent string `json:"parent"`
+}
+
+func runPools(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("pools")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pools, err := a.esx.ListRsrcPools(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "PARENT"}}
+	rows := make([]poolRow, 0, len(pools))
+	for _, pool := range pools {
+		r := poolRow{Name: pool.Name, Ref: pool.Self.Value}
+		if pool.Parent != nil {
+			r.Parent = pool.Parent.Value
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{r.Name, r.Ref, r.Parent})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+type clusterRow struct {
+	Name  string `json:"name"`
+	Ref   string `json:"ref"`
+	Hosts int    `json:"hosts"`
+	Drs   bool   `json:"drs"`
+	Ha    bool   `json:"ha"`
+}
+
+func runClusters(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("clusters")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	clusters, err := a.esx.ListClusters(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "HOSTS", "DRS", "HA"}}
+	rows := make([]clusterRow, 0, len(clusters))
+	for _, c := range clusters {
+		r := clusterRow{Name: c.Name, Ref: c.Self.Value, Hosts: len(c.Host)}
+		if cfg, ok := c.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+			r.Drs = cfg.DrsConfig.Enabled != nil && *cfg.DrsConfig.Enabled
+			r.Ha = cfg.DasConfig.Enabled != nil && *cfg.DasConfig.Enabled
+		}
+		rows = append(rows, r)
+		t.rows = append(t.rows, []string{
+			r.Name, r.Ref, strconv.Itoa(r.Hosts), strconv.FormatBool(r.Drs), strconv.FormatBool(r.Ha),
+		})
+	}
+	t.data = rows
+	return a.render(t)
+}
+
+// hostSystem returns the named HostSystem, or the only one when name is
+// empty (standalone ESXi).
+func (a *app) hostSystem(ctx context.Context, name string) (mo.HostSystem, error) {
+	hosts, err := a.esx.GetHosts(ctx)
+	if err != nil {
+		return mo.HostSystem{}, err
+	}
+	if name == "" {
+		if len(hosts) != 1 {
+			return mo.HostSystem{}, fmt.Errorf("found %d hosts, use -esx to pick one", len(hosts))
+		}
+		return hosts[0], nil
+	}
+	for _, h := range hosts {
+		if h.Name == name || h.Summary.Config.Name == name {
+			return h, nil
+		}
+	}
+	return mo.HostSystem{}, fmt.Errorf("host %q not found", name)
+}
+
+// datastore returns the datastore called name, or the only one when name
+// is empty.
+func (a *app) datastore(ctx context.Context, name string) (mo.Datastore, error) {
+	if name == "" {
+		return a.esx.GetDatastore(ctx)
+	}
+	return a.esx.FindDatastore(ctx, name)
+}
+
+// placement resolves a command's -esx and -folder flags to where a new VM
+// goes.
+func (a *app) placement(ctx context.Context, target, folder string) (gesxi.Placement, error) {
+	place, err := a.esx.GetPlacement(ctx, target)
+	if err != nil {
+		return place, err
+	}
+	if folder != "" {
+		f, err := a.esx.FindFolder(ctx, folder)
+		if err != nil {
+			return place, err
+		}
+		place.DcVmFolder = f.Self
+	}
+	return place, nil
+}
@@ -1,4 +1,317 @@
+// Command gesxi is a small CLI around the gesxi EsxiService API for
+// day-to-day host provisioning.
+//
+//	go build -o gesxi ./cmd
+//	gesxi -host esx01 -user root -pass secret hosts
+//
+// Connection settings are read from flags, falling back to the
+// ESXI_HOST, ESXI_USER and ESXI_PASS environment variables. The host
+// certificate is verified unless -thumbprint pins it or -insecure is
+// given. Interrupting the command or exceeding -timeout cancels the call
+// in flight. With -hosts the command runs on many hosts at once, each
+// host's output printed under its name. With -session-file the session
+// is kept open and reused by later runs instead of logging in each time.
 package main
 
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ApogeeNetworking/gesxi"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type app struct {
+	host     string
+	hosts    string
+	parallel int
+	user     string
+	pass     string
+	tls      gesxi.Options
+	session  string
+	auth     authFlags
+	output   string
+	timeout  time.Duration
+	verbose  bool
+	out      io.Writer
+	esx      *gesxi.EsxiService
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = []command{
+	{"hosts", "list host systems", runHosts},
+	{"vms", "list virtual machines", runVms},
+	{"networks", "list networks", runNetworks},
+	{"datacenters", "list datacenters", runDatacenters},
+	{"datastores", "list datastores", runDatastores},
+	{"pools", "list resource pools", runPools},
+	{"clusters", "list vCenter clusters", runClusters},
+	{"vm create", "create a virtual machine", runVmCreate},
+	{"vm add-disk", "add a disk to a virtual machine", runVmAddDisk},
+	{"vm add-nic", "add a network adapter to a virtual machine", runVmAddNic},
+	{"vm clone", "clone a virtual machine", runVmClone},
+	{"vm devices", "list a virtual machine's devices", runVmDevices},
+	{"vm remove-disk", "detach or delete a disk", runVmRemoveDisk},
+	{"vm grow-disk", "extend a disk", runVmGrowDisk},
+	{"vm remove-nic", "remove a network adapter", runVmRemoveNic},
+	{"vm set-nic", "change a network adapter's port group or connection", runVmSetNic},
+	{"vm reconfigure", "change a virtual machine's CPU, memory and advanced settings", runVmReconfigure},
+	{"vm destroy", "power off and delete a virtual machine", runVmDestroy},
+	{"vm unregister", "remove a virtual machine from the inventory, keeping its files", runVmUnregister},
+	{"vm register", "add a virtual machine to the inventory from its .vmx", runVmRegister},
+	{"cdrom add", "add a cdrom drive to a virtual machine", runCdromAdd},
+	{"cdrom mount", "mount a datastore ISO in a cdrom drive", runCdromMount},
+	{"cdrom client", "back a cdrom drive with the client device", runCdromClient},
+	{"cdrom host", "back a cdrom drive with a host device", runCdromHost},
+	{"cdrom eject", "eject the media from a cdrom drive", runCdromEject},
+	{"snapshot create", "snapshot a virtual machine", runSnapshotCreate},
+	{"snapshot list", "show a virtual machine's snapshot tree", runSnapshotList},
+	{"snapshot revert", "revert a virtual machine to a snapshot", runSnapshotRevert},
+	{"snapshot remove", "remove one or all snapshots", runSnapshotRemove},
+	{"snapshot consolidate", "consolidate a virtual machine's disks", runSnapshotConsolidate},
+	{"session ticket", "print a clone ticket for another process to join the saved session", runSessionTicket},
+	{"folder list", "list VM folders", runFolderList},
+	{"folder create", "create a VM folder", runFolderCreate},
+	{"folder move", "move virtual machines into a folder", runFolderMove},
+	{"folder rename", "rename a VM folder", runFolderRename},
+	{"folder remove", "remove an empty VM folder", runFolderRemove},
+	{"pg add", "add a port group to a vSwitch", runPgAdd},
+	{"vswitch add", "add a vSwitch bound to physical nics", runVswitchAdd},
+	{"net plan", "show the changes that would make a host's network match a spec file", runNetPlan},
+	{"net apply", "change a host's network to match a spec file", runNetApply},
+	{"ds mkdir", "make a directory on the datastore", runDsMkdir},
+	{"ds upload", "copy a local file to the datastore", runDsUpload},
+	{"ova import", "import an OVA as a vApp", runOvaImport},
+	{"power on", "power on a VM or vApp", runPowerOn},
+	{"power off", "power off a VM or vApp", runPowerOff},
+	{"power reset", "reset a VM", runPowerReset},
+	{"power suspend", "suspend a VM or vApp", runPowerSuspend},
+	{"power shutdown", "shut down a VM's guest OS through VMware Tools", runPowerShutdown},
+	{"power reboot", "reboot a VM's guest OS through VMware Tools", runPowerReboot},
+}
+
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "gesxi: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	a := &app{out: out}
+	// Settings in ./.env fill in the environment, so CI can keep
+	// credentials out of the command line
+	if err := gesxi.LoadEnvFiles(".env"); err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("gesxi", flag.ContinueOnError)
+	fs.StringVar(&a.host, "host", os.Getenv("ESXI_HOST"), "ESXi host or IP `address` (ESXI_HOST)")
+	fs.StringVar(&a.hosts, "hosts", os.Getenv("ESXI_HOSTS"), "run the command on each of these `hosts`, comma separated or @file with one per line (ESXI_HOSTS)")
+	fs.IntVar(&a.parallel, "parallel", gesxi.DefaultFleetConcurrency, "hosts worked on at once with -hosts")
+	fs.StringVar(&a.user, "user", os.Getenv("ESXI_USER"), "login `username` (ESXI_USER)")
+	fs.StringVar(&a.pass, "pass", os.Getenv("ESXI_PASS"), "login `password` (ESXI_PASS)")
+	fs.StringVar(&a.tls.CAFile, "ca-file", os.Getenv("ESXI_CA_FILE"), "PEM CA bundle `file` to verify the host certificate (ESXI_CA_FILE)")
+	fs.StringVar(&a.tls.Thumbprint, "thumbprint", os.Getenv("ESXI_THUMBPRINT"), "expected SHA-1/SHA-256 certificate `thumbprint` (ESXI_THUMBPRINT)")
+	fs.BoolVar(&a.tls.Insecure, "insecure", os.Getenv("ESXI_INSECURE") == "true", "skip certificate verification (ESXI_INSECURE=true)")
+	fs.StringVar(&a.session, "session-file", os.Getenv("ESXI_SESSION_FILE"), "reuse the session saved in this `file` across runs, logging in and saving one if needed (ESXI_SESSION_FILE)")
+	fs.BoolVar(&a.auth.sso, "sso", os.Getenv("ESXI_SSO") == "true", "log in to vCenter with an SSO token issued for -user/-pass (ESXI_SSO=true)")
+	fs.StringVar(&a.auth.tokenFile, "token-file", os.Getenv("ESXI_TOKEN_FILE"), "log in to vCenter with the SAML token in this `file` (ESXI_TOKEN_FILE)")
+	fs.StringVar(&a.auth.certFile, "cert", os.Getenv("ESXI_CERT"), "holder-of-key certificate `file` for -sso/-token-file (ESXI_CERT)")
+	fs.StringVar(&a.auth.keyFile, "key", os.Getenv("ESXI_KEY"), "private key `file` of -cert (ESXI_KEY)")
+	fs.StringVar(&a.auth.ticket, "ticket", os.Getenv("ESXI_TICKET"), "join the session of a clone `ticket` from 'session ticket' (ESXI_TICKET)")
+	fs.StringVar(&a.output, "o", "table", "output `format`: table or json")
+	fs.BoolVar(&a.verbose, "v", false, "print task progress to stderr")
+	fs.DurationVar(&a.timeout, "timeout", 0, "abort the command after this `duration` (e.g. 30m), 0 for none")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if a.output != "table" && a.output != "json" {
+		return fmt.Errorf("unknown output format %q", a.output)
+	}
+	cmd, rest, ok := lookup(fs.Args())
+	if !ok {
+		usage(fs)
+		return errors.New("unknown or missing command")
+	}
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	if a.hosts != "" {
+		return a.runFleet(ctx, cmd, rest)
+	}
+	if err := a.connect(ctx); err != nil {
+		return err
+	}
+	defer a.logout()
+	return cmd.run(ctx, a, rest)
+}
+
+func lookup(args []string) (command, []string, bool) {
+	if len(args) == 0 {
+		return command{}, nil, false
+	}
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == c.name {
+			return c, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: gesxi [flags] <command> [command flags]")
+	fmt.Fprintln(w, "\nflags:")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\ncommands:")
+	width := 0
+	for _, c := range commands {
+		if len(c.name) > width {
+			width = len(c.name)
+		}
+	}
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, c.name, c.usage)
+	}
+}
+
+func (a *app) connect(ctx context.Context) error {
+	if a.host == "" {
+		return errors.New("host is required (-host or ESXI_HOST)")
+	}
+	if err := a.checkUser(); err != nil {
+		return err
+	}
+	esx, err := gesxi.NewEsxiService(ctx, a.host, a.user, a.pass, a.tls)
+	if err != nil {
+		return err
+	}
+	a.esx = esx
+	a.showProgress(esx, "")
+	login, err := a.login(a.esx)
+	if err != nil {
+		return err
+	}
+	if err := login(ctx); err != nil {
+		return fmt.Errorf("login to %s: %w", a.host, err)
+	}
+	return nil
+}
+
+func (a *app) checkUser() error {
+	if a.user == "" && a.auth.ticket == "" && a.auth.tokenFile == "" {
+		return errors.New("user is required (-user or ESXI_USER)")
+	}
+	return nil
+}
+
+// showProgress prints esx's task progress to stderr with -v, after
+// prefix.
+func (a *app) showProgress(esx *gesxi.EsxiService, prefix string) {
+	if !a.verbose {
+		return
+	}
+	esx.TaskProgress = func(info types.TaskInfo) {
+		fmt.Fprintf(os.Stderr, "%s%s %s: %s %d%%\n", prefix, info.Task.Value, info.DescriptionId, info.State, info.Progress)
+	}
 }
+
+// logout ends the session even when the command's context was cancelled,
+// so an interrupted run doesn't leak a session on the host. A saved
+// session is left open for the next run.
+func (a *app) logout() {
+	if a.session != "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.esx.Logout(ctx)
+}
+
+// newFlagSet returns a FlagSet for a subcommand that reports errors
+// instead of exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("gesxi "+name, flag.ContinueOnError)
+}
+
+// listFlag collects a comma separated and/or repeated flag value.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// kvFlag collects repeated key=value flags. Values may contain commas.
+type kvFlag map[string]string
+
+func (m kvFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m kvFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want key=value, got %q", v)
+	}
+	m[k] = val
+	return nil
+}
+
+// optBool is a boolean flag that also records whether it was given at
+// all, for settings that otherwise inherit: -promisc, -promisc=false.
+type optBool struct{ v *bool }
+
+func (b *optBool) String() string {
+	if b.v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.v)
+}
+
+func (b *optBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.v = &v
+	return nil
+}
+
+func (b *optBool) IsBoolFlag() bool { return true }
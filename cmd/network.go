@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ApogeeNetworking/gesxi"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func runPgAdd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("pg add")
+	var (
+		esx     = fs.String("esx", "", "target host `name` when more than one host is managed")
+		name    = fs.String("name", "", "port group `name` (required)")
+		vswitch = fs.String("vswitch", "vSwitch0", "vSwitch `name`")
+		vlan    = fs.Int("vlan", 0, "VLAN `id`")
+		trunk   = fs.Bool("trunk", false, "pass all VLANs to the guest (VLAN 4095)")
+		teaming = fs.String("teaming", "", "load balancing `policy`: loadbalance_srcid, loadbalance_ip, loadbalance_srcmac or failover_explicit")
+		avg     = fs.Int64("shaping-avg", 0, "enable traffic shaping with this average `Kbps`")
+		peak    = fs.Int64("shaping-peak", 0, "shaping peak `Kbps`, default the average")
+		burst   = fs.Int64("shaping-burst", 102400, "shaping burst size in `KB`")
+	)
+	var promisc, mac, forged, notify, failback optBool
+	var active, standby listFlag
+	fs.Var(&promisc, "promisc", "allow promiscuous mode; =false to deny, unset inherits the vSwitch")
+	fs.Var(&mac, "mac-change", "allow MAC address changes; =false to deny, unset inherits")
+	fs.Var(&forged, "forged-transmits", "allow forged transmits; =false to deny, unset inherits")
+	fs.Var(&notify, "notify-switches", "notify switches on failover; unset inherits")
+	fs.Var(&failback, "failback", "fail back to a recovered active uplink; unset inherits")
+	fs.Var(&active, "active", "active uplink `nics` in failover order, repeatable or comma separated")
+	fs.Var(&standby, "standby", "standby uplink `nics`, repeatable or comma separated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("pg add: -name is required")
+	}
+	if *trunk {
+		*vlan = gesxi.VlanTrunk
+	}
+	host, err := a.hostSystem(ctx, *esx)
+	if err != nil {
+		return err
+	}
+	if host.ConfigManager.NetworkSystem == nil {
+		return fmt.Errorf("pg add: %s has no network system", host.Name)
+	}
+	p := gesxi.AddPgParams{
+		HostNetSystemRef: *host.ConfigManager.NetworkSystem,
+		PgName:           *name,
+		PgVlanId:         *vlan,
+		VswitchName:      *vswitch,
+		Security: gesxi.NetSec{
+			AllowPromiscuous: promisc.v,
+			AllowMacChange:   mac.v,
+			ForgedXmits:      forged.v,
+		},
+	}
+	if *teaming != "" || active != nil || standby != nil || notify.v != nil || failback.v != nil {
+		p.Teaming = &gesxi.TeamingSpec{
+			Policy:         gesxi.TeamingPolicy(*teaming),
+			Active:         active,
+			Standby:        standby,
+			NotifySwitches: notify.v,
+			Failback:       failback.v,
+		}
+	}
+	if *avg > 0 {
+		if *peak == 0 {
+			*peak = *avg
+		}
+		p.Shaping = &gesxi.ShapingSpec{
+			Enabled:     types.NewBool(true),
+			AverageKbps: *avg,
+			PeakKbps:    *peak,
+			BurstKB:     *burst,
+		}
+	}
+	if err = a.esx.AddPG(ctx, p); err != nil {
+		return err
+	}
+	return a.status("added port group %s (vlan %d) to %s", *name, *vlan, *vswitch)
+}
+
+func runVswitchAdd(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vswitch add")
+	var (
+		esx   = fs.String("esx", "", "target host `name` when more than one host is managed")
+		name  = fs.String("name", "", "vSwitch `name` (required)")
+		ports = fs.Int("ports", 1024, "number of ports")
+		nics  listFlag
+	)
+	fs.Var(&nics, "nic", "physical `nic` to bind, repeatable or comma separated (e.g. vmnic1)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("vswitch add: -name is required")
+	}
+	host, err := a.hostSystem(ctx, *esx)
+	if err != nil {
+		return err
+	}
+	if host.ConfigManager.NetworkSystem == nil {
+		return fmt.Errorf("vswitch add: %s has no network system", host.Name)
+	}
+	spec := &types.HostVirtualSwitchSpec{NumPorts: int32(*ports)}
+	if len(nics) > 0 {
+		spec.Bridge = &types.HostVirtualSwitchBondBridge{NicDevice: nics}
+	}
+	err = a.esx.VswitchPost(ctx, gesxi.VswitchPostParams{
+		HostNetSystemRef: *host.ConfigManager.NetworkSystem,
+		Vswitch: gesxi.VswitchOp{
+			Name:     *name,
+			ChangeOp: types.HostConfigChangeOperationAdd,
+			Specs:    spec,
+		},
+		ChangMode: types.HostConfigChangeModeModify,
+	})
+	if err != nil {
+		return err
+	}
+	return a.status("added vSwitch %s", *name)
+}
+
+// netPlan loads the -f spec of a net command and plans it for the host
+// -esx picks.
+func netPlan(ctx context.Context, a *app, name string, args []string) (*gesxi.NetworkPlan, error) {
+	fs := newFlagSet(name)
+	var (
+		esx  = fs.String("esx", "", "target host `name` when more than one host is managed")
+		file = fs.String("f", "", "YAML or JSON network spec `file` (required)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *file == "" {
+		return nil, errors.New(name + ": -f is required")
+	}
+	spec, err := gesxi.LoadHostNetworkSpec(*file)
+	if err != nil {
+		return nil, err
+	}
+	host, err := a.hostSystem(ctx, *esx)
+	if err != nil {
+		return nil, err
+	}
+	return a.esx.PlanHostNetwork(ctx, host.Self, spec)
+}
+
+func planTable(plan *gesxi.NetworkPlan) table {
+	t := table{header: []string{"OP", "KIND", "NAME", "CHANGES"}, data: plan}
+	for _, c := range plan.Changes {
+		t.rows = append(t.rows, []string{string(c.Op), c.Kind, c.Name, strings.Join(c.Diffs, ", ")})
+	}
+	return t
+}
+
+func runNetPlan(ctx context.Context, a *app, args []string) error {
+	plan, err := netPlan(ctx, a, "net plan", args)
+	if err != nil {
+		return err
+	}
+	if plan.Empty() && a.output != "json" {
+		return a.status("%s", plan)
+	}
+	return a.render(planTable(plan))
+}
+
+func runNetApply(ctx context.Context, a *app, args []string) error {
+	plan, err := netPlan(ctx, a, "net apply", args)
+	if err != nil {
+		return err
+	}
+	if plan.Empty() {
+		return a.status("%s", plan)
+	}
+	if err := a.esx.ApplyHostNetwork(ctx, plan); err != nil {
+		return err
+	}
+	return a.render(planTable(plan))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// table is a result ready to be printed. data is what gets encoded for
+// JSON output, header/rows are used for table output.
+type table struct {
+	header []string
+	rows   [][]string
+	data   interface{}
+}
+
+func (a *app) render(t table) error {
+	if a.output == "json" {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(t.data)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+	for _, row := range t.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// status prints a one line result for commands that don't return data.
+func (a *app) status(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if a.output == "json" {
+		return a.render(table{data: map[string]string{"status": msg}})
+	}
+	_, err := fmt.Fprintln(a.out, msg)
+	return err
+}
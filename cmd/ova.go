@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+func runOvaImport(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("ova import")
+	var (
+		file       = fs.String("file", "", "OVA `path` (required)")
+		name       = fs.String("name", "", "VM `name` (required)")
+		esx        = fs.String("esx", "", "target host or cluster `name` or inventory path when more than one host is managed")
+		folder     = fs.String("folder", "", "VM folder inventory `path` (default: the datacenter's)")
+		datastore  = fs.String("datastore", "", "datastore `name` or inventory path (default: the host's datastore)")
+		provision  = fs.String("disk-provisioning", "thin", "disk provisioning: thin, thick, eagerZeroedThick")
+		deployment = fs.String("deployment", "", "deployment option `id` from the OVF")
+		powerOn    = fs.Bool("power-on", false, "power on after import")
+		pgs        listFlag
+	)
+	fs.Var(&pgs, "pg", "port group `name` to map OVF networks to, repeatable or comma separated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" || *name == "" {
+		return errors.New("ova import: -file and -name are required")
+	}
+	ova, err := a.esx.HandleOvaExtract(ctx, filepath.Dir(*file), filepath.Base(*file))
+	if err != nil {
+		return err
+	}
+	place, err := a.placement(ctx, *esx, *folder)
+	if err != nil {
+		return err
+	}
+	ds, err := a.datastore(ctx, *datastore)
+	if err != nil {
+		return err
+	}
+	networks, err := a.esx.GetNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	p := gesxi.HandleImportVAppParams{
+		Ova:        ova,
+		DcVmFolder: place.DcVmFolder,
+		HostSystem: place.HostSystem,
+		Datastore:  ds.Self,
+		RsrcPool:   place.RsrcPool,
+		NetSys:     networks,
+	}
+	p.Vm.Name = *name
+	p.Vm.PgNames = pgs
+	p.Vm.DiskProvisioning = *provision
+	p.Vm.DeploymentOptions = *deployment
+
+	leaseRef, items, err := a.esx.ImportVAppItems(ctx, p)
+	if err != nil {
+		return err
+	}
+	lease, err := a.esx.HandleLease(ctx, leaseRef)
+	if err != nil {
+		return err
+	}
+	if lease.Info == nil || len(lease.Info.DeviceUrl) == 0 {
+		a.esx.AbortLease(lease.Self)
+		return errors.New("ova import: lease has no device urls")
+	}
+	urls := gesxi.LeaseDiskUrls(lease, items)
+	err = a.esx.HandleDiskTransfers(ctx, urls, ova.Dir, ova.Disks, &lease, p)
+	if err != nil {
+		return err
+	}
+	if *powerOn {
+		if err := a.esx.Power(ctx, gesxi.PowerParams{Action: gesxi.PowerOn, Ref: lease.Info.Entity}); err != nil {
+			return err
+		}
+	}
+	return a.status("imported %s as %s", *file, lease.Info.Entity.Value)
+}
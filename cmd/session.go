@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+// authFlags are the global flags choosing how to log in instead of with
+// -user/-pass.
+type authFlags struct {
+	sso       bool
+	tokenFile string
+	certFile  string
+	keyFile   string
+	ticket    string
+}
+
+// login returns the login of esx the flags ask for.
+func (a *app) login(esx *gesxi.EsxiService) (func(context.Context) error, error) {
+	switch {
+	case a.auth.ticket != "":
+		return func(ctx context.Context) error {
+			return esx.LoginByCloneTicket(ctx, a.auth.ticket)
+		}, nil
+	case a.auth.sso || a.auth.tokenFile != "":
+		var p gesxi.TokenLoginParams
+		if a.auth.tokenFile != "" {
+			token, err := os.ReadFile(a.auth.tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			p.Token = string(token)
+		}
+		if a.auth.certFile != "" {
+			cert, err := tls.LoadX509KeyPair(a.auth.certFile, a.auth.keyFile)
+			if err != nil {
+				return nil, err
+			}
+			p.Certificate = &cert
+		}
+		return func(ctx context.Context) error {
+			return esx.LoginByToken(ctx, p)
+		}, nil
+	case a.session != "":
+		return func(ctx context.Context) error {
+			return esx.LoginWithSessionFile(ctx, a.session)
+		}, nil
+	}
+	return esx.Login, nil
+}
+
+func runSessionTicket(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("session ticket")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if a.session == "" {
+		return errors.New("session ticket: needs -session-file, the session ends when this run logs out")
+	}
+	ticket, err := a.esx.AcquireCloneTicket(ctx)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"TICKET"}, rows: [][]string{{ticket}}}
+	t.data = map[string]string{"ticket": ticket}
+	return a.render(t)
+}
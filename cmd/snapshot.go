@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/ApogeeNetworking/gesxi"
+)
+
+func runSnapshotCreate(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("snapshot create")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	var p gesxi.SnapshotParams
+	fs.StringVar(&p.Name, "name", "", "snapshot `name` (required)")
+	fs.StringVar(&p.Description, "description", "", "snapshot description")
+	fs.BoolVar(&p.Memory, "memory", false, "include the VM's memory")
+	fs.BoolVar(&p.Quiesce, "quiesce", false, "quiesce guest file systems (needs VMware Tools)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "snapshot create", *uuid)
+	if err != nil {
+		return err
+	}
+	ref, err := a.esx.CreateSnapshot(ctx, vm, p)
+	if err != nil {
+		return err
+	}
+	return a.status("created snapshot %s (%s) of %s", p.Name, ref.Value, vm.Name)
+}
+
+type snapshotRow struct {
+	Name    string `json:"name"`
+	Ref     string `json:"ref"`
+	Created string `json:"created"`
+	Power   string `json:"powerState"`
+	Current bool   `json:"current"`
+}
+
+func runSnapshotList(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("snapshot list")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "snapshot list", *uuid)
+	if err != nil {
+		return err
+	}
+	tree, err := a.esx.GetSnapshots(ctx, vm)
+	if err != nil {
+		return err
+	}
+	t := table{header: []string{"NAME", "REF", "CREATED", "POWER", "CURRENT"}, data: tree}
+	if tree == nil {
+		t.data = []gesxi.Snapshot{}
+	}
+	var walk func(nodes []gesxi.Snapshot, depth int)
+	walk = func(nodes []gesxi.Snapshot, depth int) {
+		for _, n := range nodes {
+			current := ""
+			if n.Current {
+				current = "*"
+			}
+			t.rows = append(t.rows, []string{
+				strings.Repeat("  ", depth) + n.Name, n.Ref.Value,
+				n.Created.Local().Format("2006-01-02 15:04:05"), string(n.PowerState), current,
+			})
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(tree, 0)
+	return a.render(t)
+}
+
+func runSnapshotRevert(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("snapshot revert")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	name := fs.String("name", "", "snapshot `name`, path (base/patched) or id; default the current snapshot")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "snapshot revert", *uuid)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		if err := a.esx.RevertToCurrentSnapshot(ctx, vm); err != nil {
+			return err
+		}
+		return a.status("reverted %s to its current snapshot", vm.Name)
+	}
+	if err := a.esx.RevertToSnapshot(ctx, vm, *name); err != nil {
+		return err
+	}
+	return a.status("reverted %s to %s", vm.Name, *name)
+}
+
+func runSnapshotRemove(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("snapshot remove")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	name := fs.String("name", "", "snapshot `name`, path (base/patched) or id")
+	children := fs.Bool("children", false, "also remove the snapshot's children")
+	all := fs.Bool("all", false, "remove every snapshot of the VM")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*name == "") == !*all {
+		return errors.New("snapshot remove: one of -name or -all is required")
+	}
+	vm, err := a.vmByUuid(ctx, "snapshot remove", *uuid)
+	if err != nil {
+		return err
+	}
+	if *all {
+		if err := a.esx.RemoveAllSnapshots(ctx, vm); err != nil {
+			return err
+		}
+		return a.status("removed all snapshots of %s", vm.Name)
+	}
+	if err := a.esx.RemoveSnapshot(ctx, vm, *name, *children); err != nil {
+		return err
+	}
+	return a.status("removed snapshot %s of %s", *name, vm.Name)
+}
+
+func runSnapshotConsolidate(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("snapshot consolidate")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "snapshot consolidate", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.ConsolidateVmDisks(ctx, vm); err != nil {
+		return err
+	}
+	return a.status("consolidated disks of %s", vm.Name)
+}
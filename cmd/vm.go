@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ApogeeNetworking/gesxi"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vmByUuid looks up the VM for a command's required -uuid flag.
+func (a *app) vmByUuid(ctx context.Context, cmd, uuid string) (mo.VirtualMachine, error) {
+	if uuid == "" {
+		return mo.VirtualMachine{}, errors.New(cmd + ": -uuid is required")
+	}
+	return a.esx.GetVmByUuid(ctx, uuid)
+}
+
+func runVmCreate(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm create")
+	var (
+		name       = fs.String("name", "", "VM `name` (required)")
+		cpus       = fs.Int("cpus", 1, "number of vCPUs")
+		mem        = fs.Int64("mem", 1024, "memory in `MB`")
+		annotation = fs.String("annotation", "", "VM notes")
+		datastore  = fs.String("datastore", "", "datastore `name` (default: the host's datastore)")
+		esx        = fs.String("esx", "", "target host or cluster `name` or inventory path when more than one host is managed")
+		folder     = fs.String("folder", "", "VM folder inventory `path`, e.g. /DC1/vm/lab (default: the datacenter's)")
+		guest      = fs.String("guest", "", "guest OS `id`, e.g. ubuntu64Guest")
+		firmware   = fs.String("firmware", "", "boot firmware: bios or efi")
+		secureBoot = fs.Bool("secure-boot", false, "enable EFI secure boot")
+		iso        = fs.String("iso", "", "add a cdrom with this datastore `path` mounted, e.g. \"[datastore1] ISOs/os.iso\"")
+		powerOn    = fs.Bool("power-on", false, "power on after creation")
+		ctrls      listFlag
+		disks      listFlag
+		nics       listFlag
+		boot       listFlag
+	)
+	fs.Var(&ctrls, "controller", "storage `controller` to add: pvscsi, lsilogic, lsilogic-sas, buslogic, nvme, sata, ide (repeatable)")
+	fs.Var(&disks, "disk", "disk `size[:controller]` in GB, e.g. 40 or 100:nvme (repeatable)")
+	fs.Var(&nics, "nic", "nic `portgroup[:adapter]`, adapter vmxnet3 (default), e1000e, e1000, sriov (repeatable)")
+	fs.Var(&boot, "boot", "boot `order` of disk, cdrom, ethernet, comma separated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("vm create: -name is required")
+	}
+	p := gesxi.CreateVmParams{
+		Name:       *name,
+		NumCpus:    int32(*cpus),
+		MemoryMB:   *mem,
+		Annotation: *annotation,
+		GuestId:    *guest,
+		Firmware:   gesxi.Firmware(*firmware),
+		SecureBoot: *secureBoot,
+	}
+	for _, c := range ctrls {
+		p.Controllers = append(p.Controllers, gesxi.ControllerType(c))
+	}
+	for _, d := range disks {
+		size, ctrl, _ := strings.Cut(d, ":")
+		gb, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("vm create: bad -disk %q", d)
+		}
+		p.Disks = append(p.Disks, gesxi.DiskSpec{CapacityGB: gb, Controller: gesxi.ControllerType(ctrl)})
+	}
+	for _, n := range nics {
+		pg, adapter, _ := strings.Cut(n, ":")
+		p.Nics = append(p.Nics, gesxi.NicSpec{Network: pg, Adapter: gesxi.NicAdapter(adapter)})
+	}
+	if *iso != "" {
+		p.Cdrom = &gesxi.CdromSpec{IsoPath: *iso}
+	}
+	for _, b := range boot {
+		p.BootOrder = append(p.BootOrder, gesxi.BootDevice(b))
+	}
+	place, err := a.placement(ctx, *esx, *folder)
+	if err != nil {
+		return err
+	}
+	if *datastore == "" {
+		ds, err := a.esx.GetDatastore(ctx)
+		if err != nil {
+			return err
+		}
+		*datastore = ds.Name
+	}
+	p.DatastoreName = *datastore
+	p.DcVmFolder = place.DcVmFolder
+	p.RsrcPool = place.RsrcPool
+	p.HostSystem = place.HostSystem
+	vm, err := a.esx.CreateVm(ctx, p)
+	if err != nil {
+		return err
+	}
+	if *powerOn {
+		if err := a.esx.Power(ctx, gesxi.PowerParams{Action: gesxi.PowerOn, Ref: vm.Self}); err != nil {
+			return err
+		}
+	}
+	if vm, err = a.esx.GetVmByUuid(ctx, vm.Config.Uuid); err != nil {
+		return err
+	}
+	return a.render(vmTable(vm))
+}
+
+func runVmAddDisk(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm add-disk")
+	var (
+		uuid      = fs.String("uuid", "", "VM BIOS `uuid` (required)")
+		sizeGB    = fs.Int64("size", 0, "disk size in `GB`")
+		sizeMB    = fs.Int64("size-mb", 0, "disk size in `MB`, when -size isn't given")
+		provision = fs.String("provisioning", "thin", "thin, lazyZeroedThick or eagerZeroedThick")
+		mode      = fs.String("mode", "", "disk `mode`, e.g. persistent, independent_persistent")
+		datastore = fs.String("datastore", "", "datastore `name` (default: the VM's datastore)")
+		ctrl      = fs.String("controller", "", "`controller` type: pvscsi, lsilogic, lsilogic-sas, buslogic, nvme, sata, ide (default: the VM's)")
+		unit      = fs.Int("unit", -1, "controller `unit` number (default: first free)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "vm add-disk", *uuid)
+	if err != nil {
+		return err
+	}
+	d := gesxi.DiskSpec{
+		CapacityGB:   *sizeGB,
+		CapacityMB:   *sizeMB,
+		Provisioning: gesxi.DiskProvisioning(*provision),
+		Mode:         types.VirtualDiskMode(*mode),
+		Datastore:    *datastore,
+		Controller:   gesxi.ControllerType(*ctrl),
+	}
+	if *unit >= 0 {
+		n := int32(*unit)
+		d.UnitNumber = &n
+	}
+	if err := a.esx.AddDiskToVm(ctx, vm, d); err != nil {
+		return err
+	}
+	return a.status("added disk to %s", vm.Name)
+}
+
+func runVmAddNic(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm add-nic")
+	var (
+		uuid         = fs.String("uuid", "", "VM BIOS `uuid` (required)")
+		network      = fs.String("network", "", "standard or distributed port group `name` (required)")
+		adapter      = fs.String("adapter", "vmxnet3", "adapter `type`: vmxnet3, e1000e, e1000, sriov")
+		mac          = fs.String("mac", "", "static MAC `address` (default: generated)")
+		disconnected = fs.Bool("disconnected", false, "add the nic disconnected")
+		noStart      = fs.Bool("no-start-connected", false, "don't connect the nic at power on")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *network == "" {
+		return errors.New("vm add-nic: -network is required")
+	}
+	vm, err := a.vmByUuid(ctx, "vm add-nic", *uuid)
+	if err != nil {
+		return err
+	}
+	connected, startConnected := !*disconnected, !*noStart
+	err = a.esx.AddNicToVm(ctx, vm, gesxi.NicSpec{
+		Network:        *network,
+		Adapter:        gesxi.NicAdapter(*adapter),
+		MacAddress:     *mac,
+		Connected:      &connected,
+		StartConnected: &startConnected,
+	})
+	if err != nil {
+		return err
+	}
+	return a.status("added nic on %s to %s", *network, vm.Name)
+}
+
+func runVmClone(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm clone")
+	var (
+		p    gesxi.CloneVmParams
+		nics listFlag
+	)
+	fs.StringVar(&p.SourceUuid, "uuid", "", "BIOS `uuid` of the VM to clone (required)")
+	fs.StringVar(&p.Name, "name", "", "clone `name` (required)")
+	fs.StringVar(&p.DatastoreName, "datastore", "", "datastore `name` (default: the source's)")
+	esx := fs.String("esx", "", "target host or cluster `name` or inventory path (default: the source's; required for templates)")
+	fs.StringVar(&p.Snapshot, "snapshot", "", "clone from this snapshot `name`, path or id")
+	fs.BoolVar(&p.Linked, "linked", false, "linked clone from the snapshot (vCenter only)")
+	fs.BoolVar(&p.PowerOn, "power-on", false, "power on the clone")
+	cpus := fs.Int("cpus", 0, "number of vCPUs (default: the source's)")
+	fs.Int64Var(&p.MemoryMB, "mem", 0, "memory in `MB` (default: the source's)")
+	fs.Var(&nics, "nic", "replace the source's nics with `portgroup[:adapter]` (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if p.SourceUuid == "" || p.Name == "" {
+		return errors.New("vm clone: -uuid and -name are required")
+	}
+	p.NumCpus = int32(*cpus)
+	for _, n := range nics {
+		pg, adapter, _ := strings.Cut(n, ":")
+		p.Nics = append(p.Nics, gesxi.NicSpec{Network: pg, Adapter: gesxi.NicAdapter(adapter)})
+	}
+	if *esx != "" {
+		place, err := a.esx.GetPlacement(ctx, *esx)
+		if err != nil {
+			return err
+		}
+		p.RsrcPool = place.RsrcPool
+	}
+	vm, err := a.esx.CloneVm(ctx, p)
+	if err != nil {
+		return err
+	}
+	return a.render(vmTable(vm))
+}
+
+func runVmReconfigure(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm reconfigure")
+	var (
+		p     gesxi.ReconfigureVmParams
+		extra = kvFlag{}
+	)
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	cpus := fs.Int("cpus", 0, "number of vCPUs")
+	cores := fs.Int("cores", 0, "cores per socket")
+	fs.Int64Var(&p.MemoryMB, "mem", 0, "memory in `MB`")
+	cpuRes := fs.Int64("cpu-reservation", 0, "CPU reservation in `MHz`")
+	cpuLimit := fs.Int64("cpu-limit", 0, "CPU limit in `MHz`, -1 for unlimited")
+	memRes := fs.Int64("mem-reservation", 0, "memory reservation in `MB`")
+	memLimit := fs.Int64("mem-limit", 0, "memory limit in `MB`, -1 for unlimited")
+	reserveAll := fs.Bool("mem-reserve-all", false, "reserve all guest memory")
+	cpuHotAdd := fs.Bool("cpu-hot-add", false, "enable CPU hot add")
+	cpuHotRemove := fs.Bool("cpu-hot-remove", false, "enable CPU hot remove")
+	memHotAdd := fs.Bool("mem-hot-add", false, "enable memory hot add")
+	annotation := fs.String("annotation", "", "VM notes")
+	fs.Var(extra, "extra", "advanced setting `key=value`, e.g. guestinfo.hostname=lab01; empty value removes it (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "vm reconfigure", *uuid)
+	if err != nil {
+		return err
+	}
+	p.NumCpus, p.CoresPerSocket = int32(*cpus), int32(*cores)
+	p.ExtraConfig = extra
+	// Only the flags given on the command line change anything
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "cpu-reservation":
+			p.CpuReservationMHz = cpuRes
+		case "cpu-limit":
+			p.CpuLimitMHz = cpuLimit
+		case "mem-reservation":
+			p.MemReservationMB = memRes
+		case "mem-limit":
+			p.MemLimitMB = memLimit
+		case "mem-reserve-all":
+			p.MemReserveAll = reserveAll
+		case "cpu-hot-add":
+			p.CpuHotAdd = cpuHotAdd
+		case "cpu-hot-remove":
+			p.CpuHotRemove = cpuHotRemove
+		case "mem-hot-add":
+			p.MemoryHotAdd = memHotAdd
+		case "annotation":
+			p.Annotation = annotation
+		}
+	})
+	if err := a.esx.ReconfigureVm(ctx, vm, p); err != nil {
+		return err
+	}
+	if vm, err = a.esx.GetVmByUuid(ctx, *uuid); err != nil {
+		return err
+	}
+	return a.render(vmTable(vm))
+}
+
+func runVmDestroy(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm destroy")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "vm destroy", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.DestroyVm(ctx, vm); err != nil {
+		return err
+	}
+	return a.status("destroyed %s", vm.Name)
+}
+
+func runVmUnregister(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm unregister")
+	uuid := fs.String("uuid", "", "VM BIOS `uuid` (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vm, err := a.vmByUuid(ctx, "vm unregister", *uuid)
+	if err != nil {
+		return err
+	}
+	if err := a.esx.UnregisterVm(ctx, vm); err != nil {
+		return err
+	}
+	return a.status("unregistered %s (%s)", vm.Name, vm.Config.Files.VmPathName)
+}
+
+func runVmRegister(ctx context.Context, a *app, args []string) error {
+	fs := newFlagSet("vm register")
+	vmx := fs.String("vmx", "", "datastore `path` of the .vmx, e.g. \"[datastore1] lab01/lab01.vmx\" (required)")
+	name := fs.String("name", "", "inventory `name` (default: the one in the .vmx)")
+	esx := fs.String("esx", "", "target host or cluster `name` or inventory path when more than one host is managed")
+	folder := fs.String("folder", "", "VM folder inventory `path` (default: the datacenter's)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *vmx == "" {
+		return errors.New("vm register: -vmx is required")
+	}
+	place, err := a.placement(ctx, *esx, *folder)
+	if err != nil {
+		return err
+	}
+	vm, err := a.esx.RegisterVm(ctx, gesxi.RegisterVmParams{
+		VmxPath:    *vmx,
+		Name:       *name,
+		DcVmFolder: place.DcVmFolder,
+		RsrcPool:   place.RsrcPool,
+		HostSystem: place.HostSystem,
+	})
+	if err != nil {
+		return err
+	}
+	return a.render(vmTable(vm))
+}
+
+func runPowerOn(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerOn, args)
+}
+
+func runPowerOff(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerOff, args)
+}
+
+func runPowerReset(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerReset, args)
+}
+
+func runPowerSuspend(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerSuspend, args)
+}
+
+func runPowerShutdown(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerShutdownGuest, args)
+}
+
+func runPowerReboot(ctx context.Context, a *app, args []string) error {
+	return a.power(ctx, gesxi.PowerRebootGuest, args)
+}
+
+func (a *app) power(ctx context.Context, action gesxi.PowerAction, args []string) error {
+	name := "power " + string(action)
+	fs := newFlagSet(name)
+	uuid := fs.String("uuid", "", "VM BIOS `uuid`")
+	vapp := fs.String("vapp", "", "vApp managed object `id` (e.g. resgroup-v10)")
+	p := gesxi.PowerParams{Action: action}
+	if action == gesxi.PowerShutdownGuest || action == gesxi.PowerRebootGuest {
+		fs.BoolVar(&p.Force, "force", false, "power off/reset hard when the guest can't be reached or doesn't shut down in time")
+	}
+	switch action {
+	case gesxi.PowerShutdownGuest:
+		fs.DurationVar(&p.GuestTimeout, "guest-timeout", 0, "how long the guest gets to shut down, e.g. 5m")
+		fs.BoolVar(&p.Wait, "wait", false, "wait until the VM is powered off")
+	case gesxi.PowerRebootGuest:
+		fs.DurationVar(&p.GuestTimeout, "guest-timeout", 0, "how long the guest gets to start rebooting, e.g. 5m")
+		fs.BoolVar(&p.Wait, "wait", false, "wait until the guest is running again")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *uuid != "":
+		vm, err := a.esx.GetVmByUuid(ctx, *uuid)
+		if err != nil {
+			return err
+		}
+		p.Ref = vm.Self
+	case *vapp != "":
+		p.Ref = types.ManagedObjectReference{Type: "VirtualApp", Value: *vapp}
+	default:
+		return errors.New(name + ": -uuid or -vapp is required")
+	}
+	if err := a.esx.Power(ctx, p); err != nil {
+		return err
+	}
+	return a.status("%s %s", name, p.Ref.Value)
+}
@@ -0,0 +1,235 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VmDevice is a readable summary of one of a VM's virtual devices
+type VmDevice struct {
+	// e.g. disk-1000-0 or ethernet-0, what the device methods take
+	Name string `json:"name"`
+	Key  int32  `json:"key"`
+	// VirtualDisk, VirtualVmxnet3, VirtualCdrom, ...
+	Type string `json:"type"`
+	// As shown in the host client, e.g. "Hard disk 1"
+	Label   string `json:"label"`
+	Summary string `json:"summary,omitempty"`
+	// Name of the controller the device is attached to, if any
+	Controller string `json:"controller,omitempty"`
+	UnitNumber *int32 `json:"unitNumber,omitempty"`
+	// Disks, and ISO-backed CD-ROMs for FileName
+	CapacityKB int64  `json:"capacityKB,omitempty"`
+	FileName   string `json:"fileName,omitempty"`
+	// NICs
+	Network    string `json:"network,omitempty"`
+	MacAddress string `json:"macAddress,omitempty"`
+	// Connectable devices (NICs, CD-ROMs)
+	Connected      *bool `json:"connected,omitempty"`
+	StartConnected *bool `json:"startConnected,omitempty"`
+}
+
+// GetVmDevices lists vm's devices. NIC network names are looked up from
+// their port group keys where needed.
+func (s *EsxiService) GetVmDevices(ctx context.Context, vm mo.VirtualMachine) ([]VmDevice, error) {
+	netNames, err := s.networkNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return vmDevices(object.VirtualDeviceList(vm.Config.Hardware.Device), netNames), nil
+}
+
+// networkNames maps network moref values to network names, for resolving
+// the port group keys of distributed port group backings.
+func (s *EsxiService) networkNames(ctx context.Context) (map[string]string, error) {
+	v, err := s.getView(ctx, "Network")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var networks []mo.Network
+	if err = v.Retrieve(ctx, []string{"Network"}, []string{"name"}, &networks); err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, n := range networks {
+		names[n.Self.Value] = n.Name
+	}
+	return names, nil
+}
+
+func vmDevices(devices object.VirtualDeviceList, netNames map[string]string) []VmDevice {
+	list := make([]VmDevice, 0, len(devices))
+	for _, d := range devices {
+		vd := d.GetVirtualDevice()
+		dev := VmDevice{
+			Name:       devices.Name(d),
+			Key:        vd.Key,
+			Type:       devices.TypeName(d),
+			UnitNumber: vd.UnitNumber,
+		}
+		if vd.DeviceInfo != nil {
+			info := vd.DeviceInfo.GetDescription()
+			dev.Label, dev.Summary = info.Label, info.Summary
+		}
+		if c := devices.FindByKey(vd.ControllerKey); c != nil {
+			dev.Controller = devices.Name(c)
+		}
+		if file, ok := vd.Backing.(types.BaseVirtualDeviceFileBackingInfo); ok {
+			dev.FileName = file.GetVirtualDeviceFileBackingInfo().FileName
+		}
+		if vd.Connectable != nil {
+			dev.Connected = types.NewBool(vd.Connectable.Connected)
+			dev.StartConnected = types.NewBool(vd.Connectable.StartConnected)
+		}
+		switch d := d.(type) {
+		case *types.VirtualDisk:
+			dev.CapacityKB = d.CapacityInKB
+		case types.BaseVirtualEthernetCard:
+			dev.MacAddress = d.GetVirtualEthernetCard().MacAddress
+			switch b := vd.Backing.(type) {
+			case *types.VirtualEthernetCardNetworkBackingInfo:
+				dev.Network = b.DeviceName
+			case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+				dev.Network = netNames[b.Port.PortgroupKey]
+			case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+				dev.Network = b.OpaqueNetworkId
+			}
+		}
+		list = append(list, dev)
+	}
+	return list
+}
+
+// RemoveDisk detaches the disk named name (e.g. disk-1000-0, or its label
+// "Hard disk 2") from vm. With deleteFiles its vmdk is destroyed too,
+// otherwise it stays on the datastore.
+func (s *EsxiService) RemoveDisk(ctx context.Context, vm mo.VirtualMachine, name string, deleteFiles bool) error {
+	d, err := findDevice(vm, name, (*types.VirtualDisk)(nil))
+	if err != nil {
+		return err
+	}
+	change := &types.VirtualDeviceConfigSpec{
+		Operation: types.VirtualDeviceConfigSpecOperationRemove,
+		Device:    d,
+	}
+	if deleteFiles {
+		change.FileOperation = types.VirtualDeviceConfigSpecFileOperationDestroy
+	}
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{
+		DeviceChange: []types.BaseVirtualDeviceConfigSpec{change},
+	})
+}
+
+// GrowDisk extends the disk named name to capacityGB. Disks can't shrink,
+// and a disk with snapshots can't be resized until they're removed. The
+// guest's partitions still need extending afterwards.
+func (s *EsxiService) GrowDisk(ctx context.Context, vm mo.VirtualMachine, name string, capacityGB int64) error {
+	d, err := findDevice(vm, name, (*types.VirtualDisk)(nil))
+	if err != nil {
+		return err
+	}
+	disk := *d.(*types.VirtualDisk)
+	kb := capacityGB * 1024 * 1024
+	if kb <= disk.CapacityInKB {
+		return fmt.Errorf("grow %s on %s: disk is already %d GB, disks can't shrink", name, vm.Name, disk.CapacityInKB/1024/1024)
+	}
+	disk.CapacityInKB, disk.CapacityInBytes = kb, kb*1024
+	// No file operation: the existing vmdk is extended in place
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{
+		DeviceChange: []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    &disk,
+		}},
+	})
+}
+
+// RemoveNic removes the network adapter named name (e.g. ethernet-0, or
+// its label "Network adapter 1") from vm.
+func (s *EsxiService) RemoveNic(ctx context.Context, vm mo.VirtualMachine, name string) error {
+	d, err := findDevice(vm, name, (*types.VirtualEthernetCard)(nil))
+	if err != nil {
+		return err
+	}
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{
+		DeviceChange: []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationRemove,
+			Device:    d,
+		}},
+	})
+}
+
+// SetNicNetwork moves the network adapter named name to the standard or
+// distributed port group network, keeping its MAC. It works on running
+// VMs.
+func (s *EsxiService) SetNicNetwork(ctx context.Context, vm mo.VirtualMachine, name, network string) error {
+	networks, err := s.GetNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	backing, err := s.nicBacking(ctx, networks, network)
+	if err != nil {
+		return fmt.Errorf("set network of %s on %s: %w", name, vm.Name, err)
+	}
+	return s.editNic(ctx, vm, name, func(vd *types.VirtualDevice) {
+		vd.Backing = backing
+	})
+}
+
+// SetNicConnected connects or disconnects the network adapter named name
+// on a running VM, and whether it connects at power on to match.
+func (s *EsxiService) SetNicConnected(ctx context.Context, vm mo.VirtualMachine, name string, connected bool) error {
+	return s.editNic(ctx, vm, name, func(vd *types.VirtualDevice) {
+		setConnected(vd, connected)
+	})
+}
+
+func (s *EsxiService) editNic(ctx context.Context, vm mo.VirtualMachine, name string, edit func(*types.VirtualDevice)) error {
+	d, err := findDevice(vm, name, (*types.VirtualEthernetCard)(nil))
+	if err != nil {
+		return err
+	}
+	d = copyDevice(d)
+	edit(d.GetVirtualDevice())
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{
+		DeviceChange: []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    d,
+		}},
+	})
+}
+
+// findDevice returns the device of vm called name, by device name or
+// label, checking it is of kind's type.
+func findDevice(vm mo.VirtualMachine, name string, kind types.BaseVirtualDevice) (types.BaseVirtualDevice, error) {
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+	d := devices.Find(name)
+	if d == nil {
+		for _, dev := range devices {
+			if info := dev.GetVirtualDevice().DeviceInfo; info != nil && info.GetDescription().Label == name {
+				d = dev
+				break
+			}
+		}
+	}
+	if d == nil {
+		return nil, fmt.Errorf("device %s on %s: %w", name, vm.Name, ErrNotFound)
+	}
+	if len(object.VirtualDeviceList{d}.SelectByType(kind)) == 0 {
+		return nil, fmt.Errorf("device %s on %s is a %s", name, vm.Name, devices.TypeName(d))
+	}
+	return d, nil
+}
+
+// copyDevice returns a shallow copy of d, so edits for a config spec leave
+// the VM's device list untouched.
+func copyDevice(d types.BaseVirtualDevice) types.BaseVirtualDevice {
+	c := reflect.New(reflect.TypeOf(d).Elem())
+	c.Elem().Set(reflect.ValueOf(d).Elem())
+	return c.Interface().(types.BaseVirtualDevice)
+}
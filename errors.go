@@ -0,0 +1,87 @@
+package gesxi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Connection failure kinds reported by NewEsxiService. A ctx cancelled or
+// timed out while connecting is returned as ctx's error instead. Test for
+// them with errors.Is:
+//
+//	esx, err := gesxi.NewEsxiService(ctx, host, user, pass, gesxi.Options{})
+//	if errors.Is(err, gesxi.ErrUnreachable) {
+//		// retry later
+//	}
+var (
+	ErrInvalidURL     = errors.New("invalid host url")
+	ErrUnreachable    = errors.New("host unreachable")
+	ErrTLS            = errors.New("tls verification failed")
+	ErrNotVimEndpoint = errors.New("not an esxi/vcenter endpoint")
+)
+
+// ErrNotFound is wrapped by lookups that find nothing, e.g. GetVmByUuid
+// for a VM that has been destroyed or unregistered.
+var ErrNotFound = errors.New("not found")
+
+// ErrSessionExpired is returned when resuming a saved session the host
+// has already logged out or timed out.
+var ErrSessionExpired = errors.New("session expired")
+
+// ErrSessionMismatch is returned when resuming a saved session of another
+// host or user.
+var ErrSessionMismatch = errors.New("session of another host or user")
+
+// ErrAmbiguous is wrapped by lookups matching more than one object, e.g.
+// GetDatastore on a host with several datastores.
+var ErrAmbiguous = errors.New("ambiguous")
+
+// ConnectError is returned when the initial connection to an ESXi host or
+// vCenter fails. Kind is one of the Err* values above and Err is the
+// underlying cause.
+type ConnectError struct {
+	URL  string
+	Kind error
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("connect %s: %v", e.URL, e.Kind)
+	}
+	return fmt.Sprintf("connect %s: %v: %v", e.URL, e.Kind, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the failure kind of e.
+func (e *ConnectError) Is(target error) bool { return target == e.Kind }
+
+// connectErrKind maps an error from the initial ServiceContent retrieval
+// to one of the connection failure kinds.
+func connectErrKind(err error) error {
+	var (
+		unknownAuth x509.UnknownAuthorityError
+		hostname    x509.HostnameError
+		invalid     x509.CertificateInvalidError
+		record      tls.RecordHeaderError
+		opErr       *net.OpError
+		dnsErr      *net.DNSError
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &unknownAuth), errors.As(err, &hostname),
+		errors.As(err, &invalid), errors.As(err, &record),
+		errors.Is(err, errThumbprintMismatch),
+		strings.Contains(err.Error(), "tls: "):
+		return ErrTLS
+	case errors.As(err, &opErr), errors.As(err, &dnsErr),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrUnreachable
+	}
+	return ErrNotVimEndpoint
+}
@@ -2,9 +2,15 @@ package gesxi
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/session/keepalive"
+	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/soap"
 )
@@ -13,26 +19,197 @@ type esxClient struct {
 	*vim25.Client
 	SessionManager *session.Manager
 	Userinfo       *url.Userinfo
+	tlsConfig      *tls.Config
+	sessions       *reloginRoundTripper
+	keepalive      *keepalive.HandlerSOAP
+
+	// vCenter REST API client, logged in on first use and shared until
+	// Logout. restLogin logs it in the way the SOAP session was
+	restMu    sync.Mutex
+	rest      *rest.Client
+	restLogin func(ctx context.Context, rc *rest.Client) error
 }
 
 func (e *esxClient) Login(ctx context.Context, u *url.Userinfo) error {
-	return e.SessionManager.Login(ctx, u)
+	if err := e.SessionManager.Login(ctx, u); err != nil {
+		return err
+	}
+	e.sessions.setLogin(func(ctx context.Context) error {
+		return e.SessionManager.Login(ctx, u)
+	})
+	e.setRestLogin(ctx, nil)
+	return nil
+}
+
+// Resume adopts the session with the given cookie value, checking with
+// the SessionManager that it is still logged in. Calls that later find it
+// expired log in with u.
+func (e *esxClient) Resume(ctx context.Context, cookie string, u *url.Userinfo) error {
+	// Without a login to fall back on, a dead cookie can't be renewed
+	// behind UserSession's back
+	e.sessions.setLogin(nil)
+	e.Jar.SetCookies(e.URL(), []*http.Cookie{{Name: soap.SessionCookieName, Value: cookie, Path: "/"}})
+	us, err := e.SessionManager.UserSession(ctx)
+	if err != nil {
+		return err
+	}
+	if us == nil {
+		e.Jar.SetCookies(e.URL(), []*http.Cookie{{Name: soap.SessionCookieName, Path: "/", MaxAge: -1}})
+		return ErrSessionExpired
+	}
+	e.sessions.setLogin(func(ctx context.Context) error {
+		return e.SessionManager.Login(ctx, u)
+	})
+	e.setRestLogin(ctx, nil)
+	if e.keepalive != nil {
+		e.keepalive.Start()
+	}
+	return nil
+}
+
+// sessionCookie returns the current session's cookie value, if any.
+func (e *esxClient) sessionCookie() string {
+	for _, c := range e.Jar.Cookies(e.URL()) {
+		if c.Name == soap.SessionCookieName {
+			return c.Value
+		}
+	}
+	return ""
 }
 
 func (e *esxClient) Logout(ctx context.Context) error {
 	defer e.Client.CloseIdleConnections()
-	return e.SessionManager.Logout(ctx)
+	e.sessions.setLogin(nil)
+	restErr := e.setRestLogin(ctx, nil)
+	if err := e.SessionManager.Logout(ctx); err != nil {
+		return err
+	}
+	if restErr != nil {
+		return fmt.Errorf("rest logout: %w", restErr)
+	}
+	return nil
+}
+
+// setRestLogin changes how the REST client logs in, a nil login meaning
+// with the SOAP session. A client logged in the old way is logged out.
+func (e *esxClient) setRestLogin(ctx context.Context, login func(ctx context.Context, rc *rest.Client) error) error {
+	e.restMu.Lock()
+	rc := e.rest
+	e.rest, e.restLogin = nil, login
+	e.restMu.Unlock()
+	if rc == nil {
+		return nil
+	}
+	return rc.Logout(ctx)
 }
 
-func newEsxClient(ctx context.Context, uri, user, pass string) *esxClient {
-	u, _ := soap.ParseURL(uri)
+// vapi returns the REST client, logging it in if it isn't yet.
+func (e *esxClient) vapi(ctx context.Context) (*rest.Client, error) {
+	e.restMu.Lock()
+	defer e.restMu.Unlock()
+	if e.rest != nil {
+		return e.rest, nil
+	}
+	// The service client starts out with the SOAP session's cookie
+	rc := rest.NewClient(e.Client)
+	login := e.restLogin
+	if login == nil {
+		login = e.restLoginBySession
+	}
+	if err := login(ctx, rc); err != nil {
+		return nil, err
+	}
+	e.rest = rc
+	return rc, nil
+}
+
+// restLoginBySession logs rc in on the strength of the SOAP session cookie
+// it carries. Where that isn't accepted, the password is tried, if the
+// client has one.
+func (e *esxClient) restLoginBySession(ctx context.Context, rc *rest.Client) error {
+	err := rc.Login(ctx, nil)
+	if err == nil {
+		return nil
+	}
+	if pass, _ := e.Userinfo.Password(); pass == "" {
+		return err
+	}
+	return rc.Login(ctx, e.Userinfo)
+}
+
+// withVapi calls fn with the REST client. If fn fails because the client's
+// session has expired, it is logged in again and fn retried once.
+func (e *esxClient) withVapi(ctx context.Context, fn func(rc *rest.Client) error) error {
+	rc, err := e.vapi(ctx)
+	if err != nil {
+		return err
+	}
+	if err = fn(rc); err == nil {
+		return nil
+	}
+	if s, serr := rc.Session(ctx); serr != nil || s != nil {
+		return err
+	}
+	e.restMu.Lock()
+	if e.rest == rc {
+		e.rest = nil
+	}
+	e.restMu.Unlock()
+	if rc, err = e.vapi(ctx); err != nil {
+		return err
+	}
+	return fn(rc)
+}
+
+func newEsxClient(ctx context.Context, uri, user, pass string, opts Options) (*esxClient, error) {
+	u, err := soap.ParseURL(uri)
+	if err != nil {
+		return nil, &ConnectError{URL: uri, Kind: ErrInvalidURL, Err: err}
+	}
+	if u == nil || u.Hostname() == "" {
+		return nil, &ConnectError{URL: uri, Kind: ErrInvalidURL}
+	}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
 	u.User = url.UserPassword(user, pass)
-	soapClient := soap.NewClient(u, true)
-	vimClient, _ := vim25.NewClient(ctx, soapClient)
+	soapClient := soap.NewClient(u, opts.Insecure)
+	soapClient.DefaultTransport().TLSClientConfig = tlsConfig
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		// The caller gave up, which says nothing about the host
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("connect %s: %w", uri, ctxErr)
+		}
+		return nil, &ConnectError{URL: uri, Kind: connectErrKind(err), Err: err}
+	}
+	// Anything answering RetrieveServiceContent should be a host agent or
+	// vCenter, but make sure before handing it back
+	switch vimClient.ServiceContent.About.ApiType {
+	case "HostAgent", "VirtualCenter":
+	default:
+		return nil, &ConnectError{
+			URL:  uri,
+			Kind: ErrNotVimEndpoint,
+			Err:  fmt.Errorf("unexpected api type %q", vimClient.ServiceContent.About.ApiType),
+		}
+	}
+	var rt soap.RoundTripper = soapClient
+	var ka *keepalive.HandlerSOAP
+	if opts.KeepAlive > 0 {
+		ka = keepalive.NewHandlerSOAP(rt, opts.KeepAlive, nil)
+		rt = ka
+	}
+	sessions := &reloginRoundTripper{RoundTripper: rt, onRenew: opts.OnSessionRenew}
+	vimClient.RoundTripper = sessions
 	client := &esxClient{
 		Client:         vimClient,
 		SessionManager: session.NewManager(vimClient),
 		Userinfo:       u.User,
+		tlsConfig:      tlsConfig,
+		sessions:       sessions,
+		keepalive:      ka,
 	}
-	return client
+	return client, nil
 }
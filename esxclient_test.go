@@ -0,0 +1,167 @@
+package gesxi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+)
+
+func TestNewEsxiService(t *testing.T) {
+	m := simulator.ESX()
+	if err := m.Create(); err != nil {
+		t.Fatal(err)
+	}
+	m.Service.TLS = new(tls.Config)
+	defer m.Remove()
+	vcsim := m.Service.NewServer()
+	defer vcsim.Close()
+
+	// Something that speaks HTTPS but isn't a vSphere endpoint
+	web := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not here", http.StatusNotFound)
+	}))
+	defer web.Close()
+
+	// A port nothing listens on any more
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name string
+		host string
+		opts Options
+		want error
+	}{
+		{"connects", vcsim.URL.Host, Options{Insecure: true}, nil},
+		{"pinned thumbprint", vcsim.URL.Host, Options{Thumbprint: vcsim.CertificateInfo().ThumbprintSHA1}, nil},
+		{"invalid url", "", Options{}, ErrInvalidURL},
+		{"unreachable", closed, Options{Insecure: true}, ErrUnreachable},
+		{"thumbprint mismatch", vcsim.URL.Host, Options{Thumbprint: strings.Repeat("00", 20)}, ErrTLS},
+		{"unknown ca", vcsim.URL.Host, Options{}, ErrTLS},
+		{"not a vim endpoint", strings.TrimPrefix(web.URL, "https://"), Options{Insecure: true}, ErrNotVimEndpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			esx, err := NewEsxiService(ctx, tt.host, "user", "pass", tt.opts)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("NewEsxiService: %v", err)
+				}
+				if err = esx.Login(ctx); err != nil {
+					t.Fatalf("Login: %v", err)
+				}
+				if err = esx.Logout(ctx); err != nil {
+					t.Fatalf("Logout: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			var ce *ConnectError
+			if !errors.As(err, &ce) {
+				t.Fatalf("got %T, want *ConnectError", err)
+			}
+		})
+	}
+}
+
+func TestNewEsxiServiceContextDone(t *testing.T) {
+	// Accepts connections but never answers, so only ctx ends the attempt
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"cancelled", cancelled, context.Canceled},
+		{"deadline", expired, context.DeadlineExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEsxiService(tt.ctx, l.Addr().String(), "user", "pass", Options{Insecure: true})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if errors.Is(err, ErrUnreachable) {
+				t.Fatalf("%v is classified as unreachable", err)
+			}
+		})
+	}
+}
+
+// testServer creates m in vcsim and starts serving it.
+func testServer(t *testing.T, m *simulator.Model) *simulator.Server {
+	t.Helper()
+	if err := m.Create(); err != nil {
+		t.Fatal(err)
+	}
+	m.Service.TLS = new(tls.Config)
+	// Serves the vAPI endpoints of the simulators tests import
+	m.Service.RegisterEndpoints = true
+	vcsim := m.Service.NewServer()
+	t.Cleanup(func() {
+		vcsim.Close()
+		m.Remove()
+	})
+	return vcsim
+}
+
+// testService creates m in vcsim and returns a service logged in to it,
+// along with the simulator's server.
+func testService(t *testing.T, m *simulator.Model) (*EsxiService, *simulator.Server) {
+	t.Helper()
+	vcsim := testServer(t, m)
+	return testLogin(t, vcsim, Options{Insecure: true}), vcsim
+}
+
+// testLogin returns a new service logged in to vcsim with opts.
+func testLogin(t *testing.T, vcsim *simulator.Server, opts Options) *EsxiService {
+	t.Helper()
+	esx := testConnect(t, vcsim, opts)
+	if err := esx.Login(context.Background()); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return esx
+}
+
+// testConnect returns a new service for vcsim that isn't logged in.
+func testConnect(t *testing.T, vcsim *simulator.Server, opts Options) *EsxiService {
+	t.Helper()
+	esx, err := NewEsxiService(context.Background(), vcsim.URL.Host, "user", "pass", opts)
+	if err != nil {
+		t.Fatalf("NewEsxiService: %v", err)
+	}
+	return esx
+}
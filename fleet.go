@@ -0,0 +1,405 @@
+package gesxi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DefaultFleetConcurrency is how many hosts a Fleet works on at once when
+// its Concurrency isn't set.
+const DefaultFleetConcurrency = 8
+
+// Fleet runs the same operation across many hosts, each through its own
+// EsxiService, a bounded number at a time.
+type Fleet struct {
+	// Hosts worked on at once, DefaultFleetConcurrency when zero
+	Concurrency int
+
+	mu       sync.Mutex
+	hosts    []string
+	services map[string]*EsxiService
+}
+
+// FleetConfig is what ConnectFleet needs to reach each host
+type FleetConfig struct {
+	// Host names or ips, with optional :port
+	Hosts []string
+	User  string
+	Pass  string
+	// TLS and session settings shared by every host
+	Options     Options
+	Concurrency int
+	// Login logs each new service in, EsxiService.Login when nil
+	Login func(ctx context.Context, s *EsxiService) error
+}
+
+// HostResult is the outcome of a Fleet operation on one host
+type HostResult struct {
+	Host string
+	// What the operation returned. On failure it is nil or what was done
+	// before the error
+	Value   interface{}
+	Err     error
+	Elapsed time.Duration
+}
+
+// FleetResults holds a HostResult for each host an operation ran on, in
+// the order the hosts were added to the fleet.
+type FleetResults []HostResult
+
+// FleetError is returned by FleetResults.Err when some hosts failed
+type FleetError struct {
+	// Errors by host
+	Errors map[string]error
+	// Number of hosts the operation ran on
+	Total int
+}
+
+func (e *FleetError) Error() string {
+	hosts := make([]string, 0, len(e.Errors))
+	for h := range e.Errors {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	msgs := make([]string, len(hosts))
+	for i, h := range hosts {
+		msgs[i] = fmt.Sprintf("%s: %v", h, e.Errors[h])
+	}
+	return fmt.Sprintf("%d of %d hosts failed: %s", len(hosts), e.Total, strings.Join(msgs, "; "))
+}
+
+// Err returns a *FleetError listing the hosts that failed, or nil when all
+// of them succeeded.
+func (r FleetResults) Err() error {
+	errs := map[string]error{}
+	for _, res := range r {
+		if res.Err != nil {
+			errs[res.Host] = res.Err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &FleetError{Errors: errs, Total: len(r)}
+}
+
+// Failed returns the results of the hosts that failed.
+func (r FleetResults) Failed() FleetResults {
+	var failed FleetResults
+	for _, res := range r {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// HostFilter picks the hosts of a fleet an operation runs on; a nil filter
+// picks them all.
+type HostFilter func(host string) bool
+
+// HostsMatching selects hosts whose name matches any of the globs, in
+// path.Match syntax, e.g. "esx-nyc-*".
+func HostsMatching(globs ...string) HostFilter {
+	return func(host string) bool {
+		for _, g := range globs {
+			if ok, _ := path.Match(g, host); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FleetFunc is an operation on one host of a fleet. Its value ends up in
+// the host's HostResult.
+type FleetFunc func(ctx context.Context, s *EsxiService) (interface{}, error)
+
+// NewFleet returns a fleet of services that are already connected. A
+// service for a host that's already in the fleet is left out, still
+// logged in.
+func NewFleet(concurrency int, services ...*EsxiService) *Fleet {
+	f := &Fleet{Concurrency: concurrency}
+	for _, s := range services {
+		_ = f.Add(s)
+	}
+	return f
+}
+
+// ConnectFleet connects to and logs in to each of c.Hosts. Hosts that
+// can't be reached or logged in to are left out of the fleet and reported
+// in the results, so the rest can still be worked on. A host listed more
+// than once is only connected to the first time.
+func ConnectFleet(ctx context.Context, c FleetConfig) (*Fleet, FleetResults) {
+	login := c.Login
+	if login == nil {
+		login = func(ctx context.Context, s *EsxiService) error {
+			return s.Login(ctx)
+		}
+	}
+	var hosts []string
+	seen := map[string]bool{}
+	for _, h := range c.Hosts {
+		if key := strings.ToLower(h); !seen[key] {
+			seen[key] = true
+			hosts = append(hosts, h)
+		}
+	}
+	f := &Fleet{Concurrency: c.Concurrency}
+	results := f.each(ctx, hosts, func(ctx context.Context, host string) (interface{}, error) {
+		s, err := NewEsxiService(ctx, host, c.User, c.Pass, c.Options)
+		if err != nil {
+			return nil, err
+		}
+		if err = login(ctx, s); err != nil {
+			return nil, fmt.Errorf("login: %w", err)
+		}
+		return s, nil
+	})
+	// Added afterwards so the fleet keeps c.Hosts' order
+	for i, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		s := res.Value.(*EsxiService)
+		if err := f.Add(s); err != nil {
+			_ = s.Logout(ctx)
+			results[i].Value, results[i].Err = nil, err
+		}
+	}
+	return f, results
+}
+
+// Add puts s in the fleet under s.EsxHostIp. A host can only be in the
+// fleet once; Remove its service first to replace it.
+func (f *Fleet) Add(s *EsxiService) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.services == nil {
+		f.services = map[string]*EsxiService{}
+	}
+	if cur, ok := f.services[s.EsxHostIp]; ok {
+		if cur == s {
+			return nil
+		}
+		return fmt.Errorf("host %s is already in the fleet", s.EsxHostIp)
+	}
+	f.hosts = append(f.hosts, s.EsxHostIp)
+	f.services[s.EsxHostIp] = s
+	return nil
+}
+
+// Remove takes host out of the fleet and returns its service, without
+// logging it out.
+func (f *Fleet) Remove(host string) (*EsxiService, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.services[host]
+	if !ok {
+		return nil, false
+	}
+	delete(f.services, host)
+	for i, h := range f.hosts {
+		if h == host {
+			f.hosts = append(f.hosts[:i], f.hosts[i+1:]...)
+			break
+		}
+	}
+	return s, true
+}
+
+// Get returns the service of host.
+func (f *Fleet) Get(host string) (*EsxiService, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.services[host]
+	return s, ok
+}
+
+// Hosts returns the fleet's hosts that filter picks, in the order they
+// were added.
+func (f *Fleet) Hosts(filter HostFilter) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var hosts []string
+	for _, h := range f.hosts {
+		if filter == nil || filter(h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// Run calls fn for each host filter picks, at most Concurrency at once,
+// and waits for them all. A failing host doesn't stop the others; once
+// ctx is done the hosts not yet started fail with ctx's error.
+func (f *Fleet) Run(ctx context.Context, filter HostFilter, fn FleetFunc) FleetResults {
+	return f.each(ctx, f.Hosts(filter), func(ctx context.Context, host string) (interface{}, error) {
+		s, ok := f.Get(host)
+		if !ok {
+			return nil, fmt.Errorf("host %s: %w", host, ErrNotFound)
+		}
+		return fn(ctx, s)
+	})
+}
+
+func (f *Fleet) each(ctx context.Context, hosts []string, fn func(ctx context.Context, host string) (interface{}, error)) FleetResults {
+	limit := f.Concurrency
+	if limit <= 0 {
+		limit = DefaultFleetConcurrency
+	}
+	results := make(FleetResults, len(hosts))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		results[i].Host = host
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		// select picks at random when ctx was done as a slot freed up
+		if err := ctx.Err(); err != nil {
+			<-sem
+			results[i].Err = err
+			continue
+		}
+		wg.Add(1)
+		go func(res *HostResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// One host's panic is reported as its error rather than
+			// taking down the rollout on every other host
+			defer func() {
+				if p := recover(); p != nil {
+					res.Value, res.Err = nil, fmt.Errorf("panic: %v", p)
+				}
+			}()
+			start := time.Now()
+			res.Value, res.Err = fn(ctx, res.Host)
+			res.Elapsed = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// Logout logs every host in the fleet out.
+func (f *Fleet) Logout(ctx context.Context) FleetResults {
+	return f.Run(ctx, nil, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+		return nil, s.Logout(ctx)
+	})
+}
+
+// ListVms runs ListVms with q on each host filter picks. Each result's
+// Value is the host's []VmSummary.
+func (f *Fleet) ListVms(ctx context.Context, filter HostFilter, q VmQuery) FleetResults {
+	return f.Run(ctx, filter, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+		return s.ListVms(ctx, q)
+	})
+}
+
+// AddPG adds the port group p describes to every host system managed by
+// the hosts filter picks; p.HostNetSystemRef is filled in for each. Each
+// result's Value is the names of the host systems it was added to.
+func (f *Fleet) AddPG(ctx context.Context, filter HostFilter, p AddPgParams) FleetResults {
+	return f.Run(ctx, filter, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+		hosts, err := s.GetHosts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var added []string
+		for _, h := range hosts {
+			if h.ConfigManager.NetworkSystem == nil {
+				return added, fmt.Errorf("add port group %s on %s: no network system", p.PgName, h.Name)
+			}
+			hp := p
+			hp.HostNetSystemRef = *h.ConfigManager.NetworkSystem
+			if err := s.AddPG(ctx, hp); err != nil {
+				return added, fmt.Errorf("add port group %s on %s: %w", p.PgName, h.Name, err)
+			}
+			added = append(added, h.Name)
+		}
+		return added, nil
+	})
+}
+
+// PlanHostNetwork plans spec for every host system managed by the hosts
+// filter picks. Each result's Value is the host's []*NetworkPlan.
+func (f *Fleet) PlanHostNetwork(ctx context.Context, filter HostFilter, spec HostNetworkSpec) FleetResults {
+	return f.hostNetwork(ctx, filter, spec, false)
+}
+
+// ApplyHostNetwork plans and applies spec on every host system managed by
+// the hosts filter picks. Each result's Value is the host's applied
+// []*NetworkPlan.
+func (f *Fleet) ApplyHostNetwork(ctx context.Context, filter HostFilter, spec HostNetworkSpec) FleetResults {
+	return f.hostNetwork(ctx, filter, spec, true)
+}
+
+func (f *Fleet) hostNetwork(ctx context.Context, filter HostFilter, spec HostNetworkSpec, apply bool) FleetResults {
+	return f.Run(ctx, filter, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+		hosts, err := s.hostNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+		refs := make([]string, 0, len(hosts))
+		for ref := range hosts {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		var plans []*NetworkPlan
+		for _, ref := range refs {
+			plan, err := s.PlanHostNetwork(ctx, types.ManagedObjectReference{Type: "HostSystem", Value: ref}, spec)
+			if err != nil {
+				return plans, err
+			}
+			if apply {
+				if err = s.ApplyHostNetwork(ctx, plan); err != nil {
+					return plans, err
+				}
+			}
+			plans = append(plans, plan)
+		}
+		return plans, nil
+	})
+}
+
+// PowerVms runs action on the VMs matching q on each host filter picks.
+// A host's VMs are all tried even when some fail. Each result's Value is
+// the names of the VMs the action succeeded on.
+func (f *Fleet) PowerVms(ctx context.Context, filter HostFilter, q VmQuery, action PowerAction) FleetResults {
+	q.Props = []string{"name"}
+	return f.Run(ctx, filter, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+		vms, err := s.ListVms(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		var done []string
+		var errs []string
+		for _, vm := range vms {
+			if err := s.Power(ctx, PowerParams{Action: action, Ref: vm.Ref}); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", vm.Name, err))
+				continue
+			}
+			done = append(done, vm.Name)
+		}
+		if len(errs) > 0 {
+			return done, errors.New(strings.Join(errs, "; "))
+		}
+		return done, nil
+	})
+}
@@ -0,0 +1,234 @@
+package gesxi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+)
+
+// testFleet is a fleet of services that never connect, for operations
+// that don't call the host.
+func testFleet(concurrency int, hosts ...string) *Fleet {
+	f := NewFleet(concurrency)
+	for _, h := range hosts {
+		f.Add(&EsxiService{EsxHostIp: h})
+	}
+	return f
+}
+
+func TestFleetRun(t *testing.T) {
+	hosts := []string{"esx-nyc-1", "esx-nyc-2", "esx-lon-1", "esx-lon-2"}
+	tests := []struct {
+		name        string
+		concurrency int
+		filter      HostFilter
+		// fn gets the ctx Run was given and its cancel
+		fn      func(ctx context.Context, cancel context.CancelFunc, s *EsxiService) (interface{}, error)
+		want    []string
+		wantErr map[string]string
+	}{
+		{
+			name: "keeps host order",
+			fn: func(ctx context.Context, _ context.CancelFunc, s *EsxiService) (interface{}, error) {
+				// Later hosts finish first
+				for i, h := range hosts {
+					if h == s.EsxHostIp {
+						time.Sleep(time.Duration(len(hosts)-i) * 5 * time.Millisecond)
+					}
+				}
+				return s.EsxHostIp, nil
+			},
+			want: hosts,
+		},
+		{
+			name:   "filter",
+			filter: HostsMatching("esx-lon-*", "esx-nyc-2"),
+			fn: func(ctx context.Context, _ context.CancelFunc, s *EsxiService) (interface{}, error) {
+				return s.EsxHostIp, nil
+			},
+			want: []string{"esx-nyc-2", "esx-lon-1", "esx-lon-2"},
+		},
+		{
+			name: "failure and panic stay with their host",
+			fn: func(ctx context.Context, _ context.CancelFunc, s *EsxiService) (interface{}, error) {
+				switch s.EsxHostIp {
+				case "esx-nyc-2":
+					return nil, errors.New("boom")
+				case "esx-lon-1":
+					panic("oops")
+				}
+				return s.EsxHostIp, nil
+			},
+			want: []string{"esx-nyc-1", "esx-nyc-2", "esx-lon-1", "esx-lon-2"},
+			wantErr: map[string]string{
+				"esx-nyc-2": "boom",
+				"esx-lon-1": "panic: oops",
+			},
+		},
+		{
+			name:        "unstarted hosts get ctx's error",
+			concurrency: 1,
+			fn: func(ctx context.Context, cancel context.CancelFunc, s *EsxiService) (interface{}, error) {
+				if s.EsxHostIp == "esx-nyc-2" {
+					cancel()
+				}
+				return s.EsxHostIp, nil
+			},
+			want: hosts,
+			wantErr: map[string]string{
+				"esx-lon-1": context.Canceled.Error(),
+				"esx-lon-2": context.Canceled.Error(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f := testFleet(tt.concurrency, hosts...)
+			results := f.Run(ctx, tt.filter, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+				return tt.fn(ctx, cancel, s)
+			})
+			var got []string
+			gotErr := map[string]string{}
+			for _, res := range results {
+				got = append(got, res.Host)
+				if res.Err != nil {
+					gotErr[res.Host] = res.Err.Error()
+					if res.Value != nil {
+						t.Errorf("%s failed but has value %v", res.Host, res.Value)
+					}
+					continue
+				}
+				if res.Value != res.Host {
+					t.Errorf("%s has value %v", res.Host, res.Value)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts %v, want %v", got, tt.want)
+			}
+			if tt.wantErr == nil {
+				tt.wantErr = map[string]string{}
+			}
+			if !reflect.DeepEqual(gotErr, tt.wantErr) {
+				t.Errorf("errors %v, want %v", gotErr, tt.wantErr)
+			}
+			if len(results.Failed()) != len(tt.wantErr) {
+				t.Errorf("%d failed, want %d", len(results.Failed()), len(tt.wantErr))
+			}
+		})
+	}
+}
+
+func TestFleetConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		concurrency int
+		hosts       int
+		want        int32
+	}{
+		{concurrency: 1, hosts: 4, want: 1},
+		{concurrency: 3, hosts: 10, want: 3},
+		{concurrency: 0, hosts: 20, want: DefaultFleetConcurrency},
+		{concurrency: 8, hosts: 2, want: 2},
+	} {
+		t.Run(fmt.Sprintf("%d of %d", tt.concurrency, tt.hosts), func(t *testing.T) {
+			var hosts []string
+			for i := 0; i < tt.hosts; i++ {
+				hosts = append(hosts, fmt.Sprintf("esx%02d", i))
+			}
+			var running, peak int32
+			var mu sync.Mutex
+			testFleet(tt.concurrency, hosts...).Run(context.Background(), nil, func(ctx context.Context, s *EsxiService) (interface{}, error) {
+				n := atomic.AddInt32(&running, 1)
+				mu.Lock()
+				if n > peak {
+					peak = n
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil, nil
+			})
+			if peak != tt.want {
+				t.Errorf("%d hosts ran at once, want %d", peak, tt.want)
+			}
+		})
+	}
+}
+
+func TestFleetResultsErr(t *testing.T) {
+	results := FleetResults{
+		{Host: "esx3", Err: errors.New("timeout")},
+		{Host: "esx1"},
+		{Host: "esx2", Err: ErrNotFound},
+	}
+	err := results.Err()
+	var fe *FleetError
+	if !errors.As(err, &fe) {
+		t.Fatalf("got %T, want *FleetError", err)
+	}
+	if fe.Total != 3 || len(fe.Errors) != 2 {
+		t.Errorf("total %d, %d errors", fe.Total, len(fe.Errors))
+	}
+	want := "2 of 3 hosts failed: esx2: not found; esx3: timeout"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+	if err := results[1:2].Err(); err != nil {
+		t.Errorf("got %v for no failures", err)
+	}
+}
+
+func TestFleetAdd(t *testing.T) {
+	f := testFleet(0, "esx1")
+	s, _ := f.Get("esx1")
+	if err := f.Add(s); err != nil {
+		t.Errorf("adding the same service again: %v", err)
+	}
+	if err := f.Add(&EsxiService{EsxHostIp: "esx1"}); err == nil {
+		t.Error("added a second service for esx1")
+	}
+	if got, _ := f.Get("esx1"); got != s {
+		t.Error("esx1's service was replaced")
+	}
+	f.Remove("esx1")
+	if err := f.Add(&EsxiService{EsxHostIp: "esx1"}); err != nil {
+		t.Errorf("adding after Remove: %v", err)
+	}
+	if hosts := f.Hosts(nil); !reflect.DeepEqual(hosts, []string{"esx1"}) {
+		t.Errorf("hosts %v", hosts)
+	}
+}
+
+func TestConnectFleetDuplicateHosts(t *testing.T) {
+	vcsim := testServer(t, simulator.ESX())
+	host := vcsim.URL.Host
+	var logins int32
+	f, results := ConnectFleet(context.Background(), FleetConfig{
+		Hosts:   []string{host, host, strings.ToUpper(host)},
+		User:    "user",
+		Pass:    "pass",
+		Options: Options{Insecure: true},
+		Login: func(ctx context.Context, s *EsxiService) error {
+			atomic.AddInt32(&logins, 1)
+			return s.Login(ctx)
+		},
+	})
+	if err := results.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || logins != 1 {
+		t.Fatalf("%d results, %d logins, want 1 of each", len(results), logins)
+	}
+	if hosts := f.Hosts(nil); !reflect.DeepEqual(hosts, []string{host}) {
+		t.Errorf("hosts %v", hosts)
+	}
+}
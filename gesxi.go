@@ -3,15 +3,20 @@ package gesxi
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/view"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
@@ -22,100 +27,262 @@ import (
 type EsxiService struct {
 	EsxHostIp  string
 	EsxiClient *esxClient
-	ctx        context.Context
+	// TaskProgress, when set, is called with updates of every task the
+	// service waits on (CreateVm, AddDiskToVm, Power, ...)
+	TaskProgress TaskProgressFunc
 }
 
-// NewEsxiService ...
-func NewEsxiService(host, user, pass string) *EsxiService {
-	ctx := context.Background()
+// NewEsxiService connects to host (name or ip, with an optional :port) and
+// retrieves its ServiceContent. Connection failures are returned as a
+// *ConnectError. opts sets the TLS policy for both the SOAP client and
+// datastore/NFC transfers.
+func NewEsxiService(ctx context.Context, host, user, pass string, opts Options) (*EsxiService, error) {
 	uri := fmt.Sprintf("https://%s/sdk", host)
-	client := newEsxClient(ctx, uri, user, pass)
-
-	return &EsxiService{ctx: ctx, EsxiClient: client, EsxHostIp: host}
+	client, err := newEsxClient(ctx, uri, user, pass, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &EsxiService{EsxiClient: client, EsxHostIp: host}, nil
 }
 
-func (s *EsxiService) Login() error {
-	return s.EsxiClient.Login(s.ctx, s.EsxiClient.Userinfo)
+func (s *EsxiService) Login(ctx context.Context) error {
+	return s.EsxiClient.Login(ctx, s.EsxiClient.Userinfo)
 }
 
-func (s *EsxiService) Logout() error {
-	return s.EsxiClient.Logout(s.ctx)
+func (s *EsxiService) Logout(ctx context.Context) error {
+	return s.EsxiClient.Logout(ctx)
 }
 
-func (s *EsxiService) getView(v string) (*view.ContainerView, error) {
+func (s *EsxiService) getView(ctx context.Context, v string) (*view.ContainerView, error) {
 	m := view.NewManager(s.EsxiClient.Client)
 	return m.CreateContainerView(
-		s.ctx,
+		ctx,
 		s.EsxiClient.ServiceContent.RootFolder,
 		[]string{v},
 		true,
 	)
 }
 
-func (s *EsxiService) GetHosts() ([]mo.HostSystem, error) {
-	v, err := s.getView("HostSystem")
+func (s *EsxiService) GetHosts(ctx context.Context) ([]mo.HostSystem, error) {
+	v, err := s.getView(ctx, "HostSystem")
 	if err != nil {
 		return nil, err
 	}
-	defer v.Destroy(s.ctx)
+	defer v.Destroy(ctx)
 	var hosts []mo.HostSystem
-	err = v.Retrieve(s.ctx, []string{"HostSystem"}, nil, &hosts)
+	err = v.Retrieve(ctx, []string{"HostSystem"}, nil, &hosts)
 	if err != nil {
 		return nil, err
 	}
 	return hosts, nil
 }
 
-func (s *EsxiService) GetDatacenter() (mo.Datacenter, error) {
-	v, err := s.getView("Datacenter")
+// GetDatacenter returns the only datacenter, ha-datacenter on standalone
+// ESXi. It fails with ErrAmbiguous when there are several; use
+// FindDatacenter then.
+func (s *EsxiService) GetDatacenter(ctx context.Context) (mo.Datacenter, error) {
+	dcs, err := s.ListDatacenters(ctx)
 	if err != nil {
 		return mo.Datacenter{}, err
 	}
-	defer v.Destroy(s.ctx)
+	if err = onlyOne("Datacenter", len(dcs)); err != nil {
+		return mo.Datacenter{}, err
+	}
+	return dcs[0], nil
+}
+
+func (s *EsxiService) ListDatacenters(ctx context.Context) ([]mo.Datacenter, error) {
+	v, err := s.getView(ctx, "Datacenter")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var dcs []mo.Datacenter
+	if err = v.Retrieve(ctx, []string{"Datacenter"}, nil, &dcs); err != nil {
+		return nil, err
+	}
+	return dcs, nil
+}
+
+// FindDatacenter returns the datacenter called name, or at inventory path
+// name when it contains a "/".
+func (s *EsxiService) FindDatacenter(ctx context.Context, name string) (mo.Datacenter, error) {
 	var dc mo.Datacenter
-	err = v.Retrieve(s.ctx, []string{"Datacenter"}, nil, &dc)
+	ref, err := s.findEntity(ctx, "Datacenter", name)
 	if err != nil {
 		return dc, err
 	}
-	return dc, nil
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &dc)
+	return dc, err
 }
 
-func (s *EsxiService) GetDatastore() (mo.Datastore, error) {
-	v, err := s.getView("Datastore")
+// GetDatastore returns the only datastore. It fails with ErrAmbiguous when
+// the host or vCenter has several; use FindDatastore then.
+func (s *EsxiService) GetDatastore(ctx context.Context) (mo.Datastore, error) {
+	dss, err := s.ListDatastores(ctx)
 	if err != nil {
 		return mo.Datastore{}, err
 	}
-	defer v.Destroy(s.ctx)
-	var dss mo.Datastore
-	err = v.Retrieve(s.ctx, []string{"Datastore"}, nil, &dss)
-	if err != nil {
+	if err = onlyOne("Datastore", len(dss)); err != nil {
 		return mo.Datastore{}, err
 	}
+	return dss[0], nil
+}
+
+func (s *EsxiService) ListDatastores(ctx context.Context) ([]mo.Datastore, error) {
+	v, err := s.getView(ctx, "Datastore")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var dss []mo.Datastore
+	if err = v.Retrieve(ctx, []string{"Datastore"}, nil, &dss); err != nil {
+		return nil, err
+	}
 	return dss, nil
 }
 
-func (s *EsxiService) GetRsrcPool() (mo.ResourcePool, error) {
-	var rsrcPool mo.ResourcePool
-	view, err := s.getView("ResourcePool")
+// FindDatastore returns the datastore called name, e.g. "ssd01", or at
+// inventory path name ("DC0/datastore/ssd01") when it contains a "/".
+func (s *EsxiService) FindDatastore(ctx context.Context, name string) (mo.Datastore, error) {
+	var ds mo.Datastore
+	ref, err := s.findEntity(ctx, "Datastore", name)
+	if err != nil {
+		return ds, err
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &ds)
+	return ds, err
+}
+
+// GetRsrcPool returns the root resource pool of the only host or cluster,
+// which is where VMs go by default. It fails with ErrAmbiguous when there
+// are several; use FindRsrcPool then.
+func (s *EsxiService) GetRsrcPool(ctx context.Context) (mo.ResourcePool, error) {
+	pools, err := s.ListRsrcPools(ctx)
 	if err != nil {
-		return rsrcPool, err
+		return mo.ResourcePool{}, err
+	}
+	var roots []mo.ResourcePool
+	for _, pool := range pools {
+		if pool.Parent != nil && pool.Parent.Type != "ResourcePool" && pool.Parent.Type != "VirtualApp" {
+			roots = append(roots, pool)
+		}
 	}
-	defer view.Destroy(s.ctx)
-	if err = view.Retrieve(s.ctx, []string{"ResourcePool"}, nil, &rsrcPool); err != nil {
-		return rsrcPool, err
+	if err = onlyOne("ResourcePool", len(roots)); err != nil {
+		return mo.ResourcePool{}, err
 	}
-	return rsrcPool, nil
+	return roots[0], nil
+}
+
+// ListRsrcPools returns every resource pool, root pools included. vApps
+// are left out.
+func (s *EsxiService) ListRsrcPools(ctx context.Context) ([]mo.ResourcePool, error) {
+	v, err := s.getView(ctx, "ResourcePool")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var all, pools []mo.ResourcePool
+	if err = v.Retrieve(ctx, []string{"ResourcePool"}, nil, &all); err != nil {
+		return nil, err
+	}
+	for _, pool := range all {
+		if pool.Self.Type == "ResourcePool" {
+			pools = append(pools, pool)
+		}
+	}
+	return pools, nil
+}
+
+// FindRsrcPool returns the resource pool called name, or at inventory path
+// name ("DC0/host/cluster1/Resources/web") when it contains a "/". Every
+// host and cluster has a root pool called Resources, so those need a path.
+func (s *EsxiService) FindRsrcPool(ctx context.Context, name string) (mo.ResourcePool, error) {
+	var pool mo.ResourcePool
+	ref, err := s.findEntity(ctx, "ResourcePool", name)
+	if err != nil {
+		return pool, err
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &pool)
+	return pool, err
+}
+
+var entityNames = map[string]string{
+	"Datacenter":             "datacenter",
+	"Datastore":              "datastore",
+	"ResourcePool":           "resource pool",
+	"ClusterComputeResource": "cluster",
+	"HostSystem":             "host",
+}
+
+// findEntity returns the reference of the kind object called name, or at
+// inventory path name when it contains a "/". Names shared by several
+// objects fail with ErrAmbiguous.
+func (s *EsxiService) findEntity(ctx context.Context, kind, name string) (types.ManagedObjectReference, error) {
+	var ref types.ManagedObjectReference
+	if strings.Contains(name, "/") {
+		ref, err := s.FindByPath(ctx, name)
+		if err == nil && ref.Type != kind {
+			err = fmt.Errorf("%s: %w", name, ErrNotFound)
+		}
+		if err != nil {
+			return ref, fmt.Errorf("%s %w", entityNames[kind], err)
+		}
+		return ref, nil
+	}
+	v, err := s.getView(ctx, kind)
+	if err != nil {
+		return ref, err
+	}
+	defer v.Destroy(ctx)
+	var entities []mo.ManagedEntity
+	if err = v.Retrieve(ctx, []string{kind}, []string{"name"}, &entities); err != nil {
+		return ref, err
+	}
+	var matches []types.ManagedObjectReference
+	for _, e := range entities {
+		if e.Name == name && e.Self.Type == kind {
+			matches = append(matches, e.Self)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return ref, fmt.Errorf("%s %s: %w", entityNames[kind], name, ErrNotFound)
+	case 1:
+		return matches[0], nil
+	}
+	return ref, fmt.Errorf("%s %s: %d share the name, use its inventory path: %w", entityNames[kind], name, len(matches), ErrAmbiguous)
+}
+
+// onlyOne checks that a default getter found exactly one kind object.
+func onlyOne(kind string, n int) error {
+	switch n {
+	case 0:
+		return fmt.Errorf("%s: %w", entityNames[kind], ErrNotFound)
+	case 1:
+		return nil
+	}
+	return fmt.Errorf("%s: %d found, look one up by name or path: %w", entityNames[kind], n, ErrAmbiguous)
 }
 
 type MkDirParams struct {
 	PathName string
-	DcRef    *types.ManagedObjectReference
+	// Datastore to create the directory on, defaults to the only datastore
+	DsName string
+	DcRef  *types.ManagedObjectReference
 }
 
-func (s *EsxiService) MkDir(p MkDirParams) error {
-	_, err := methods.MakeDirectory(s.ctx, s.EsxiClient.Client, &types.MakeDirectory{
+func (s *EsxiService) MkDir(ctx context.Context, p MkDirParams) error {
+	if p.DsName == "" {
+		ds, err := s.GetDatastore(ctx)
+		if err != nil {
+			return fmt.Errorf("mkdir %s: %w", p.PathName, err)
+		}
+		p.DsName = ds.Name
+	}
+	_, err := methods.MakeDirectory(ctx, s.EsxiClient.Client, &types.MakeDirectory{
 		This:       s.EsxiClient.ServiceContent.FileManager.Reference(),
-		Name:       fmt.Sprintf("[datastore1] %s", p.PathName),
+		Name:       fmt.Sprintf("[%s] %s", p.DsName, strings.TrimPrefix(p.PathName, "/")),
 		Datacenter: p.DcRef,
 	})
 	if err != nil {
@@ -138,18 +305,19 @@ type CpFileParams struct {
 	RemoteFileName string
 }
 
-func (s *EsxiService) CpFileToDatastore(p CpFileParams) error {
-	file, err := os.Open(fmt.Sprintf("%s/%s", p.LocalFilePath, p.FileName))
+func (s *EsxiService) CpFileToDatastore(ctx context.Context, p CpFileParams) error {
+	file, err := os.Open(filepath.Join(p.LocalFilePath, p.FileName))
 	if err != nil {
 		return err
 	}
-	httpClient := newHttpService(s.EsxHostIp, &s.EsxiClient.Jar)
+	defer file.Close()
+	httpClient := newHttpService(s.EsxHostIp, &s.EsxiClient.Jar, s.EsxiClient.tlsConfig)
 	if p.RemoteFileName == "" {
 		p.RemoteFileName = p.FileName
 	}
 	url := fmt.Sprintf("%s/%s/%s", httpClient.BaseURL, p.DatastoreDir, p.RemoteFileName)
 
-	req, err := httpClient.GenerateRequest("PUT", url, file)
+	req, err := httpClient.GenerateRequest(ctx, "PUT", url, file)
 	if err != nil {
 		return err
 	}
@@ -163,21 +331,32 @@ func (s *EsxiService) CpFileToDatastore(p CpFileParams) error {
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("upload %s to [%s] %s: %s", p.FileName, p.DsName, p.DatastoreDir, res.Status)
+	}
 	return nil
 }
 
-// GetVmsWithTickets ...
-func (s *EsxiService) GetVmsWithTickets() []ApgVM {
-	v, _ := s.getView("VirtualMachine")
-	defer v.Destroy(s.ctx)
+// GetVmsWithTickets returns every VM with an mks ticket for its console.
+func (s *EsxiService) GetVmsWithTickets(ctx context.Context) ([]ApgVM, error) {
+	v, err := s.getView(ctx, "VirtualMachine")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
 	var vmMos []mo.VirtualMachine
-	v.Retrieve(s.ctx, []string{"VirtualMachine"}, []string{"summary"}, &vmMos)
+	if err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"summary"}, &vmMos); err != nil {
+		return nil, err
+	}
 
 	var vms []ApgVM
 
 	for _, vmMo := range vmMos {
 		vm := object.NewVirtualMachine(s.EsxiClient.Client, vmMo.Reference())
-		vmTicket, _ := vm.AcquireTicket(s.ctx, "mks")
+		vmTicket, err := vm.AcquireTicket(ctx, "mks")
+		if err != nil {
+			return nil, fmt.Errorf("ticket for %s: %w", vmMo.Summary.Config.Name, err)
+		}
 		apgVM := ApgVM{
 			UUID:         vmMo.Summary.Config.Uuid,
 			InstanceUUID: vmMo.Summary.Config.InstanceUuid,
@@ -191,26 +370,28 @@ func (s *EsxiService) GetVmsWithTickets() []ApgVM {
 		apgVM.TicketInfo.SSLThumbprint = vmTicket.SslThumbprint
 		vms = append(vms, apgVM)
 	}
-	return vms
+	return vms, nil
 }
 
-func (s *EsxiService) GetVms() ([]mo.VirtualMachine, error) {
-	view, err := s.getView("VirtualMachine")
+// GetVms returns every VM with all of its properties. Use ListVms when only
+// a summary is needed, it's far cheaper.
+func (s *EsxiService) GetVms(ctx context.Context) ([]mo.VirtualMachine, error) {
+	view, err := s.getView(ctx, "VirtualMachine")
 	if err != nil {
 		return nil, err
 	}
-	defer view.Destroy(s.ctx)
+	defer view.Destroy(ctx)
 	var vms []mo.VirtualMachine
-	if err = view.Retrieve(s.ctx, []string{"VirtualMachine"}, nil, &vms); err != nil {
+	if err = view.Retrieve(ctx, []string{"VirtualMachine"}, nil, &vms); err != nil {
 		return nil, err
 	}
 	return vms, nil
 }
 
-func (s *EsxiService) GetVmByUuid(uuid string) (mo.VirtualMachine, error) {
+func (s *EsxiService) GetVmByUuid(ctx context.Context, uuid string) (mo.VirtualMachine, error) {
 	var vm mo.VirtualMachine
 	searchIdx := s.EsxiClient.ServiceContent.SearchIndex
-	resp, err := methods.FindByUuid(s.ctx, s.EsxiClient.Client, &types.FindByUuid{
+	resp, err := methods.FindByUuid(ctx, s.EsxiClient.Client, &types.FindByUuid{
 		This:     *searchIdx,
 		Uuid:     uuid,
 		VmSearch: true,
@@ -218,17 +399,20 @@ func (s *EsxiService) GetVmByUuid(uuid string) (mo.VirtualMachine, error) {
 	if err != nil {
 		return vm, err
 	}
-	return s.getVmByMo(*resp.Returnval)
+	if resp.Returnval == nil {
+		return vm, fmt.Errorf("vm %s: %w", uuid, ErrNotFound)
+	}
+	return s.getVmByMo(ctx, *resp.Returnval)
 }
 
-func (s *EsxiService) getVmByMo(moRef types.ManagedObjectReference) (mo.VirtualMachine, error) {
+func (s *EsxiService) getVmByMo(ctx context.Context, moRef types.ManagedObjectReference) (mo.VirtualMachine, error) {
 	var vm mo.VirtualMachine
-	view, err := s.getView("VirtualMachine")
+	view, err := s.getView(ctx, "VirtualMachine")
 	if err != nil {
 		return vm, err
 	}
-	defer view.Destroy(s.ctx)
-	if err = view.Properties(s.ctx, moRef, nil, &vm); err != nil {
+	defer view.Destroy(ctx)
+	if err = view.Properties(ctx, moRef, nil, &vm); err != nil {
 		return vm, err
 	}
 	return vm, nil
@@ -243,245 +427,277 @@ type CreateVmParams struct {
 	DatastoreName string
 	DcVmFolder    types.ManagedObjectReference
 	RsrcPool      types.ManagedObjectReference
+	// Host to create the VM on. Only needed in a vCenter cluster without
+	// DRS, see GetPlacement
+	HostSystem types.ManagedObjectReference
+	// Guest OS identifier, e.g. ubuntu64Guest (types.VirtualMachineGuestOsIdentifier)
+	GuestId    string
+	Firmware   Firmware
+	SecureBoot bool
+	// Controllers to add up front; disks and cdroms create any they need.
+	// The first one is the default for Disks without a Controller
+	Controllers []ControllerType
+	Disks       []DiskSpec
+	Nics        []NicSpec
+	Cdrom       *CdromSpec
+	BootOrder   []BootDevice
 }
 
-func (s *EsxiService) CreateVm(p CreateVmParams) (mo.VirtualMachine, error) {
+// CreateVm creates a VM with all of the hardware in p in a single
+// CreateVM_Task, then applies BootOrder.
+func (s *EsxiService) CreateVm(ctx context.Context, p CreateVmParams) (mo.VirtualMachine, error) {
 	var vm mo.VirtualMachine
 	vmCfgSpec := types.VirtualMachineConfigSpec{
 		Annotation: p.Annotation,
 		MemoryMB:   p.MemoryMB,
 		Name:       p.Name,
 		NumCPUs:    p.NumCpus,
+		GuestId:    p.GuestId,
+		Firmware:   string(p.Firmware),
 		Files: &types.VirtualMachineFileInfo{
 			VmPathName: fmt.Sprintf("[%s]", p.DatastoreName),
 		},
 	}
-	_, err := methods.CreateVM_Task(s.ctx, s.EsxiClient.Client, &types.CreateVM_Task{
-		This:   p.DcVmFolder,
-		Config: vmCfgSpec,
-		Pool:   p.RsrcPool,
-	})
-	if err != nil {
-		return vm, err
+	if p.SecureBoot {
+		if p.Firmware != FirmwareEFI {
+			return vm, fmt.Errorf("create vm %s: secure boot requires efi firmware", p.Name)
+		}
+		vmCfgSpec.BootOptions = &types.VirtualMachineBootOptions{
+			EfiSecureBootEnabled: types.NewBool(true),
+		}
 	}
-	time.Sleep(500 * time.Millisecond)
-	vms, err := s.GetVms()
+	deviceChange, err := s.deviceChanges(ctx, p)
 	if err != nil {
+		return vm, fmt.Errorf("create vm %s: %w", p.Name, err)
+	}
+	vmCfgSpec.DeviceChange = deviceChange
+	if vm, err = s.createVm(ctx, p.DcVmFolder, p.RsrcPool, p.HostSystem, vmCfgSpec); err != nil {
 		return vm, err
 	}
-	for _, v := range vms {
-		if v.Name == p.Name {
-			vm = v
-			break
+	if len(p.BootOrder) > 0 {
+		if err = s.setBootOrder(ctx, vm, p.BootOrder); err != nil {
+			return vm, err
 		}
+		return s.getVmByMo(ctx, vm.Self)
 	}
 	return vm, nil
 }
 
-func (s *EsxiService) AddDiskToVm(vm mo.VirtualMachine) error {
-	var spec types.VirtualMachineConfigSpec = types.VirtualMachineConfigSpec{
-		MemoryMB: vm.Config.ToConfigSpec().MemoryMB,
-		NumCPUs:  vm.Config.ToConfigSpec().NumCPUs,
-	}
-	var (
-		thinProv      bool  = true
-		eagarScrub    bool  = false
-		unitNum       int32 = 1
-		controllerKey int32
-	)
-	for _, dev := range vm.Config.Hardware.Device {
-		device := types.VirtualDevice(*dev.GetVirtualDevice())
-		if device.DeviceInfo.GetDescription().Label == "IDE 0" {
-			controllerKey = device.Key
-		}
+// createVm runs CreateVM_Task for spec and returns the new VM.
+func (s *EsxiService) createVm(ctx context.Context, folder, pool, host types.ManagedObjectReference, spec types.VirtualMachineConfigSpec) (mo.VirtualMachine, error) {
+	var vm mo.VirtualMachine
+	req := &types.CreateVM_Task{
+		This:   folder,
+		Config: spec,
+		Pool:   pool,
 	}
-	virtDisk := &types.VirtualDisk{
-		VirtualDevice: types.VirtualDevice{
-			Backing: &types.VirtualDiskFlatVer2BackingInfo{
-				DiskMode:        "independent_persistent",
-				ThinProvisioned: &thinProv,
-				EagerlyScrub:    &eagarScrub,
-				Sharing:         "sharingNone",
-				VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
-					FileName:  fmt.Sprintf("[%s] %s", vm.Config.DatastoreUrl[0].Name, vm.Name),
-					Datastore: &vm.Datastore[0],
-				},
-			},
-			UnitNumber:    &unitNum,
-			ControllerKey: controllerKey,
-			Key:           -1000000,
-		},
-		CapacityInKB: int64(80000),
+	if host.Value != "" {
+		req.Host = &host
 	}
-	diskSpec := types.VirtualDeviceConfigSpec{
-		FileOperation: types.VirtualDeviceConfigSpecFileOperationCreate,
-		Operation:     types.VirtualDeviceConfigSpecOperationAdd,
-		Device:        virtDisk,
+	task, err := methods.CreateVM_Task(ctx, s.EsxiClient.Client, req)
+	if err != nil {
+		return vm, err
 	}
-	spec.DeviceChange = append(spec.DeviceChange, types.BaseVirtualDeviceConfigSpec(&diskSpec))
-	_, err := methods.ReconfigVM_Task(s.ctx, s.EsxiClient.Client, &types.ReconfigVM_Task{
-		This: vm.Reference(),
-		Spec: spec,
-	})
-	time.Sleep(500 * time.Millisecond)
+	result, err := s.waitTask(ctx, task.Returnval)
 	if err != nil {
-		return err
+		return vm, err
 	}
-	return nil
+	// The task result is the new VM, which is unambiguous even when other
+	// VMs share its name
+	vmRef, ok := result.(types.ManagedObjectReference)
+	if !ok {
+		return vm, fmt.Errorf("create vm %s: unexpected task result %T", spec.Name, result)
+	}
+	return s.getVmByMo(ctx, vmRef)
 }
 
-func (s *EsxiService) AddNicToVm(vm mo.VirtualMachine, netName string) error {
-	var (
-		wakeOnLan      bool = true
-		useAutoDectect bool = false
-		netMo          types.ManagedObjectReference
-		network        mo.Network
-		inPassThruMode bool = false
-	)
-	var spec types.VirtualMachineConfigSpec = types.VirtualMachineConfigSpec{
-		MemoryMB: vm.Config.ToConfigSpec().MemoryMB,
-		NumCPUs:  vm.Config.ToConfigSpec().NumCPUs,
-	}
-
-	device := types.VirtualE1000{
-		VirtualEthernetCard: types.VirtualEthernetCard{
-			VirtualDevice: types.VirtualDevice{
-				Key: 100,
-				DeviceInfo: &types.Description{
-					Summary: "vSphere API Test",
-				},
-				Connectable: &types.VirtualDeviceConnectInfo{
-					StartConnected:    true,
-					AllowGuestControl: true,
-					Connected:         false,
-					Status:            "untried",
-				},
-			},
-			AddressType:      "generated",
-			WakeOnLanEnabled: &wakeOnLan,
-		},
+// AddDiskToVm adds a disk described by d to vm. The disk goes on the first
+// controller of d.Controller with a free unit (created if there is none);
+// without a Controller the VM's existing disk controller type is used.
+func (s *EsxiService) AddDiskToVm(ctx context.Context, vm mo.VirtualMachine, d DiskSpec) error {
+	if d.capacityKB() <= 0 {
+		return fmt.Errorf("add disk to %s: capacity is required", vm.Name)
 	}
-	networks, err := s.GetNetworks()
-	for _, net := range networks {
-		if net.Name == netName {
-			network = net
-			netMo = net.Reference()
-		}
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+	if d.Controller == "" {
+		d.Controller = diskControllerType(devices)
 	}
+	ctrl, added, err := pickController(devices, d.Controller)
 	if err != nil {
-		return err
-	}
-	switch {
-	case netMo.Type == "Network":
-		device.VirtualEthernetCard.VirtualDevice.Backing = &types.VirtualEthernetCardNetworkBackingInfo{
-			VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{
-				UseAutoDetect: &useAutoDectect,
-				DeviceName:    network.Name,
-			},
-			Network:           &network.Self,
-			InPassthroughMode: &inPassThruMode,
-		}
-	default:
-		device.VirtualEthernetCard.VirtualDevice.Backing = types.BaseVirtualDeviceBackingInfo(
-			&types.VirtualEthernetCardOpaqueNetworkBackingInfo{
-				OpaqueNetworkType: network.Summary.GetNetworkSummary().Network.Type,
-				OpaqueNetworkId:   network.Summary.GetNetworkSummary().Name,
-			},
-		)
+		return fmt.Errorf("add disk to %s: %w", vm.Name, err)
 	}
-	nicSpec := types.VirtualDeviceConfigSpec{
-		Operation: types.VirtualDeviceConfigSpecOperationAdd,
-		Device:    &device,
+	devices = append(devices, added...)
+	var dsPath object.DatastorePath
+	dsPath.FromString(vm.Config.Files.VmPathName)
+	disk, err := newDisk(devices, ctrl, dsPath.Datastore, d)
+	if err != nil {
+		return fmt.Errorf("add disk to %s: %w", vm.Name, err)
 	}
-	spec.DeviceChange = append(spec.DeviceChange, &nicSpec)
-	rcfgVm := &types.ReconfigVM_Task{
-		This: vm.Reference(),
-		Spec: spec,
+	deviceChange, err := append(object.VirtualDeviceList(added), disk).ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return err
 	}
-	_, err = methods.ReconfigVM_Task(s.ctx, s.EsxiClient.Client, rcfgVm)
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{DeviceChange: deviceChange})
+}
+
+// AddNicToVm adds a network adapter described by n to vm. The port group
+// in n.Network must exist.
+func (s *EsxiService) AddNicToVm(ctx context.Context, vm mo.VirtualMachine, n NicSpec) error {
+	networks, err := s.GetNetworks(ctx)
 	if err != nil {
 		return err
 	}
-	time.Sleep(500 * time.Millisecond)
-	return nil
+	nic, err := s.newNic(ctx, networks, n)
+	if err != nil {
+		return fmt.Errorf("add nic to %s: %w", vm.Name, err)
+	}
+	// Keys only need to be unique within the spec; vSphere assigns the
+	// real one
+	nic.GetVirtualDevice().Key = object.VirtualDeviceList(vm.Config.Hardware.Device).NewKey()
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{
+		DeviceChange: []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    nic,
+		}},
+	})
 }
 
-func (s *EsxiService) Power(action, appType string, moRef types.ManagedObjectReference) (*types.ManagedObjectReference, error) {
-	switch appType {
-	case "vm":
-		if action == "on" {
-			pwrOnTask, err := methods.PowerOnVM_Task(s.ctx, s.EsxiClient.Client, &types.PowerOnVM_Task{
-				This: moRef,
-			})
-			return &pwrOnTask.Returnval, err
-		}
-		pwrOffTask, err := methods.PowerOffVM_Task(s.ctx, s.EsxiClient.Client, &types.PowerOffVM_Task{
-			This: moRef,
-		})
-		return &pwrOffTask.Returnval, err
-	case "vapp":
-		if action == "on" {
-			pwrOnTask, err := methods.PowerOnVApp_Task(s.ctx, s.EsxiClient.Client, &types.PowerOnVApp_Task{
-				This: moRef,
-			})
-			return &pwrOnTask.Returnval, err
+// DestroyVm powers vm off if it's running or suspended, then deletes it
+// and its files from the datastore. The power state is read from the host,
+// vm only needs Self.
+func (s *EsxiService) DestroyVm(ctx context.Context, vm mo.VirtualMachine) error {
+	var cur mo.VirtualMachine
+	err := property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, vm.Self, []string{"runtime.powerState"}, &cur)
+	if err != nil {
+		return fmt.Errorf("destroy %s: %w", vm.Name, err)
+	}
+	if cur.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		// It may have powered off since it was read
+		if err = s.powerTask(ctx, PowerOff, vm.Self); err != nil && !isInvalidPowerState(err) {
+			return fmt.Errorf("destroy %s: %w", vm.Name, err)
 		}
-		pwrOffTask, err := methods.PowerOffVApp_Task(s.ctx, s.EsxiClient.Client, &types.PowerOffVApp_Task{
-			This: moRef,
-		})
-		return &pwrOffTask.Returnval, err
 	}
-	return nil, nil
+	task, err := methods.Destroy_Task(ctx, s.EsxiClient.Client, &types.Destroy_Task{
+		This: vm.Self,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// UnregisterVm removes vm from the inventory, leaving its files on the
+// datastore. The VM must be powered off.
+func (s *EsxiService) UnregisterVm(ctx context.Context, vm mo.VirtualMachine) error {
+	_, err := methods.UnregisterVM(ctx, s.EsxiClient.Client, &types.UnregisterVM{
+		This: vm.Self,
+	})
+	return err
 }
 
-// Create VM
-// Add Disk to VM
-// Add Nic to VM
-// Add CDROM and Mount ISO to It
-// PowerOn Vm
+type RegisterVmParams struct {
+	// Datastore path of the .vmx, e.g. "[datastore1] lab01/lab01.vmx"
+	VmxPath string
+	// Inventory name, default the one in the .vmx
+	Name       string
+	DcVmFolder types.ManagedObjectReference
+	RsrcPool   types.ManagedObjectReference
+	// Host to register the VM on, as for CreateVmParams
+	HostSystem types.ManagedObjectReference
+}
+
+// RegisterVm adds the VM defined by an existing .vmx to the inventory and
+// returns it.
+func (s *EsxiService) RegisterVm(ctx context.Context, p RegisterVmParams) (mo.VirtualMachine, error) {
+	var vm mo.VirtualMachine
+	req := &types.RegisterVM_Task{
+		This: p.DcVmFolder,
+		Path: p.VmxPath,
+		Name: p.Name,
+		Pool: &p.RsrcPool,
+	}
+	if p.HostSystem.Value != "" {
+		req.Host = &p.HostSystem
+	}
+	task, err := methods.RegisterVM_Task(ctx, s.EsxiClient.Client, req)
+	if err != nil {
+		return vm, err
+	}
+	result, err := s.waitTask(ctx, task.Returnval)
+	if err != nil {
+		return vm, err
+	}
+	vmRef, ok := result.(types.ManagedObjectReference)
+	if !ok {
+		return vm, fmt.Errorf("register %s: unexpected task result %T", p.VmxPath, result)
+	}
+	return s.getVmByMo(ctx, vmRef)
+}
 
-func (s *EsxiService) GetNetworks() ([]mo.Network, error) {
+func (s *EsxiService) GetNetworks(ctx context.Context) ([]mo.Network, error) {
 	var networks []mo.Network
-	v, err := s.getView("Network")
+	v, err := s.getView(ctx, "Network")
 	if err != nil {
 		return networks, err
 	}
-	defer v.Destroy(s.ctx)
-	if err = v.Retrieve(s.ctx, []string{"Network"}, nil, &networks); err != nil {
+	defer v.Destroy(ctx)
+	if err = v.Retrieve(ctx, []string{"Network"}, nil, &networks); err != nil {
 		return networks, err
 	}
 	return networks, nil
 }
 
+// VlanTrunk as a port group's VLAN id passes every VLAN through to the
+// guest with its tags, for VMs that do their own tagging (virtual routers,
+// packet capture)
+const VlanTrunk = 4095
+
 type AddPgParams struct {
 	// A Reference to the HostNetworkSystem
 	// host.ConfigManager.NetworkSystem.Reference()
 	HostNetSystemRef types.ManagedObjectReference
 	PgName           string
-	PgVlanId         int
-	VswitchName      string
-	Security         NetSec
+	// 0 for untagged, 1-4094, or VlanTrunk
+	PgVlanId    int
+	VswitchName string
+	// Policies left nil inherit the vSwitch's
+	Security NetSec
+	Teaming  *TeamingSpec
+	Shaping  *ShapingSpec
 }
 
+// NetSec overrides the vSwitch's security policy for a port group. Nil
+// fields inherit the vSwitch's setting, so false can be set explicitly,
+// e.g. AllowPromiscuous: types.NewBool(true)
 type NetSec struct {
-	AllowPromiscuous bool
-	AllowMacChange   bool
-	ForgedXmits      bool
+	AllowPromiscuous *bool
+	AllowMacChange   *bool
+	ForgedXmits      *bool
 }
 
 // AddPG adds a PortGroup to an Existing vSwitch
-func (s *EsxiService) AddPG(p AddPgParams) error {
-	policy := types.HostNetworkPolicy{}
-	if p.Security.AllowPromiscuous {
-		*policy.Security.AllowPromiscuous = p.Security.AllowPromiscuous
+func (s *EsxiService) AddPG(ctx context.Context, p AddPgParams) error {
+	if p.PgVlanId < 0 || p.PgVlanId > VlanTrunk {
+		return fmt.Errorf("add port group %s: vlan %d out of range 0-%d", p.PgName, p.PgVlanId, VlanTrunk)
 	}
-	if p.Security.AllowMacChange {
-		*policy.Security.MacChanges = p.Security.AllowMacChange
+	if err := checkShaping(p.Shaping, true); err != nil {
+		return fmt.Errorf("add port group %s: %w", p.PgName, err)
 	}
-	if p.Security.ForgedXmits {
-		*policy.Security.ForgedTransmits = p.Security.ForgedXmits
+	if err := s.checkPgFailoverOrder(ctx, p); err != nil {
+		return fmt.Errorf("add port group %s: %w", p.PgName, err)
 	}
-	_, err := methods.AddPortGroup(s.ctx, s.EsxiClient.Client, &types.AddPortGroup{
+	// A new port group's policies are all changes; what they were doesn't
+	// matter here
+	policy := types.HostNetworkPolicy{}
+	policy.Security, _ = securityPolicy(nil, &SecuritySpec{
+		AllowPromiscuous: p.Security.AllowPromiscuous,
+		MacChanges:       p.Security.AllowMacChange,
+		ForgedTransmits:  p.Security.ForgedXmits,
+	})
+	policy.NicTeaming, _ = teamingPolicy(nil, p.Teaming, nil)
+	policy.ShapingPolicy, _ = shapingPolicy(nil, p.Shaping)
+	_, err := methods.AddPortGroup(ctx, s.EsxiClient.Client, &types.AddPortGroup{
 		This: p.HostNetSystemRef,
 		Portgrp: types.HostPortGroupSpec{
 			Name:        p.PgName,
@@ -496,6 +712,27 @@ func (s *EsxiService) AddPG(p AddPgParams) error {
 	return nil
 }
 
+// checkPgFailoverOrder checks the failover order of p.Teaming against the
+// uplinks of the vSwitch the port group goes on.
+func (s *EsxiService) checkPgFailoverOrder(ctx context.Context, p AddPgParams) error {
+	if p.Teaming == nil || (p.Teaming.Active == nil && p.Teaming.Standby == nil) {
+		return nil
+	}
+	var ns mo.HostNetworkSystem
+	err := property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, p.HostNetSystemRef, []string{"networkInfo.vswitch"}, &ns)
+	if err != nil {
+		return err
+	}
+	if ns.NetworkInfo != nil {
+		for _, vs := range ns.NetworkInfo.Vswitch {
+			if vs.Name == p.VswitchName {
+				return checkFailoverOrder(p.Teaming, nonNil(vswitchUplinks(vs)))
+			}
+		}
+	}
+	return fmt.Errorf("vswitch %s: %w", p.VswitchName, ErrNotFound)
+}
+
 type VswitchOp struct {
 	Name     string
 	ChangeOp types.HostConfigChangeOperation
@@ -508,8 +745,8 @@ type VswitchPostParams struct {
 	ChangMode        types.HostConfigChangeMode
 }
 
-func (s *EsxiService) VswitchPost(p VswitchPostParams) error {
-	_, err := methods.UpdateNetworkConfig(s.ctx, s.EsxiClient.Client, &types.UpdateNetworkConfig{
+func (s *EsxiService) VswitchPost(ctx context.Context, p VswitchPostParams) error {
+	_, err := methods.UpdateNetworkConfig(ctx, s.EsxiClient.Client, &types.UpdateNetworkConfig{
 		This: p.HostNetSystemRef,
 		Config: types.HostNetworkConfig{
 			Vswitch: []types.HostVirtualSwitchConfig{{
@@ -529,6 +766,8 @@ func (s *EsxiService) VswitchPost(p VswitchPostParams) error {
 type HandleImportVAppParams struct {
 	Ova        OvaInfo
 	DcVmFolder types.ManagedObjectReference
+	// Required on standalone ESXi; can be left empty for a vCenter DRS
+	// cluster's pool
 	HostSystem types.ManagedObjectReference
 	Datastore  types.ManagedObjectReference
 	RsrcPool   types.ManagedObjectReference
@@ -555,8 +794,8 @@ type OvaInfo struct {
 	Disks []string
 }
 
-func (s *EsxiService) HandleOvaExtract(dir, filename string) (OvaInfo, error) {
-	ovaInfo, err := s.extractOva(dir, filename)
+func (s *EsxiService) HandleOvaExtract(ctx context.Context, dir, filename string) (OvaInfo, error) {
+	ovaInfo, err := s.extractOva(ctx, dir, filename)
 	if err != nil {
 		return ovaInfo, err
 	}
@@ -564,7 +803,15 @@ func (s *EsxiService) HandleOvaExtract(dir, filename string) (OvaInfo, error) {
 	return ovaInfo, nil
 }
 
-func (s *EsxiService) ImportVApp(p HandleImportVAppParams) (types.ManagedObjectReference, error) {
+func (s *EsxiService) ImportVApp(ctx context.Context, p HandleImportVAppParams) (types.ManagedObjectReference, error) {
+	lease, _, err := s.ImportVAppItems(ctx, p)
+	return lease, err
+}
+
+// ImportVAppItems is ImportVApp that also returns the import spec's file
+// items. Pass them to LeaseDiskUrls once the lease is ready to find the url
+// each of the OVA's disks uploads to.
+func (s *EsxiService) ImportVAppItems(ctx context.Context, p HandleImportVAppParams) (types.ManagedObjectReference, []types.OvfFileItem, error) {
 	var mo types.ManagedObjectReference
 	// Set OvfNetworkMapping according to PortGroup Names to Add for VM Networking
 	var networkMapping []types.OvfNetworkMapping
@@ -577,18 +824,22 @@ func (s *EsxiService) ImportVApp(p HandleImportVAppParams) (types.ManagedObjectR
 			}
 		}
 	}
+	var host *types.ManagedObjectReference
+	if p.HostSystem.Value != "" {
+		host = &p.HostSystem
+	}
 	cisp := types.OvfCreateImportSpecParams{
 		OvfManagerCommonParams: types.OvfManagerCommonParams{
 			Locale:           "US",
 			DeploymentOption: p.Vm.DeploymentOptions,
 		},
 		EntityName:       p.Vm.Name,
-		HostSystem:       &p.HostSystem,
+		HostSystem:       host,
 		NetworkMapping:   networkMapping,
 		DiskProvisioning: p.Vm.DiskProvisioning,
 	}
 	ovfMo := s.EsxiClient.ServiceContent.OvfManager
-	cisr, err := methods.CreateImportSpec(s.ctx, s.EsxiClient.Client, &types.CreateImportSpec{
+	cisr, err := methods.CreateImportSpec(ctx, s.EsxiClient.Client, &types.CreateImportSpec{
 		This:          *ovfMo,
 		OvfDescriptor: p.Ova.Ovf.Data,
 		ResourcePool:  p.RsrcPool,
@@ -596,161 +847,325 @@ func (s *EsxiService) ImportVApp(p HandleImportVAppParams) (types.ManagedObjectR
 		Cisp:          cisp,
 	})
 	if err != nil {
-		return mo, err
+		return mo, nil, err
+	}
+	if errs := cisr.Returnval.Error; len(errs) > 0 {
+		return mo, nil, fmt.Errorf("create import spec: %s", errs[0].LocalizedMessage)
 	}
-	resp, err := methods.ImportVApp(s.ctx, s.EsxiClient.Client, &types.ImportVApp{
+	resp, err := methods.ImportVApp(ctx, s.EsxiClient.Client, &types.ImportVApp{
 		This:   p.RsrcPool,
 		Spec:   cisr.Returnval.ImportSpec,
 		Folder: &p.DcVmFolder,
-		Host:   &p.HostSystem,
+		Host:   host,
 	})
 	if err != nil {
-		fmt.Println("failed here")
-		return mo, err
+		return mo, nil, fmt.Errorf("import vapp %s: %w", p.Vm.Name, err)
 	}
-	time.Sleep(1 * time.Second)
-	return resp.Returnval, nil
+	return resp.Returnval, cisr.Returnval.FileItem, nil
 }
 
-func (s *EsxiService) HandleVmdkTransfer(uri, dir string, disks []string, lease *mo.HttpNfcLease, p HandleImportVAppParams) error {
-	url := strings.Replace(uri, "*", s.EsxHostIp, -1)
+// LeaseDiskUrls maps the file name of each of items to the url lease gave
+// its device for upload. Files with no device url, such as ISO images, are
+// left out.
+func LeaseDiskUrls(lease mo.HttpNfcLease, items []types.OvfFileItem) map[string]string {
+	urls := make(map[string]string)
+	if lease.Info == nil {
+		return urls
+	}
+	for _, item := range items {
+		for _, du := range lease.Info.DeviceUrl {
+			if du.ImportKey == item.DeviceId {
+				urls[path.Base(item.Path)] = du.Url
+				break
+			}
+		}
+	}
+	return urls
+}
+
+// leaseProgressInterval is how often HandleVmdkTransfer reports progress
+// on a lease. Hosts time out leases that go several minutes without one.
+const leaseProgressInterval = 10 * time.Second
+
+// HandleVmdkTransfer uploads disks from dir to the lease's device url uri
+// and completes the lease. Disks the url refuses, such as ISO images, are
+// copied to the VM's directory on p.Datastore instead. Progress is reported
+// on the lease while uploading and the lease is aborted if any step fails.
+// Use HandleDiskTransfers for OVAs with more than one disk.
+func (s *EsxiService) HandleVmdkTransfer(ctx context.Context, uri, dir string, disks []string, lease *mo.HttpNfcLease, p HandleImportVAppParams) error {
+	urls := make(map[string]string, len(disks))
 	for _, disk := range disks {
-		path := fmt.Sprintf("./%s/%s", dir, disk)
-		payload, err := os.Open(path)
+		urls[disk] = uri
+	}
+	return s.HandleDiskTransfers(ctx, urls, dir, disks, lease, p)
+}
+
+// HandleDiskTransfers is HandleVmdkTransfer with a url per disk, as
+// returned by LeaseDiskUrls. Disks with no url are copied to the VM's
+// directory on p.Datastore.
+func (s *EsxiService) HandleDiskTransfers(ctx context.Context, urls map[string]string, dir string, disks []string, lease *mo.HttpNfcLease, p HandleImportVAppParams) (err error) {
+	defer func() {
 		if err != nil {
-			fmt.Println("error with disk")
-			return err
+			s.AbortLease(lease.Self)
 		}
-		requestor := newHttpService(s.EsxHostIp, &s.EsxiClient.Jar)
-		req, err := requestor.GenerateRequest("POST", url, payload)
+	}()
+	sizes := make([]int64, len(disks))
+	progress := &leaseProgress{}
+	for i, disk := range disks {
+		fi, err := os.Stat(filepath.Join(dir, disk))
 		if err != nil {
-			fmt.Println("error generating request")
-			return err
+			return fmt.Errorf("open disk %s: %w", disk, err)
 		}
-		req.Header.Add("Content-Type", "application/x-vnd.vmware-streamVmdk")
-		resp, err := requestor.MakeRequest(req)
-		if err != nil {
-			fmt.Println("error in resp")
+		sizes[i] = fi.Size()
+		progress.total += fi.Size()
+	}
+	stop := s.reportLeaseProgress(ctx, lease.Self, progress)
+	var sent int64
+	for i, disk := range disks {
+		url := strings.Replace(urls[disk], "*", s.EsxHostIp, -1)
+		if err = s.uploadLeaseDisk(ctx, url, dir, disk, progress, p); err != nil {
+			stop()
 			return err
 		}
-		defer resp.Body.Close()
-		d, _ := ioutil.ReadAll(resp.Body)
-		respText := string(d)
-		if strings.Contains(respText, "Cannot POST") {
-			var remoteFileName string
-			switch {
-			case strings.Contains(disk, ".iso"):
-				remoteFileName = "_deviceImage-0.iso"
-			}
-			dc, _ := s.GetDatacenter()
-			ds, _ := s.GetDatastore()
-			s.CpFileToDatastore(CpFileParams{
-				DcName:         dc.Name,
-				DsName:         ds.Name,
-				LocalFilePath:  dir,
-				FileName:       disk,
-				DatastoreDir:   fmt.Sprintf("/%s", p.Vm.Name),
-				RemoteFileName: remoteFileName,
-			})
-		}
+		// Datastore copies bypass the counting reader
+		sent += sizes[i]
+		atomic.StoreInt64(&progress.sent, sent)
 	}
+	stop()
 	// Close the Lease for the VAppImport
-	_, err := methods.HttpNfcLeaseComplete(s.ctx, s.EsxiClient.Client, &types.HttpNfcLeaseComplete{
+	_, err = methods.HttpNfcLeaseComplete(ctx, s.EsxiClient.Client, &types.HttpNfcLeaseComplete{
 		This: lease.Self,
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("complete lease %s: %w", lease.Self.Value, err)
 	}
 	return nil
 }
 
-func (s *EsxiService) HandleLease(moRef types.ManagedObjectReference) (mo.HttpNfcLease, error) {
-	var lease mo.HttpNfcLease
-	m := view.NewManager(s.EsxiClient.Client)
-	err := m.Properties(s.ctx, moRef, nil, &lease)
+// uploadLeaseDisk posts one disk to a lease's device url, falling back to
+// a datastore copy when there is no url or the url doesn't take it.
+func (s *EsxiService) uploadLeaseDisk(ctx context.Context, url, dir, disk string, progress *leaseProgress, p HandleImportVAppParams) error {
+	if url == "" {
+		return s.copyLeaseDisk(ctx, dir, disk, p)
+	}
+	payload, err := os.Open(filepath.Join(dir, disk))
+	if err != nil {
+		return fmt.Errorf("open disk %s: %w", disk, err)
+	}
+	defer payload.Close()
+	fi, err := payload.Stat()
+	if err != nil {
+		return fmt.Errorf("open disk %s: %w", disk, err)
+	}
+	requestor := newHttpService(s.EsxHostIp, &s.EsxiClient.Jar, s.EsxiClient.tlsConfig)
+	req, err := requestor.GenerateRequest(ctx, "POST", url, &countingReader{r: payload, n: &progress.sent})
+	if err != nil {
+		return fmt.Errorf("upload disk %s: %w", disk, err)
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Add("Content-Type", "application/x-vnd.vmware-streamVmdk")
+	resp, err := requestor.MakeRequest(req)
+	if err != nil {
+		return fmt.Errorf("upload disk %s: %w", disk, err)
+	}
+	defer resp.Body.Close()
+	d, _ := ioutil.ReadAll(resp.Body)
+	if strings.Contains(string(d), "Cannot POST") {
+		return s.copyLeaseDisk(ctx, dir, disk, p)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload disk %s: %s", disk, resp.Status)
+	}
+	return nil
+}
+
+// copyLeaseDisk copies a file the lease has no device url for straight
+// onto the datastore the VM is being imported to.
+func (s *EsxiService) copyLeaseDisk(ctx context.Context, dir, disk string, p HandleImportVAppParams) error {
+	var remoteFileName string
+	switch {
+	case strings.Contains(disk, ".iso"):
+		remoteFileName = "_deviceImage-0.iso"
+	}
+	var ds mo.Datastore
+	err := property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, p.Datastore, []string{"name"}, &ds)
+	if err != nil {
+		return fmt.Errorf("datastore %s: %w", p.Datastore.Value, err)
+	}
+	dc, err := s.datacenterOf(ctx, p.Datastore)
 	if err != nil {
+		return fmt.Errorf("datacenter of datastore %s: %w", ds.Name, err)
+	}
+	return s.CpFileToDatastore(ctx, CpFileParams{
+		DcName:         dc.Name,
+		DsName:         ds.Name,
+		LocalFilePath:  dir,
+		FileName:       disk,
+		DatastoreDir:   fmt.Sprintf("/%s", p.Vm.Name),
+		RemoteFileName: remoteFileName,
+	})
+}
+
+// leaseProgress counts the bytes of a lease's disks sent so far.
+type leaseProgress struct {
+	sent  int64 // accessed atomically
+	total int64
+}
+
+func (p *leaseProgress) percent() int32 {
+	if p.total == 0 {
+		return 0
+	}
+	pct := atomic.LoadInt64(&p.sent) * 100 / p.total
+	if pct > 100 {
+		pct = 100
+	}
+	return int32(pct)
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// reportLeaseProgress sends progress's percentage to the lease every
+// leaseProgressInterval until the returned stop func is called.
+func (s *EsxiService) reportLeaseProgress(ctx context.Context, leaseMo types.ManagedObjectReference, progress *leaseProgress) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(leaseProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				methods.HttpNfcLeaseProgress(ctx, s.EsxiClient.Client, &types.HttpNfcLeaseProgress{
+					This:    leaseMo,
+					Percent: progress.percent(),
+				})
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// AbortLease releases the host side of a lease an import gave up on,
+// which removes the half imported VM. It runs on its own context since
+// the caller's may be done.
+func (s *EsxiService) AbortLease(leaseMo types.ManagedObjectReference) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	methods.HttpNfcLeaseAbort(ctx, s.EsxiClient.Client, &types.HttpNfcLeaseAbort{
+		This: leaseMo,
+	})
+}
+
+// HandleLease waits for the lease of an import to be ready. A lease that
+// fails, or isn't ready by the time ctx is done, is aborted.
+func (s *EsxiService) HandleLease(ctx context.Context, moRef types.ManagedObjectReference) (lease mo.HttpNfcLease, err error) {
+	// A lease that never got ready is of no use to the caller, and would
+	// leave the half imported VM behind
+	defer func() {
+		if err != nil {
+			s.AbortLease(moRef)
+		}
+	}()
+	m := view.NewManager(s.EsxiClient.Client)
+	if err = m.Properties(ctx, moRef, nil, &lease); err != nil {
 		return lease, err
 	}
-	leaseState := string(lease.State)
-LeaseState:
 	for {
-		switch leaseState {
-		case string(types.HttpNfcLeaseStateInitializing):
-			time.Sleep(2 * time.Second)
-		case string(types.HttpNfcLeaseStateError):
-			err = fmt.Errorf("lease error: %s", string(types.HttpNfcLeaseStateError))
-			break LeaseState
-		case string(types.HttpNfcLeaseStateReady):
-			break LeaseState
+		switch lease.State {
+		case types.HttpNfcLeaseStateReady:
+			return lease, nil
+		case types.HttpNfcLeaseStateError:
+			return lease, leaseError(lease)
+		case types.HttpNfcLeaseStateDone:
+			return lease, fmt.Errorf("lease %s is already done", moRef.Value)
 		}
-		lease, err := s.getLease(moRef)
-		if err != nil {
-			break
+		select {
+		case <-ctx.Done():
+			return lease, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		if lease, err = s.getLease(ctx, moRef); err != nil {
+			return lease, err
 		}
-		leaseState = string(lease.State)
 	}
-	if err != nil {
-		return lease, err
+}
+
+// leaseError describes the fault that put lease in the error state.
+func leaseError(lease mo.HttpNfcLease) error {
+	if lease.Error == nil {
+		return errors.New("lease error")
 	}
-	return lease, nil
+	msg := lease.Error.LocalizedMessage
+	if msg == "" && lease.Error.Fault != nil {
+		msg = reflect.TypeOf(lease.Error.Fault).Elem().Name()
+	}
+	return fmt.Errorf("lease error: %s", msg)
 }
 
-func (s *EsxiService) getLease(leaseMo types.ManagedObjectReference) (mo.HttpNfcLease, error) {
+func (s *EsxiService) getLease(ctx context.Context, leaseMo types.ManagedObjectReference) (mo.HttpNfcLease, error) {
 	var lease mo.HttpNfcLease
 	manager := view.NewManager(s.EsxiClient.Client)
-	err := manager.Properties(s.ctx, leaseMo, nil, &lease)
+	err := manager.Properties(ctx, leaseMo, nil, &lease)
 	if err != nil {
-		fmt.Println("error getting HttpNfcLease Properties")
-		return lease, err
+		return lease, fmt.Errorf("lease %s: %w", leaseMo.Value, err)
 	}
 	return lease, nil
 }
 
-func (s *EsxiService) extractOva(path, filename string) (OvaInfo, error) {
+// extractOva unpacks the OVA dir/filename into dir and lists the OVF and
+// disks it held.
+func (s *EsxiService) extractOva(ctx context.Context, dir, filename string) (OvaInfo, error) {
 	var ovaInfo OvaInfo
-	f, err := os.Open(fmt.Sprintf("./%s/%s", path, filename))
+	f, err := os.Open(filepath.Join(dir, filename))
 	if err != nil {
 		return ovaInfo, err
 	}
 	defer f.Close()
-	var fr io.ReadCloser = f
-	tr := tar.NewReader(fr)
-OuterLoop:
+	tr := tar.NewReader(f)
 	for {
+		if err := ctx.Err(); err != nil {
+			return ovaInfo, err
+		}
 		header, err := tr.Next()
-		switch {
-		case err == io.EOF:
-			break OuterLoop
-			// return ovfInfo, nil
-		case err != nil:
-			break OuterLoop
-			// return ovfInfo, err
-		case header == nil:
-			continue
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ovaInfo, fmt.Errorf("extract %s: %w", filename, err)
+		}
+		target, err := ovaEntryPath(dir, header.Name)
+		if err != nil {
+			return ovaInfo, fmt.Errorf("extract %s: %w", filename, err)
 		}
-		target := filepath.Join(fmt.Sprintf("./%s", path), header.Name)
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.Mkdir(target, 0o755); err != nil {
-					break
-				}
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return ovaInfo, fmt.Errorf("extract %s: %w", filename, err)
 			}
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				break
-			}
-			defer f.Close()
-			if _, err := io.Copy(f, tr); err != nil {
-				break OuterLoop
+			if err := extractOvaFile(target, tr, os.FileMode(header.Mode)); err != nil {
+				return ovaInfo, fmt.Errorf("extract %s: %w", filename, err)
 			}
 		}
 	}
-	if err != nil {
-		return ovaInfo, err
-	}
-	dirEntries, err := os.ReadDir("./" + path)
+	dirEntries, err := os.ReadDir(dir)
 	if err != nil {
 		return ovaInfo, err
 	}
@@ -758,14 +1173,38 @@ OuterLoop:
 		switch {
 		case strings.Contains(entry.Name(), ".ovf"):
 			ovaInfo.Ovf.FileName = entry.Name()
-			ovfFile, _ := os.Open(fmt.Sprintf("./%s/%s", path, entry.Name()))
-			defer ovfFile.Close()
-			d, _ := ioutil.ReadAll(ovfFile)
+			d, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return ovaInfo, err
+			}
 			ovaInfo.Ovf.Data = string(d)
 		case strings.Contains(entry.Name(), ".vmdk") || strings.Contains(entry.Name(), ".iso"):
 			ovaInfo.Disks = append(ovaInfo.Disks, entry.Name())
 		}
 	}
-	ovaInfo.Dir = path
+	ovaInfo.Dir = dir
 	return ovaInfo, nil
 }
+
+// ovaEntryPath returns where the OVA entry name extracts to under dir.
+// Names that would land outside dir are refused.
+func ovaEntryPath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %s is outside the OVA", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// extractOvaFile writes the contents of r to target.
+func extractOvaFile(target string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
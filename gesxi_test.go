@@ -0,0 +1,197 @@
+package gesxi
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestLeaseDiskUrls(t *testing.T) {
+	lease := mo.HttpNfcLease{Info: &types.HttpNfcLeaseInfo{
+		DeviceUrl: []types.HttpNfcLeaseDeviceUrl{
+			{ImportKey: "/app/VirtualLsiLogicController0:0", Url: "https://*/nfc/52a1/disk-0.vmdk"},
+			{ImportKey: "/app/VirtualLsiLogicController0:1", Url: "https://*/nfc/52a1/disk-1.vmdk"},
+		},
+	}}
+	items := []types.OvfFileItem{
+		{DeviceId: "/app/VirtualLsiLogicController0:1", Path: "app-disk2.vmdk"},
+		{DeviceId: "/app/VirtualLsiLogicController0:0", Path: "disks/app-disk1.vmdk"},
+		{DeviceId: "/app/VirtualCdrom0", Path: "app.iso"},
+	}
+	got := LeaseDiskUrls(lease, items)
+	want := map[string]string{
+		"app-disk1.vmdk": "https://*/nfc/52a1/disk-0.vmdk",
+		"app-disk2.vmdk": "https://*/nfc/52a1/disk-1.vmdk",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := LeaseDiskUrls(mo.HttpNfcLease{}, items); len(got) != 0 {
+		t.Fatalf("lease without info: got %v", got)
+	}
+}
+
+// testLease starts importing a VM on esx and returns the import's lease.
+func testLease(t *testing.T, esx *EsxiService) types.ManagedObjectReference {
+	t.Helper()
+	ctx := context.Background()
+	pool, err := esx.GetRsrcPool(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := esx.GetDatastore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &types.VirtualMachineImportSpec{ConfigSpec: types.VirtualMachineConfigSpec{
+		Name:    "import0",
+		GuestId: string(types.VirtualMachineGuestOsIdentifierOtherGuest),
+		Files:   &types.VirtualMachineFileInfo{VmPathName: "[" + ds.Name + "]"},
+	}}
+	res, err := methods.ImportVApp(ctx, esx.EsxiClient.Client, &types.ImportVApp{This: pool.Self, Spec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Returnval
+}
+
+func TestHandleLease(t *testing.T) {
+	esx, _ := testService(t, simulator.ESX())
+	leaseRef := testLease(t, esx)
+	lease, err := esx.HandleLease(context.Background(), leaseRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.State != types.HttpNfcLeaseStateReady {
+		t.Fatalf("lease %s", lease.State)
+	}
+}
+
+func TestHandleLeaseContextDone(t *testing.T) {
+	esx, _ := testService(t, simulator.ESX())
+	leaseRef := testLease(t, esx)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := esx.HandleLease(ctx, leaseRef); err == nil {
+		t.Fatal("no error with the context done")
+	}
+	// The host drops an aborted lease
+	if _, err := esx.getLease(context.Background(), leaseRef); err == nil {
+		t.Fatal("lease wasn't aborted")
+	}
+}
+
+// testOva writes an OVA holding entries, name to contents, to dir.
+func testOva(t *testing.T, dir string, entries [][2]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0o644, Size: int64(len(e[1])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.ova"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return "app.ova"
+}
+
+func TestHandleOvaExtract(t *testing.T) {
+	dir := t.TempDir()
+	name := testOva(t, dir, [][2]string{{"app.ovf", "<Envelope/>"}, {"app-disk1.vmdk", "disk"}})
+	ova, err := (&EsxiService{}).HandleOvaExtract(context.Background(), dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ova.Dir != dir || ova.Ovf.FileName != "app.ovf" || ova.Ovf.Data != "<Envelope/>" {
+		t.Errorf("got %+v", ova)
+	}
+	if !reflect.DeepEqual(ova.Disks, []string{"app-disk1.vmdk"}) {
+		t.Errorf("disks %v", ova.Disks)
+	}
+}
+
+func TestHandleOvaExtractOutside(t *testing.T) {
+	for _, entry := range []string{"../evil.ovf", "disks/../../evil.ovf", "/tmp/evil.ovf"} {
+		t.Run(entry, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "ova")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			name := testOva(t, dir, [][2]string{{entry, "x"}})
+			if _, err := (&EsxiService{}).HandleOvaExtract(context.Background(), dir, name); err == nil {
+				t.Fatal("extracted an entry outside the directory")
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil.ovf")); err == nil {
+				t.Fatal("evil.ovf written outside the directory")
+			}
+		})
+	}
+}
+
+func TestHandleOvaExtractCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.ova"), bytes.Repeat([]byte("x"), 1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&EsxiService{}).HandleOvaExtract(context.Background(), dir, "bad.ova"); err == nil {
+		t.Fatal("no error for a corrupt OVA")
+	}
+	if _, err := (&EsxiService{}).HandleOvaExtract(context.Background(), dir, "missing.ova"); err == nil {
+		t.Fatal("no error for a missing OVA")
+	}
+}
+
+func TestAddPG(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.ESX())
+	hosts, err := esx.GetHosts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netSys := *hosts[0].ConfigManager.NetworkSystem
+	// vcsim's network system doesn't know vSwitch0's uplink
+	ns := simulator.Map.Get(netSys).(*simulator.HostNetworkSystem)
+	ns.NetworkInfo.Vswitch[0].Spec.Bridge = &types.HostVirtualSwitchBondBridge{NicDevice: []string{"vmnic0"}}
+	on := types.NewBool(true)
+	tests := []struct {
+		name    string
+		p       AddPgParams
+		wantErr bool
+	}{
+		{"uplink", AddPgParams{PgName: "pg1", VswitchName: "vSwitch0", Teaming: &TeamingSpec{Active: []string{"vmnic0"}}}, false},
+		{"not an uplink", AddPgParams{PgName: "pg2", VswitchName: "vSwitch0", Teaming: &TeamingSpec{Active: []string{"vmnic0"}, Standby: []string{"vmnic1"}}}, true},
+		{"listed twice", AddPgParams{PgName: "pg3", VswitchName: "vSwitch0", Teaming: &TeamingSpec{Active: []string{"vmnic0"}, Standby: []string{"vmnic0"}}}, true},
+		{"no vswitch", AddPgParams{PgName: "pg4", VswitchName: "vSwitch9", Teaming: &TeamingSpec{Active: []string{"vmnic0"}}}, true},
+		{"shaping", AddPgParams{PgName: "pg5", VswitchName: "vSwitch0", Shaping: &ShapingSpec{Enabled: on, AverageKbps: 1000, PeakKbps: 2000, BurstKB: 100}}, false},
+		{"shaping without burst", AddPgParams{PgName: "pg6", VswitchName: "vSwitch0", Shaping: &ShapingSpec{Enabled: on, AverageKbps: 1000, PeakKbps: 2000}}, true},
+		{"negative shaping", AddPgParams{PgName: "pg7", VswitchName: "vSwitch0", Shaping: &ShapingSpec{AverageKbps: -1}}, true},
+		{"peak below average", AddPgParams{PgName: "pg8", VswitchName: "vSwitch0", Shaping: &ShapingSpec{AverageKbps: 2000, PeakKbps: 1000}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.HostNetSystemRef = netSys
+			err := esx.AddPG(ctx, tt.p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
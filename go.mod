@@ -5,4 +5,7 @@ go 1.18
 require (
 	github.com/subosito/gotenv v1.4.1
 	github.com/vmware/govmomi v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/google/uuid v1.3.0 // indirect
@@ -0,0 +1,984 @@
+package gesxi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"gopkg.in/yaml.v3"
+)
+
+// TeamingPolicy is how a vSwitch or port group spreads traffic over its
+// uplinks
+type TeamingPolicy string
+
+const (
+	TeamingSrcPortId        TeamingPolicy = "loadbalance_srcid"
+	TeamingIpHash           TeamingPolicy = "loadbalance_ip"
+	TeamingSrcMac           TeamingPolicy = "loadbalance_srcmac"
+	TeamingExplicitFailover TeamingPolicy = "failover_explicit"
+)
+
+// HostNetworkSpec is the standard switch networking a host should have.
+// PlanHostNetwork compares it with what the host has and ApplyHostNetwork
+// makes the difference, so applying the same spec twice changes nothing
+// the second time. Fields left empty keep the host's setting, or the ESXi
+// default for new objects.
+type HostNetworkSpec struct {
+	Vswitches  []VswitchSpec   `json:"vswitches,omitempty" yaml:"vswitches"`
+	PortGroups []PortGroupSpec `json:"portGroups,omitempty" yaml:"portGroups"`
+	Vmkernels  []VmkernelSpec  `json:"vmkernels,omitempty" yaml:"vmkernels"`
+	// Remove the vSwitches, port groups and VMkernel adapters the spec
+	// doesn't list. vmk0, its port group and vSwitch are always kept so
+	// the host stays reachable
+	Prune bool `json:"prune,omitempty" yaml:"prune"`
+}
+
+// VswitchSpec is a standard vSwitch of a HostNetworkSpec
+type VswitchSpec struct {
+	Name string `json:"name" yaml:"name"`
+	// Physical NICs bound to the vSwitch, e.g. vmnic1. An empty list
+	// unbinds them all
+	Uplinks  []string      `json:"uplinks,omitempty" yaml:"uplinks"`
+	Mtu      int32         `json:"mtu,omitempty" yaml:"mtu"`
+	NumPorts int32         `json:"numPorts,omitempty" yaml:"numPorts"`
+	Teaming  *TeamingSpec  `json:"teaming,omitempty" yaml:"teaming"`
+	Security *SecuritySpec `json:"security,omitempty" yaml:"security"`
+	Shaping  *ShapingSpec  `json:"shaping,omitempty" yaml:"shaping"`
+}
+
+// PortGroupSpec is a port group of a HostNetworkSpec
+type PortGroupSpec struct {
+	Name    string `json:"name" yaml:"name"`
+	Vswitch string `json:"vswitch" yaml:"vswitch"`
+	// Always applied: 0 is untagged, VlanTrunk passes every VLAN to the guest
+	VlanId int32 `json:"vlanId" yaml:"vlanId"`
+	// Override the vSwitch's policies; unset fields inherit them
+	Teaming  *TeamingSpec  `json:"teaming,omitempty" yaml:"teaming"`
+	Security *SecuritySpec `json:"security,omitempty" yaml:"security"`
+	Shaping  *ShapingSpec  `json:"shaping,omitempty" yaml:"shaping"`
+}
+
+// TeamingSpec is the NIC teaming and failover policy of a vSwitch or port
+// group
+type TeamingSpec struct {
+	Policy TeamingPolicy `json:"policy,omitempty" yaml:"policy"`
+	// Uplinks in use and on standby, in failover order, each one of the
+	// vSwitch's uplinks. A vSwitch whose uplinks change uses them all as
+	// active unless these are set
+	Active         []string `json:"active,omitempty" yaml:"active"`
+	Standby        []string `json:"standby,omitempty" yaml:"standby"`
+	NotifySwitches *bool    `json:"notifySwitches,omitempty" yaml:"notifySwitches"`
+	// Move traffic back to an active uplink once it recovers
+	Failback *bool `json:"failback,omitempty" yaml:"failback"`
+}
+
+// SecuritySpec is the security policy of a vSwitch or port group
+type SecuritySpec struct {
+	AllowPromiscuous *bool `json:"allowPromiscuous,omitempty" yaml:"allowPromiscuous"`
+	MacChanges       *bool `json:"macChanges,omitempty" yaml:"macChanges"`
+	ForgedTransmits  *bool `json:"forgedTransmits,omitempty" yaml:"forgedTransmits"`
+}
+
+// ShapingSpec is the outbound traffic shaping policy of a vSwitch or port
+// group, in the units the host client shows
+type ShapingSpec struct {
+	// The rates only apply once shaping is enabled; ESXi wants all three
+	// when it is
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled"`
+	// Kbit/s
+	AverageKbps int64 `json:"averageKbps,omitempty" yaml:"averageKbps"`
+	PeakKbps    int64 `json:"peakKbps,omitempty" yaml:"peakKbps"`
+	BurstKB     int64 `json:"burstKB,omitempty" yaml:"burstKB"`
+}
+
+// VmkernelSpec is a VMkernel adapter of a HostNetworkSpec
+type VmkernelSpec struct {
+	// e.g. vmk1. Without one the spec matches the host's adapter on
+	// PortGroup, and a new adapter gets the next free device
+	Device    string `json:"device,omitempty" yaml:"device"`
+	PortGroup string `json:"portGroup" yaml:"portGroup"`
+	// DHCP, or a static Ip and Netmask
+	Dhcp    bool   `json:"dhcp,omitempty" yaml:"dhcp"`
+	Ip      string `json:"ip,omitempty" yaml:"ip"`
+	Netmask string `json:"netmask,omitempty" yaml:"netmask"`
+	Mtu     int32  `json:"mtu,omitempty" yaml:"mtu"`
+	// Services the adapter carries, e.g. management, vmotion, vsan or
+	// faultToleranceLogging; the others are turned off. Nil leaves them
+	// alone
+	Services []string `json:"services,omitempty" yaml:"services"`
+}
+
+// LoadHostNetworkSpec reads a HostNetworkSpec from a YAML or JSON file.
+func LoadHostNetworkSpec(path string) (HostNetworkSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return HostNetworkSpec{}, err
+	}
+	spec, err := ParseHostNetworkSpec(data)
+	if err != nil {
+		return spec, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// ParseHostNetworkSpec decodes a HostNetworkSpec from YAML or JSON (which
+// is also YAML). Unknown fields are an error, so typos don't go unnoticed.
+func ParseHostNetworkSpec(data []byte) (HostNetworkSpec, error) {
+	var spec HostNetworkSpec
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return spec, err
+	}
+	return spec, spec.validate()
+}
+
+func (spec HostNetworkSpec) validate() error {
+	seen := map[string]bool{}
+	for _, vs := range spec.Vswitches {
+		if vs.Name == "" {
+			return errors.New("vswitch without a name")
+		}
+		if seen["vswitch "+vs.Name] {
+			return fmt.Errorf("vswitch %s listed twice", vs.Name)
+		}
+		seen["vswitch "+vs.Name] = true
+		if err := checkFailoverOrder(vs.Teaming, vs.Uplinks); err != nil {
+			return fmt.Errorf("vswitch %s: %w", vs.Name, err)
+		}
+		if err := checkShaping(vs.Shaping, false); err != nil {
+			return fmt.Errorf("vswitch %s: %w", vs.Name, err)
+		}
+	}
+	for _, pg := range spec.PortGroups {
+		if pg.Name == "" || pg.Vswitch == "" {
+			return fmt.Errorf("port group %q needs a name and a vswitch", pg.Name)
+		}
+		if pg.VlanId < 0 || pg.VlanId > VlanTrunk {
+			return fmt.Errorf("port group %s: vlan %d out of range 0-%d", pg.Name, pg.VlanId, VlanTrunk)
+		}
+		if seen["portgroup "+pg.Name] {
+			return fmt.Errorf("port group %s listed twice", pg.Name)
+		}
+		seen["portgroup "+pg.Name] = true
+		if err := checkFailoverOrder(pg.Teaming, nil); err != nil {
+			return fmt.Errorf("port group %s: %w", pg.Name, err)
+		}
+		if err := checkShaping(pg.Shaping, false); err != nil {
+			return fmt.Errorf("port group %s: %w", pg.Name, err)
+		}
+	}
+	for i, vmk := range spec.Vmkernels {
+		if vmk.PortGroup == "" {
+			// Without a port group, only its place in the list tells
+			// an adapter with no device apart
+			name := vmk.Device
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return fmt.Errorf("vmkernel %s needs a port group", name)
+		}
+		if vmk.Dhcp && vmk.Ip != "" {
+			return fmt.Errorf("vmkernel on %s: dhcp and ip are exclusive", vmk.PortGroup)
+		}
+		if (vmk.Ip == "") != (vmk.Netmask == "") {
+			return fmt.Errorf("vmkernel on %s: ip and netmask go together", vmk.PortGroup)
+		}
+	}
+	return nil
+}
+
+// NetworkChange is one step of a NetworkPlan
+type NetworkChange struct {
+	Op types.HostConfigChangeOperation `json:"op"`
+	// vswitch, portgroup or vmkernel
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// What differs, e.g. "mtu 1500 -> 9000"
+	Diffs []string `json:"diffs,omitempty"`
+}
+
+func (c NetworkChange) String() string {
+	sign := map[types.HostConfigChangeOperation]string{
+		types.HostConfigChangeOperationAdd:    "+",
+		types.HostConfigChangeOperationEdit:   "~",
+		types.HostConfigChangeOperationRemove: "-",
+	}[c.Op]
+	line := fmt.Sprintf("%s %s %s", sign, c.Kind, c.Name)
+	if len(c.Diffs) > 0 {
+		line += ": " + strings.Join(c.Diffs, ", ")
+	}
+	return line
+}
+
+// NetworkPlan is what ApplyHostNetwork will change on a host to match a
+// HostNetworkSpec
+type NetworkPlan struct {
+	Host    string          `json:"host"`
+	Changes []NetworkChange `json:"changes"`
+
+	netSystem   types.ManagedObjectReference
+	vnicManager types.ManagedObjectReference
+	config      types.HostNetworkConfig
+	services    []serviceChange
+}
+
+// serviceChange turns a service on or off on a VMkernel adapter. Adapters
+// the plan adds have no device yet; added is their index in the vnics the
+// network config adds.
+type serviceChange struct {
+	nicType string
+	device  string
+	added   int
+	enable  bool
+}
+
+// Empty reports whether the host already matches the spec.
+func (p *NetworkPlan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+func (p *NetworkPlan) String() string {
+	if p.Empty() {
+		return fmt.Sprintf("%s: no changes", p.Host)
+	}
+	lines := make([]string, len(p.Changes))
+	for i, c := range p.Changes {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PlanHostNetwork compares host's vSwitches, port groups and VMkernel
+// adapters with spec and returns the changes that would make them match.
+// Nothing is changed until the plan is passed to ApplyHostNetwork.
+func (s *EsxiService) PlanHostNetwork(ctx context.Context, host types.ManagedObjectReference, spec HostNetworkSpec) (*NetworkPlan, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	var h mo.HostSystem
+	err := property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, host, []string{
+		"name",
+		"configManager.networkSystem",
+		"configManager.virtualNicManager",
+		"config.network",
+		"config.virtualNicManagerInfo",
+	}, &h)
+	if err != nil {
+		return nil, err
+	}
+	if h.ConfigManager.NetworkSystem == nil || h.Config == nil || h.Config.Network == nil {
+		return nil, fmt.Errorf("plan network of %s: host has no network system", h.Name)
+	}
+	p, err := planHostNetwork(h.Name, h.Config.Network, h.Config.VirtualNicManagerInfo, spec)
+	if err != nil {
+		return nil, err
+	}
+	p.netSystem = *h.ConfigManager.NetworkSystem
+	if h.ConfigManager.VirtualNicManager != nil {
+		p.vnicManager = *h.ConfigManager.VirtualNicManager
+	}
+	return p, nil
+}
+
+// planHostNetwork compares the network config and VMkernel services of
+// host with spec.
+func planHostNetwork(host string, info *types.HostNetworkInfo, nicInfo *types.HostVirtualNicManagerInfo, spec HostNetworkSpec) (*NetworkPlan, error) {
+	p := &NetworkPlan{Host: host}
+	keep := keptNetwork(info)
+
+	vswitches := map[string]types.HostVirtualSwitch{}
+	// The uplinks each vSwitch will have, which failover orders may name
+	uplinks := map[string][]string{}
+	for _, vs := range info.Vswitch {
+		vswitches[vs.Name] = vs
+		uplinks[vs.Name] = nonNil(vswitchUplinks(vs))
+	}
+	for _, want := range spec.Vswitches {
+		if _, ok := vswitches[want.Name]; !ok || want.Uplinks != nil {
+			uplinks[want.Name] = nonNil(want.Uplinks)
+		}
+	}
+	wantVswitch := map[string]bool{}
+	for _, want := range spec.Vswitches {
+		wantVswitch[want.Name] = true
+		if err := checkFailoverOrder(want.Teaming, uplinks[want.Name]); err != nil {
+			return nil, fmt.Errorf("plan vswitch %s: %w", want.Name, err)
+		}
+		cur, ok := vswitches[want.Name]
+		if !ok {
+			p.addVswitch(want)
+			continue
+		}
+		p.editVswitch(cur, want)
+	}
+
+	portGroups := map[string]types.HostPortGroup{}
+	for _, pg := range info.Portgroup {
+		portGroups[pg.Spec.Name] = pg
+	}
+	wantPg := map[string]bool{}
+	for _, want := range spec.PortGroups {
+		wantPg[want.Name] = true
+		if _, ok := vswitches[want.Vswitch]; !ok && !wantVswitch[want.Vswitch] {
+			return nil, fmt.Errorf("plan port group %s: vswitch %s: %w", want.Name, want.Vswitch, ErrNotFound)
+		}
+		if err := checkFailoverOrder(want.Teaming, uplinks[want.Vswitch]); err != nil {
+			return nil, fmt.Errorf("plan port group %s: %w", want.Name, err)
+		}
+		cur, ok := portGroups[want.Name]
+		if !ok {
+			p.addPortGroup(want)
+			continue
+		}
+		p.editPortGroup(cur, want)
+	}
+
+	if err := p.planVmkernels(info, nicInfo, spec, keep); err != nil {
+		return nil, err
+	}
+
+	if spec.Prune {
+		for _, pg := range info.Portgroup {
+			if !wantPg[pg.Spec.Name] && !keep[pg.Spec.Name] {
+				spec := pg.Spec
+				p.config.Portgroup = append(p.config.Portgroup, types.HostPortGroupConfig{
+					ChangeOperation: string(types.HostConfigChangeOperationRemove),
+					Spec:            &spec,
+				})
+				p.change(types.HostConfigChangeOperationRemove, "portgroup", pg.Spec.Name, nil)
+			}
+		}
+		for _, vs := range info.Vswitch {
+			if !wantVswitch[vs.Name] && !keep[vs.Name] {
+				p.config.Vswitch = append(p.config.Vswitch, types.HostVirtualSwitchConfig{
+					ChangeOperation: string(types.HostConfigChangeOperationRemove),
+					Name:            vs.Name,
+				})
+				p.change(types.HostConfigChangeOperationRemove, "vswitch", vs.Name, nil)
+			}
+		}
+	}
+	return p, nil
+}
+
+// ApplyHostNetwork makes the changes of plan in one UpdateNetworkConfig
+// call, then turns VMkernel services on and off. An empty plan does
+// nothing.
+func (s *EsxiService) ApplyHostNetwork(ctx context.Context, plan *NetworkPlan) error {
+	if plan.Empty() {
+		return nil
+	}
+	var added []string
+	c := plan.config
+	if len(c.Vswitch) > 0 || len(c.Portgroup) > 0 || len(c.Vnic) > 0 {
+		res, err := methods.UpdateNetworkConfig(ctx, s.EsxiClient.Client, &types.UpdateNetworkConfig{
+			This:       plan.netSystem,
+			Config:     c,
+			ChangeMode: string(types.HostConfigChangeModeModify),
+		})
+		if err != nil {
+			return fmt.Errorf("apply network of %s: %w", plan.Host, err)
+		}
+		added = res.Returnval.VnicDevice
+	}
+	for _, sc := range plan.services {
+		device := sc.device
+		if device == "" {
+			if sc.added >= len(added) {
+				return fmt.Errorf("apply network of %s: no device reported for new vmkernel adapter", plan.Host)
+			}
+			device = added[sc.added]
+		}
+		var err error
+		if sc.enable {
+			_, err = methods.SelectVnicForNicType(ctx, s.EsxiClient.Client, &types.SelectVnicForNicType{
+				This:    plan.vnicManager,
+				NicType: sc.nicType,
+				Device:  device,
+			})
+		} else {
+			_, err = methods.DeselectVnicForNicType(ctx, s.EsxiClient.Client, &types.DeselectVnicForNicType{
+				This:    plan.vnicManager,
+				NicType: sc.nicType,
+				Device:  device,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("apply network of %s: service %s on %s: %w", plan.Host, sc.nicType, device, err)
+		}
+	}
+	return nil
+}
+
+func (p *NetworkPlan) change(op types.HostConfigChangeOperation, kind, name string, diffs []string) {
+	p.Changes = append(p.Changes, NetworkChange{Op: op, Kind: kind, Name: name, Diffs: diffs})
+}
+
+func (p *NetworkPlan) addVswitch(want VswitchSpec) {
+	spec := &types.HostVirtualSwitchSpec{NumPorts: want.NumPorts, Mtu: want.Mtu}
+	if spec.NumPorts == 0 {
+		spec.NumPorts = 1024
+	}
+	diffs := []string{fmt.Sprintf("ports %d", spec.NumPorts)}
+	if want.Mtu != 0 {
+		diffs = append(diffs, fmt.Sprintf("mtu %d", want.Mtu))
+	}
+	if len(want.Uplinks) > 0 {
+		spec.Bridge = &types.HostVirtualSwitchBondBridge{NicDevice: want.Uplinks}
+		diffs = append(diffs, fmt.Sprintf("uplinks %v", want.Uplinks))
+	}
+	teaming, defaulted := want.Teaming, false
+	if len(want.Uplinks) > 0 {
+		teaming, defaulted = defaultActive(teaming, want.Uplinks)
+	}
+	policy := &types.HostNetworkPolicy{}
+	var d []string
+	policy.NicTeaming, d = teamingPolicy(nil, teaming, want.Uplinks)
+	if defaulted {
+		d = markDefaultActive(d)
+	}
+	diffs = append(diffs, d...)
+	policy.Security, d = securityPolicy(nil, want.Security)
+	diffs = append(diffs, d...)
+	policy.ShapingPolicy, d = shapingPolicy(nil, want.Shaping)
+	diffs = append(diffs, d...)
+	if policy.NicTeaming != nil || policy.Security != nil || policy.ShapingPolicy != nil {
+		spec.Policy = policy
+	}
+	diffs = newValues(diffs)
+	p.config.Vswitch = append(p.config.Vswitch, types.HostVirtualSwitchConfig{
+		ChangeOperation: string(types.HostConfigChangeOperationAdd),
+		Name:            want.Name,
+		Spec:            spec,
+	})
+	p.change(types.HostConfigChangeOperationAdd, "vswitch", want.Name, diffs)
+}
+
+func (p *NetworkPlan) editVswitch(cur types.HostVirtualSwitch, want VswitchSpec) {
+	spec := cur.Spec
+	var diffs []string
+	if want.NumPorts != 0 && want.NumPorts != spec.NumPorts {
+		diffs = append(diffs, fmt.Sprintf("ports %d -> %d", spec.NumPorts, want.NumPorts))
+		spec.NumPorts = want.NumPorts
+	}
+	if want.Mtu != 0 && want.Mtu != cur.Mtu {
+		diffs = append(diffs, fmt.Sprintf("mtu %d -> %d", cur.Mtu, want.Mtu))
+		spec.Mtu = want.Mtu
+	}
+	uplinks := vswitchUplinks(cur)
+	teaming, defaulted := want.Teaming, false
+	if want.Uplinks != nil && !sameSet(uplinks, want.Uplinks) {
+		diffs = append(diffs, fmt.Sprintf("uplinks %v -> %v", uplinks, want.Uplinks))
+		uplinks = want.Uplinks
+		spec.Bridge = nil
+		if len(uplinks) > 0 {
+			// Only the NICs change; beacon probing and CDP/LLDP stay
+			bridge := types.HostVirtualSwitchBondBridge{}
+			if b, ok := cur.Spec.Bridge.(*types.HostVirtualSwitchBondBridge); ok {
+				bridge = *b
+			}
+			bridge.NicDevice = uplinks
+			spec.Bridge = &bridge
+		}
+		// The failover order has to name exactly the bound uplinks
+		teaming, defaulted = defaultActive(teaming, uplinks)
+	}
+	var policy types.HostNetworkPolicy
+	if spec.Policy != nil {
+		policy = *spec.Policy
+	}
+	var d []string
+	policy.NicTeaming, d = teamingPolicy(policy.NicTeaming, teaming, uplinks)
+	if defaulted {
+		d = markDefaultActive(d)
+	}
+	diffs = append(diffs, d...)
+	policy.Security, d = securityPolicy(policy.Security, want.Security)
+	diffs = append(diffs, d...)
+	policy.ShapingPolicy, d = shapingPolicy(policy.ShapingPolicy, want.Shaping)
+	diffs = append(diffs, d...)
+	if len(diffs) == 0 {
+		return
+	}
+	spec.Policy = &policy
+	p.config.Vswitch = append(p.config.Vswitch, types.HostVirtualSwitchConfig{
+		ChangeOperation: string(types.HostConfigChangeOperationEdit),
+		Name:            cur.Name,
+		Spec:            &spec,
+	})
+	p.change(types.HostConfigChangeOperationEdit, "vswitch", cur.Name, diffs)
+}
+
+func (p *NetworkPlan) addPortGroup(want PortGroupSpec) {
+	diffs := []string{fmt.Sprintf("vswitch %s", want.Vswitch), fmt.Sprintf("vlan %d", want.VlanId)}
+	var policy types.HostNetworkPolicy
+	var d []string
+	policy.NicTeaming, d = teamingPolicy(nil, want.Teaming, nil)
+	diffs = append(diffs, d...)
+	policy.Security, d = securityPolicy(nil, want.Security)
+	diffs = append(diffs, d...)
+	policy.ShapingPolicy, d = shapingPolicy(nil, want.Shaping)
+	diffs = newValues(append(diffs, d...))
+	p.config.Portgroup = append(p.config.Portgroup, types.HostPortGroupConfig{
+		ChangeOperation: string(types.HostConfigChangeOperationAdd),
+		Spec: &types.HostPortGroupSpec{
+			Name:        want.Name,
+			VlanId:      want.VlanId,
+			VswitchName: want.Vswitch,
+			Policy:      policy,
+		},
+	})
+	p.change(types.HostConfigChangeOperationAdd, "portgroup", want.Name, diffs)
+}
+
+func (p *NetworkPlan) editPortGroup(cur types.HostPortGroup, want PortGroupSpec) {
+	spec := cur.Spec
+	var diffs []string
+	if want.Vswitch != spec.VswitchName {
+		diffs = append(diffs, fmt.Sprintf("vswitch %s -> %s", spec.VswitchName, want.Vswitch))
+		spec.VswitchName = want.Vswitch
+	}
+	if want.VlanId != spec.VlanId {
+		diffs = append(diffs, fmt.Sprintf("vlan %d -> %d", spec.VlanId, want.VlanId))
+		spec.VlanId = want.VlanId
+	}
+	var d []string
+	spec.Policy.NicTeaming, d = teamingPolicy(spec.Policy.NicTeaming, want.Teaming, nil)
+	diffs = append(diffs, d...)
+	spec.Policy.Security, d = securityPolicy(spec.Policy.Security, want.Security)
+	diffs = append(diffs, d...)
+	spec.Policy.ShapingPolicy, d = shapingPolicy(spec.Policy.ShapingPolicy, want.Shaping)
+	diffs = append(diffs, d...)
+	if len(diffs) == 0 {
+		return
+	}
+	p.config.Portgroup = append(p.config.Portgroup, types.HostPortGroupConfig{
+		ChangeOperation: string(types.HostConfigChangeOperationEdit),
+		Spec:            &spec,
+	})
+	p.change(types.HostConfigChangeOperationEdit, "portgroup", spec.Name, diffs)
+}
+
+func (p *NetworkPlan) planVmkernels(info *types.HostNetworkInfo, nicInfo *types.HostVirtualNicManagerInfo, spec HostNetworkSpec, keep map[string]bool) error {
+	// Services each device carries, by nic type
+	services := map[string]map[string]bool{}
+	if nicInfo != nil {
+		for _, nc := range nicInfo.NetConfig {
+			devices := map[string]string{}
+			for _, c := range nc.CandidateVnic {
+				devices[c.Key] = c.Device
+			}
+			services[nc.NicType] = map[string]bool{}
+			for _, key := range nc.SelectedVnic {
+				services[nc.NicType][devices[key]] = true
+			}
+		}
+	}
+	nicTypes := make([]string, 0, len(services))
+	for t := range services {
+		nicTypes = append(nicTypes, t)
+	}
+	sort.Strings(nicTypes)
+
+	matched := map[string]bool{}
+	added := 0
+	for _, want := range spec.Vmkernels {
+		for _, svc := range want.Services {
+			if _, ok := services[svc]; !ok {
+				return fmt.Errorf("plan vmkernel on %s: unknown service %q, the host has %v", want.PortGroup, svc, nicTypes)
+			}
+		}
+		var cur *types.HostVirtualNic
+		for i, vnic := range info.Vnic {
+			if matched[vnic.Device] {
+				continue
+			}
+			if want.Device == vnic.Device || (want.Device == "" && vnic.Portgroup == want.PortGroup) {
+				cur = &info.Vnic[i]
+				break
+			}
+		}
+		if cur == nil {
+			if !want.Dhcp && want.Ip == "" {
+				return fmt.Errorf("plan vmkernel on %s: a new adapter needs dhcp or an ip", want.PortGroup)
+			}
+			name := want.Device
+			if name == "" {
+				name = "(new)"
+			}
+			diffs := []string{"portgroup " + want.PortGroup, ipString(&types.HostIpConfig{Dhcp: want.Dhcp, IpAddress: want.Ip, SubnetMask: want.Netmask})}
+			if want.Mtu != 0 {
+				diffs = append(diffs, fmt.Sprintf("mtu %d", want.Mtu))
+			}
+			for _, svc := range want.Services {
+				p.services = append(p.services, serviceChange{nicType: svc, added: added, enable: true})
+				diffs = append(diffs, "+service "+svc)
+			}
+			p.config.Vnic = append(p.config.Vnic, types.HostVirtualNicConfig{
+				ChangeOperation: string(types.HostConfigChangeOperationAdd),
+				Device:          want.Device,
+				Portgroup:       want.PortGroup,
+				Spec: &types.HostVirtualNicSpec{
+					Ip:  &types.HostIpConfig{Dhcp: want.Dhcp, IpAddress: want.Ip, SubnetMask: want.Netmask},
+					Mtu: want.Mtu,
+				},
+			})
+			added++
+			p.change(types.HostConfigChangeOperationAdd, "vmkernel", name, diffs)
+			continue
+		}
+		matched[cur.Device] = true
+
+		vspec := cur.Spec
+		var diffs []string
+		if cur.Portgroup != want.PortGroup {
+			diffs = append(diffs, fmt.Sprintf("portgroup %s -> %s", cur.Portgroup, want.PortGroup))
+			vspec.Portgroup = want.PortGroup
+		}
+		if want.Dhcp || want.Ip != "" {
+			ip := &types.HostIpConfig{Dhcp: want.Dhcp, IpAddress: want.Ip, SubnetMask: want.Netmask}
+			if vspec.Ip == nil || vspec.Ip.Dhcp != ip.Dhcp || (!ip.Dhcp && (vspec.Ip.IpAddress != ip.IpAddress || vspec.Ip.SubnetMask != ip.SubnetMask)) {
+				diffs = append(diffs, fmt.Sprintf("%s -> %s", ipString(vspec.Ip), ipString(ip)))
+				if vspec.Ip != nil {
+					ip.IpV6Config = vspec.Ip.IpV6Config
+				}
+				vspec.Ip = ip
+			}
+		}
+		if want.Mtu != 0 && want.Mtu != vspec.Mtu {
+			diffs = append(diffs, fmt.Sprintf("mtu %d -> %d", vspec.Mtu, want.Mtu))
+			vspec.Mtu = want.Mtu
+		}
+		if len(diffs) > 0 {
+			p.config.Vnic = append(p.config.Vnic, types.HostVirtualNicConfig{
+				ChangeOperation: string(types.HostConfigChangeOperationEdit),
+				Device:          cur.Device,
+				Portgroup:       cur.Portgroup,
+				Spec:            &vspec,
+			})
+		}
+		if want.Services != nil {
+			enabled := map[string]bool{}
+			for _, svc := range want.Services {
+				enabled[svc] = true
+			}
+			for _, t := range nicTypes {
+				if enabled[t] == services[t][cur.Device] {
+					continue
+				}
+				p.services = append(p.services, serviceChange{nicType: t, device: cur.Device, enable: enabled[t]})
+				if enabled[t] {
+					diffs = append(diffs, "+service "+t)
+				} else {
+					diffs = append(diffs, "-service "+t)
+				}
+			}
+		}
+		if len(diffs) > 0 {
+			p.change(types.HostConfigChangeOperationEdit, "vmkernel", cur.Device, diffs)
+		}
+	}
+
+	// Turn services on before turning any off, so moving management to
+	// another adapter never leaves the host without it
+	sort.SliceStable(p.services, func(i, j int) bool {
+		return p.services[i].enable && !p.services[j].enable
+	})
+
+	if spec.Prune {
+		for _, vnic := range info.Vnic {
+			if matched[vnic.Device] || keep[vnic.Device] {
+				continue
+			}
+			p.config.Vnic = append(p.config.Vnic, types.HostVirtualNicConfig{
+				ChangeOperation: string(types.HostConfigChangeOperationRemove),
+				Device:          vnic.Device,
+				Portgroup:       vnic.Portgroup,
+			})
+			p.change(types.HostConfigChangeOperationRemove, "vmkernel", vnic.Device, nil)
+		}
+	}
+	return nil
+}
+
+// keptNetwork returns the names of vmk0, its port group and its vSwitch,
+// which pruning leaves alone.
+func keptNetwork(info *types.HostNetworkInfo) map[string]bool {
+	keep := map[string]bool{}
+	for _, vnic := range info.Vnic {
+		if vnic.Device != "vmk0" {
+			continue
+		}
+		keep[vnic.Device], keep[vnic.Portgroup] = true, true
+		for _, pg := range info.Portgroup {
+			if pg.Spec.Name == vnic.Portgroup {
+				keep[pg.Spec.VswitchName] = true
+			}
+		}
+	}
+	return keep
+}
+
+// teamingPolicy applies want to a copy of cur, returning the new policy
+// and what changed. uplinks are the vSwitch's, which always gets a load
+// balancing policy; nil for port groups. The failover order must already
+// have passed checkFailoverOrder.
+func teamingPolicy(cur *types.HostNicTeamingPolicy, want *TeamingSpec, uplinks []string) (*types.HostNicTeamingPolicy, []string) {
+	if want == nil {
+		return cur, nil
+	}
+	var t types.HostNicTeamingPolicy
+	if cur != nil {
+		t = *cur
+	}
+	var diffs []string
+	if want.Policy != "" && t.Policy != string(want.Policy) {
+		diffs = append(diffs, fmt.Sprintf("teaming %s -> %s", orInherit(t.Policy), want.Policy))
+		t.Policy = string(want.Policy)
+	}
+	if uplinks != nil && t.Policy == "" {
+		t.Policy = string(TeamingSrcPortId)
+	}
+	if want.Active != nil || want.Standby != nil {
+		var curActive, curStandby []string
+		if t.NicOrder != nil {
+			curActive, curStandby = t.NicOrder.ActiveNic, t.NicOrder.StandbyNic
+		}
+		if !reflect.DeepEqual(nonNil(curActive), nonNil(want.Active)) || !reflect.DeepEqual(nonNil(curStandby), nonNil(want.Standby)) {
+			diffs = append(diffs, fmt.Sprintf("failover order %v/%v -> %v/%v", curActive, curStandby, want.Active, want.Standby))
+			t.NicOrder = &types.HostNicOrderPolicy{ActiveNic: want.Active, StandbyNic: want.Standby}
+		}
+	}
+	if d, ok := boolDiff("notify switches", t.NotifySwitches, want.NotifySwitches); ok {
+		diffs = append(diffs, d)
+		t.NotifySwitches = want.NotifySwitches
+	}
+	// Failback is the inverse of the API's rolling order
+	if want.Failback != nil {
+		rolling := !*want.Failback
+		if d, ok := boolDiff("rolling order", t.RollingOrder, &rolling); ok {
+			diffs = append(diffs, d)
+			t.RollingOrder = &rolling
+		}
+	}
+	if len(diffs) == 0 {
+		return cur, nil
+	}
+	return &t, diffs
+}
+
+// checkFailoverOrder checks that each NIC of want's failover order is
+// listed once and, unless uplinks is nil, is one of them.
+func checkFailoverOrder(want *TeamingSpec, uplinks []string) error {
+	if want == nil {
+		return nil
+	}
+	bound := map[string]bool{}
+	for _, nic := range uplinks {
+		bound[nic] = true
+	}
+	seen := map[string]bool{}
+	for _, nic := range append(append([]string{}, want.Active...), want.Standby...) {
+		if seen[nic] {
+			return fmt.Errorf("uplink %s is in the failover order twice", nic)
+		}
+		seen[nic] = true
+		if uplinks != nil && !bound[nic] {
+			return fmt.Errorf("failover order names %s, which isn't among the uplinks %v", nic, uplinks)
+		}
+	}
+	return nil
+}
+
+// defaultActive makes all of uplinks active when want has no failover
+// order, reporting whether it did.
+func defaultActive(want *TeamingSpec, uplinks []string) (*TeamingSpec, bool) {
+	if want != nil && (want.Active != nil || want.Standby != nil) {
+		return want, false
+	}
+	t := TeamingSpec{}
+	if want != nil {
+		t = *want
+	}
+	t.Active = uplinks
+	return &t, true
+}
+
+// markDefaultActive notes in the failover order diff of d that the spec
+// didn't give one.
+func markDefaultActive(d []string) []string {
+	for i := range d {
+		if strings.HasPrefix(d[i], "failover order ") {
+			d[i] += " (all uplinks active by default)"
+		}
+	}
+	return d
+}
+
+// securityPolicy applies want to a copy of cur, returning the new policy
+// and what changed.
+func securityPolicy(cur *types.HostNetworkSecurityPolicy, want *SecuritySpec) (*types.HostNetworkSecurityPolicy, []string) {
+	if want == nil {
+		return cur, nil
+	}
+	var sec types.HostNetworkSecurityPolicy
+	if cur != nil {
+		sec = *cur
+	}
+	var diffs []string
+	for _, f := range []struct {
+		name string
+		cur  **bool
+		want *bool
+	}{
+		{"promiscuous", &sec.AllowPromiscuous, want.AllowPromiscuous},
+		{"mac changes", &sec.MacChanges, want.MacChanges},
+		{"forged transmits", &sec.ForgedTransmits, want.ForgedTransmits},
+	} {
+		if d, ok := boolDiff(f.name, *f.cur, f.want); ok {
+			diffs = append(diffs, d)
+			*f.cur = f.want
+		}
+	}
+	if len(diffs) == 0 {
+		return cur, nil
+	}
+	return &sec, diffs
+}
+
+// shapingPolicy applies want to a copy of cur, returning the new policy
+// and what changed. The API counts bits/s and bytes.
+func shapingPolicy(cur *types.HostNetworkTrafficShapingPolicy, want *ShapingSpec) (*types.HostNetworkTrafficShapingPolicy, []string) {
+	if want == nil {
+		return cur, nil
+	}
+	var sh types.HostNetworkTrafficShapingPolicy
+	if cur != nil {
+		sh = *cur
+	}
+	var diffs []string
+	if d, ok := boolDiff("shaping", sh.Enabled, want.Enabled); ok {
+		diffs = append(diffs, d)
+		sh.Enabled = want.Enabled
+	}
+	for _, f := range []struct {
+		name string
+		cur  *int64
+		want int64
+	}{
+		{"average bit/s", &sh.AverageBandwidth, want.AverageKbps * 1000},
+		{"peak bit/s", &sh.PeakBandwidth, want.PeakKbps * 1000},
+		{"burst bytes", &sh.BurstSize, want.BurstKB * 1024},
+	} {
+		if f.want != 0 && f.want != *f.cur {
+			diffs = append(diffs, fmt.Sprintf("%s %d -> %d", f.name, *f.cur, f.want))
+			*f.cur = f.want
+		}
+	}
+	if len(diffs) == 0 {
+		return cur, nil
+	}
+	return &sh, diffs
+}
+
+// checkShaping checks the rates of want. A new policy has no rates to
+// keep, so turning shaping on in one needs all three.
+func checkShaping(want *ShapingSpec, isNew bool) error {
+	if want == nil {
+		return nil
+	}
+	if want.AverageKbps < 0 || want.PeakKbps < 0 || want.BurstKB < 0 {
+		return errors.New("shaping rates can't be negative")
+	}
+	if want.AverageKbps != 0 && want.PeakKbps != 0 && want.PeakKbps < want.AverageKbps {
+		return fmt.Errorf("shaping peak %d kbit/s is below the average %d kbit/s", want.PeakKbps, want.AverageKbps)
+	}
+	if isNew && want.Enabled != nil && *want.Enabled && (want.AverageKbps == 0 || want.PeakKbps == 0 || want.BurstKB == 0) {
+		return errors.New("shaping needs an average, peak and burst")
+	}
+	return nil
+}
+
+// boolDiff describes the change from cur to want, if want is set and
+// differs.
+func boolDiff(name string, cur, want *bool) (string, bool) {
+	if want == nil || (cur != nil && *cur == *want) {
+		return "", false
+	}
+	from := "inherit"
+	if cur != nil {
+		from = fmt.Sprint(*cur)
+	}
+	return fmt.Sprintf("%s %s -> %t", name, from, *want), true
+}
+
+// newValues drops the old values from the diffs of a new object, which
+// has nothing to change from: "mtu 0 -> 9000" becomes "mtu 9000".
+func newValues(diffs []string) []string {
+	for i, d := range diffs {
+		if from, to, ok := strings.Cut(d, " -> "); ok {
+			if sp := strings.LastIndex(from, " "); sp >= 0 {
+				diffs[i] = from[:sp] + " " + to
+			}
+		}
+	}
+	return diffs
+}
+
+func vswitchUplinks(vs types.HostVirtualSwitch) []string {
+	if b, ok := vs.Spec.Bridge.(*types.HostVirtualSwitchBondBridge); ok {
+		return b.NicDevice
+	}
+	return nil
+}
+
+func ipString(ip *types.HostIpConfig) string {
+	switch {
+	case ip == nil:
+		return "no ip"
+	case ip.Dhcp:
+		return "dhcp"
+	}
+	return ip.IpAddress + "/" + ip.SubnetMask
+}
+
+func orInherit(s string) string {
+	if s == "" {
+		return "inherit"
+	}
+	return s
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, v := range a {
+		set[v] = true
+	}
+	for _, v := range b {
+		if !set[v] {
+			return false
+		}
+	}
+	return true
+}
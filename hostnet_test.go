@@ -0,0 +1,397 @@
+package gesxi
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// testHostNetwork is a host with vmk0 for management on vSwitch0, and a
+// second vSwitch with a port group and adapter pruning can remove.
+func testHostNetwork() (*types.HostNetworkInfo, *types.HostVirtualNicManagerInfo) {
+	info := &types.HostNetworkInfo{
+		Vswitch: []types.HostVirtualSwitch{
+			{
+				Name:     "vSwitch0",
+				NumPorts: 128,
+				Mtu:      1500,
+				Spec: types.HostVirtualSwitchSpec{
+					NumPorts: 128,
+					Mtu:      1500,
+					Bridge: &types.HostVirtualSwitchBondBridge{
+						NicDevice: []string{"vmnic0"},
+						Beacon:    &types.HostVirtualSwitchBeaconConfig{Interval: 1},
+						LinkDiscoveryProtocolConfig: &types.LinkDiscoveryProtocolConfig{
+							Protocol:  "cdp",
+							Operation: "listen",
+						},
+					},
+					Policy: &types.HostNetworkPolicy{
+						NicTeaming: &types.HostNicTeamingPolicy{
+							Policy:   string(TeamingSrcPortId),
+							NicOrder: &types.HostNicOrderPolicy{ActiveNic: []string{"vmnic0"}},
+						},
+					},
+				},
+			},
+			{
+				Name:     "vSwitch1",
+				NumPorts: 128,
+				Mtu:      1500,
+				Spec: types.HostVirtualSwitchSpec{
+					NumPorts: 128,
+					Mtu:      1500,
+					Bridge:   &types.HostVirtualSwitchBondBridge{NicDevice: []string{"vmnic1"}},
+				},
+			},
+		},
+		Portgroup: []types.HostPortGroup{
+			{Spec: types.HostPortGroupSpec{Name: "Management Network", VswitchName: "vSwitch0"}},
+			{Spec: types.HostPortGroupSpec{Name: "VM Network", VswitchName: "vSwitch0"}},
+			{Spec: types.HostPortGroupSpec{Name: "old", VswitchName: "vSwitch1", VlanId: 5}},
+		},
+		Vnic: []types.HostVirtualNic{
+			{
+				Device:    "vmk0",
+				Portgroup: "Management Network",
+				Spec: types.HostVirtualNicSpec{
+					Ip:  &types.HostIpConfig{IpAddress: "10.0.0.10", SubnetMask: "255.255.255.0"},
+					Mtu: 1500,
+				},
+			},
+			{
+				Device:    "vmk1",
+				Portgroup: "old",
+				Spec: types.HostVirtualNicSpec{
+					Ip:  &types.HostIpConfig{IpAddress: "10.0.5.10", SubnetMask: "255.255.255.0"},
+					Mtu: 1500,
+				},
+			},
+		},
+	}
+	nicInfo := &types.HostVirtualNicManagerInfo{}
+	for _, t := range []string{"management", "vmotion"} {
+		nc := types.VirtualNicManagerNetConfig{NicType: t}
+		for _, vnic := range info.Vnic {
+			nc.CandidateVnic = append(nc.CandidateVnic, types.HostVirtualNic{Key: t + "." + vnic.Device, Device: vnic.Device})
+		}
+		if t == "management" {
+			nc.SelectedVnic = []string{"management.vmk0"}
+		}
+		nicInfo.NetConfig = append(nicInfo.NetConfig, nc)
+	}
+	return info, nicInfo
+}
+
+// applyTestPlan makes the changes of p on info and nicInfo the way the
+// host would.
+func applyTestPlan(p *NetworkPlan, info *types.HostNetworkInfo, nicInfo *types.HostVirtualNicManagerInfo) {
+	for _, c := range p.config.Vswitch {
+		i := indexOf(len(info.Vswitch), func(i int) bool { return info.Vswitch[i].Name == c.Name })
+		switch types.HostConfigChangeOperation(c.ChangeOperation) {
+		case types.HostConfigChangeOperationAdd:
+			info.Vswitch = append(info.Vswitch, types.HostVirtualSwitch{Name: c.Name})
+			i = len(info.Vswitch) - 1
+			fallthrough
+		case types.HostConfigChangeOperationEdit:
+			vs := &info.Vswitch[i]
+			vs.Spec, vs.NumPorts, vs.Mtu = *c.Spec, c.Spec.NumPorts, c.Spec.Mtu
+		case types.HostConfigChangeOperationRemove:
+			info.Vswitch = append(info.Vswitch[:i], info.Vswitch[i+1:]...)
+		}
+	}
+	for _, c := range p.config.Portgroup {
+		i := indexOf(len(info.Portgroup), func(i int) bool { return info.Portgroup[i].Spec.Name == c.Spec.Name })
+		switch types.HostConfigChangeOperation(c.ChangeOperation) {
+		case types.HostConfigChangeOperationAdd:
+			info.Portgroup = append(info.Portgroup, types.HostPortGroup{Spec: *c.Spec})
+		case types.HostConfigChangeOperationEdit:
+			info.Portgroup[i].Spec = *c.Spec
+		case types.HostConfigChangeOperationRemove:
+			info.Portgroup = append(info.Portgroup[:i], info.Portgroup[i+1:]...)
+		}
+	}
+	var added []string
+	for _, c := range p.config.Vnic {
+		i := indexOf(len(info.Vnic), func(i int) bool { return info.Vnic[i].Device == c.Device })
+		switch types.HostConfigChangeOperation(c.ChangeOperation) {
+		case types.HostConfigChangeOperationAdd:
+			device := c.Device
+			if device == "" {
+				device = fmt.Sprintf("vmk%d", len(info.Vnic))
+			}
+			info.Vnic = append(info.Vnic, types.HostVirtualNic{Device: device, Portgroup: c.Portgroup, Spec: *c.Spec})
+			for j := range nicInfo.NetConfig {
+				nc := &nicInfo.NetConfig[j]
+				nc.CandidateVnic = append(nc.CandidateVnic, types.HostVirtualNic{Key: nc.NicType + "." + device, Device: device})
+			}
+			added = append(added, device)
+		case types.HostConfigChangeOperationEdit:
+			vnic := &info.Vnic[i]
+			vnic.Spec = *c.Spec
+			if c.Spec.Portgroup != "" {
+				vnic.Portgroup = c.Spec.Portgroup
+			}
+		case types.HostConfigChangeOperationRemove:
+			info.Vnic = append(info.Vnic[:i], info.Vnic[i+1:]...)
+		}
+	}
+	for _, sc := range p.services {
+		device := sc.device
+		if device == "" {
+			device = added[sc.added]
+		}
+		for j := range nicInfo.NetConfig {
+			nc := &nicInfo.NetConfig[j]
+			if nc.NicType != sc.nicType {
+				continue
+			}
+			key := nc.NicType + "." + device
+			k := indexOf(len(nc.SelectedVnic), func(k int) bool { return nc.SelectedVnic[k] == key })
+			if sc.enable && k < 0 {
+				nc.SelectedVnic = append(nc.SelectedVnic, key)
+			} else if !sc.enable && k >= 0 {
+				nc.SelectedVnic = append(nc.SelectedVnic[:k], nc.SelectedVnic[k+1:]...)
+			}
+		}
+	}
+}
+
+func indexOf(n int, match func(i int) bool) int {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPlanHostNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		spec HostNetworkSpec
+		want []string
+	}{
+		{
+			name: "keep",
+			spec: HostNetworkSpec{
+				Vswitches:  []VswitchSpec{{Name: "vSwitch0", Uplinks: []string{"vmnic0"}, Mtu: 1500}},
+				PortGroups: []PortGroupSpec{{Name: "VM Network", Vswitch: "vSwitch0"}},
+				Vmkernels:  []VmkernelSpec{{Device: "vmk0", PortGroup: "Management Network", Services: []string{"management"}}},
+			},
+		},
+		{
+			name: "add",
+			spec: HostNetworkSpec{
+				Vswitches:  []VswitchSpec{{Name: "vSwitch2", Uplinks: []string{"vmnic2"}, Mtu: 9000}},
+				PortGroups: []PortGroupSpec{{Name: "vMotion", Vswitch: "vSwitch2", VlanId: 20}},
+				Vmkernels: []VmkernelSpec{{
+					PortGroup: "vMotion",
+					Ip:        "10.0.20.10",
+					Netmask:   "255.255.255.0",
+					Mtu:       9000,
+					Services:  []string{"vmotion"},
+				}},
+			},
+			want: []string{
+				"+ vswitch vSwitch2: ports 1024, mtu 9000, uplinks [vmnic2], failover order [vmnic2]/[] (all uplinks active by default)",
+				"+ portgroup vMotion: vswitch vSwitch2, vlan 20",
+				"+ vmkernel (new): portgroup vMotion, 10.0.20.10/255.255.255.0, mtu 9000, +service vmotion",
+			},
+		},
+		{
+			name: "edit",
+			spec: HostNetworkSpec{
+				Vswitches:  []VswitchSpec{{Name: "vSwitch0", Uplinks: []string{"vmnic0", "vmnic3"}, Mtu: 9000}},
+				PortGroups: []PortGroupSpec{{Name: "VM Network", Vswitch: "vSwitch0", VlanId: 10}},
+				Vmkernels:  []VmkernelSpec{{Device: "vmk0", PortGroup: "Management Network", Services: []string{"management", "vmotion"}}},
+			},
+			want: []string{
+				"~ vswitch vSwitch0: mtu 1500 -> 9000, uplinks [vmnic0] -> [vmnic0 vmnic3], failover order [vmnic0]/[] -> [vmnic0 vmnic3]/[] (all uplinks active by default)",
+				"~ portgroup VM Network: vlan 0 -> 10",
+				"~ vmkernel vmk0: +service vmotion",
+			},
+		},
+		{
+			name: "failover order",
+			spec: HostNetworkSpec{
+				Vswitches: []VswitchSpec{{
+					Name:    "vSwitch0",
+					Uplinks: []string{"vmnic0", "vmnic3"},
+					Teaming: &TeamingSpec{Active: []string{"vmnic3"}, Standby: []string{"vmnic0"}},
+				}},
+			},
+			want: []string{
+				"~ vswitch vSwitch0: uplinks [vmnic0] -> [vmnic0 vmnic3], failover order [vmnic0]/[] -> [vmnic3]/[vmnic0]",
+			},
+		},
+		{
+			name: "prune",
+			spec: HostNetworkSpec{
+				Vswitches: []VswitchSpec{{Name: "vSwitch0"}},
+				Prune:     true,
+			},
+			want: []string{
+				"- vmkernel vmk1",
+				"- portgroup VM Network",
+				"- portgroup old",
+				"- vswitch vSwitch1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, nicInfo := testHostNetwork()
+			p, err := planHostNetwork("esx01", info, nicInfo, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range p.Changes {
+				got = append(got, c.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("plan:\n%#v\nwant:\n%#v", got, tt.want)
+			}
+
+			applyTestPlan(p, info, nicInfo)
+			again, err := planHostNetwork("esx01", info, nicInfo, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !again.Empty() {
+				t.Fatalf("plan after applying isn't empty:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestPlanHostNetworkKeepsBridge(t *testing.T) {
+	info, nicInfo := testHostNetwork()
+	spec := HostNetworkSpec{Vswitches: []VswitchSpec{{Name: "vSwitch0", Uplinks: []string{"vmnic0", "vmnic3"}}}}
+	p, err := planHostNetwork("esx01", info, nicInfo, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.config.Vswitch) != 1 {
+		t.Fatalf("got %d vswitch changes, want 1", len(p.config.Vswitch))
+	}
+	bridge, ok := p.config.Vswitch[0].Spec.Bridge.(*types.HostVirtualSwitchBondBridge)
+	if !ok {
+		t.Fatalf("bridge is %T", p.config.Vswitch[0].Spec.Bridge)
+	}
+	if !reflect.DeepEqual(bridge.NicDevice, []string{"vmnic0", "vmnic3"}) {
+		t.Errorf("uplinks %v", bridge.NicDevice)
+	}
+	if bridge.Beacon == nil || bridge.LinkDiscoveryProtocolConfig == nil || bridge.LinkDiscoveryProtocolConfig.Protocol != "cdp" {
+		t.Errorf("beacon or link discovery dropped: %+v", bridge)
+	}
+	// The host's own config is left alone
+	if cur := info.Vswitch[0].Spec.Bridge.(*types.HostVirtualSwitchBondBridge); len(cur.NicDevice) != 1 {
+		t.Errorf("current bridge changed to %v", cur.NicDevice)
+	}
+}
+
+func TestPlanHostNetworkFailoverOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		spec HostNetworkSpec
+	}{
+		{
+			name: "not an uplink",
+			spec: HostNetworkSpec{Vswitches: []VswitchSpec{{
+				Name:    "vSwitch0",
+				Teaming: &TeamingSpec{Active: []string{"vmnic0"}, Standby: []string{"vmnic1"}},
+			}}},
+		},
+		{
+			name: "not a new uplink",
+			spec: HostNetworkSpec{Vswitches: []VswitchSpec{{
+				Name:    "vSwitch1",
+				Uplinks: []string{"vmnic2"},
+				Teaming: &TeamingSpec{Active: []string{"vmnic1"}},
+			}}},
+		},
+		{
+			name: "active and standby",
+			spec: HostNetworkSpec{Vswitches: []VswitchSpec{{
+				Name:    "vSwitch0",
+				Uplinks: []string{"vmnic0", "vmnic3"},
+				Teaming: &TeamingSpec{Active: []string{"vmnic0", "vmnic3"}, Standby: []string{"vmnic3"}},
+			}}},
+		},
+		{
+			name: "port group",
+			spec: HostNetworkSpec{PortGroups: []PortGroupSpec{{
+				Name:    "VM Network",
+				Vswitch: "vSwitch0",
+				Teaming: &TeamingSpec{Active: []string{"vmnic1"}},
+			}}},
+		},
+		{
+			name: "port group on new vswitch",
+			spec: HostNetworkSpec{
+				Vswitches:  []VswitchSpec{{Name: "vSwitch2", Uplinks: []string{"vmnic2"}}},
+				PortGroups: []PortGroupSpec{{Name: "vMotion", Vswitch: "vSwitch2", Teaming: &TeamingSpec{Standby: []string{"vmnic0"}}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, nicInfo := testHostNetwork()
+			if _, err := planHostNetwork("esx01", info, nicInfo, tt.spec); err == nil {
+				t.Fatal("planned a failover order the vswitch can't have")
+			}
+		})
+	}
+}
+
+func TestParseHostNetworkSpecFailoverOrder(t *testing.T) {
+	for _, data := range []string{
+		"vswitches: [{name: vSwitch1, uplinks: [vmnic1, vmnic2], teaming: {active: [vmnic1], standby: [vmnic1]}}]",
+		"vswitches: [{name: vSwitch1, uplinks: [vmnic1], teaming: {active: [vmnic2]}}]",
+		"portGroups: [{name: pg, vswitch: vSwitch1, teaming: {active: [vmnic1, vmnic1]}}]",
+	} {
+		if _, err := ParseHostNetworkSpec([]byte(data)); err == nil {
+			t.Errorf("parsed %s", data)
+		}
+	}
+	data := "vswitches: [{name: vSwitch1, uplinks: [vmnic1, vmnic2], teaming: {active: [vmnic2], standby: [vmnic1]}}]"
+	if _, err := ParseHostNetworkSpec([]byte(data)); err != nil {
+		t.Errorf("%s: %v", data, err)
+	}
+}
+
+func TestParseHostNetworkSpecShaping(t *testing.T) {
+	for _, data := range []string{
+		"vswitches: [{name: vSwitch1, shaping: {averageKbps: -1}}]",
+		"portGroups: [{name: pg, vswitch: vSwitch1, shaping: {averageKbps: 2000, peakKbps: 1000}}]",
+	} {
+		if _, err := ParseHostNetworkSpec([]byte(data)); err == nil {
+			t.Errorf("parsed %s", data)
+		}
+	}
+	// Rates left out keep the host's
+	data := "portGroups: [{name: pg, vswitch: vSwitch1, shaping: {enabled: true, peakKbps: 1000}}]"
+	if _, err := ParseHostNetworkSpec([]byte(data)); err != nil {
+		t.Errorf("%s: %v", data, err)
+	}
+}
+
+func TestParseHostNetworkSpecVmkernelName(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"vmkernels: [{device: vmk1}]", "vmkernel vmk1 needs a port group"},
+		{"vmkernels: [{device: vmk1, portGroup: pg}, {dhcp: true}]", "vmkernel #2 needs a port group"},
+	}
+	for _, tt := range tests {
+		_, err := ParseHostNetworkSpec([]byte(tt.data))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.data, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VmSummaryProps are the property paths ListVms retrieves by default, all
+// that's needed to fill in a VmSummary.
+var VmSummaryProps = []string{
+	"name",
+	"config.uuid",
+	"config.guestFullName",
+	"config.annotation",
+	"config.hardware.numCPU",
+	"config.hardware.memoryMB",
+	"config.hardware.device",
+	"config.datastoreUrl",
+	"config.files.vmPathName",
+	"runtime.powerState",
+	"runtime.host",
+	"guest.ipAddress",
+	"guest.net",
+}
+
+// VmSummary is a compact view of a VM for inventory listings
+type VmSummary struct {
+	Ref        types.ManagedObjectReference   `json:"ref"`
+	Name       string                         `json:"name"`
+	Uuid       string                         `json:"uuid,omitempty"`
+	PowerState types.VirtualMachinePowerState `json:"powerState,omitempty"`
+	GuestOS    string                         `json:"guestOs,omitempty"`
+	Annotation string                         `json:"annotation,omitempty"`
+	// Guest addresses reported by VMware Tools
+	IPs      []string   `json:"ips,omitempty"`
+	NumCpus  int32      `json:"numCpus,omitempty"`
+	MemoryMB int32      `json:"memoryMB,omitempty"`
+	Disks    []VmDevice `json:"disks,omitempty"`
+	Nics     []VmDevice `json:"nics,omitempty"`
+	// Names of the datastores holding the VM's files
+	Datastores []string `json:"datastores,omitempty"`
+	// Name of the host the VM is registered on
+	Host string `json:"host,omitempty"`
+}
+
+// VmQuery selects the VMs ListVms returns; zero fields match every VM.
+type VmQuery struct {
+	// Glob matched against the VM name, in path.Match syntax, e.g. "web-*"
+	Name       string
+	PowerState types.VirtualMachinePowerState
+	// Case-insensitive substring of the VM's notes
+	Annotation string
+	// Name or id of a vSphere tag the VM must carry. vCenter only
+	Tag string
+	// Property paths to retrieve instead of VmSummaryProps. Summary fields
+	// whose properties aren't retrieved are left empty; the properties the
+	// filters need are always added
+	Props []string
+}
+
+// ListVms returns a summary of each VM matching q. Only q.Props (or
+// VmSummaryProps) are retrieved, which is much cheaper than GetVms on
+// hosts with many VMs.
+func (s *EsxiService) ListVms(ctx context.Context, q VmQuery) ([]VmSummary, error) {
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return nil, fmt.Errorf("list vms: name %q: %w", q.Name, err)
+		}
+	}
+	props := q.Props
+	if len(props) == 0 {
+		props = VmSummaryProps
+	}
+	props = withProps(props, "name")
+	if q.PowerState != "" {
+		props = withProps(props, "runtime.powerState")
+	}
+	if q.Annotation != "" {
+		props = withProps(props, "config.annotation")
+	}
+	var tagged map[string]bool
+	if q.Tag != "" {
+		var err error
+		if tagged, err = s.taggedObjects(ctx, q.Tag); err != nil {
+			return nil, fmt.Errorf("list vms: tag %s: %w", q.Tag, err)
+		}
+	}
+
+	v, err := s.getView(ctx, "VirtualMachine")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var vms []mo.VirtualMachine
+	if err = v.Retrieve(ctx, []string{"VirtualMachine"}, props, &vms); err != nil {
+		return nil, err
+	}
+	var netNames, hostNames map[string]string
+	if hasProp(props, "config.hardware.device") {
+		if netNames, err = s.networkNames(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if hasProp(props, "runtime.host") {
+		if hostNames, err = s.hostNames(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]VmSummary, 0, len(vms))
+	for _, vm := range vms {
+		sum := vmSummary(vm, netNames, hostNames)
+		if q.Name != "" {
+			if ok, _ := path.Match(q.Name, sum.Name); !ok {
+				continue
+			}
+		}
+		if q.PowerState != "" && sum.PowerState != q.PowerState {
+			continue
+		}
+		if q.Annotation != "" && !strings.Contains(strings.ToLower(sum.Annotation), strings.ToLower(q.Annotation)) {
+			continue
+		}
+		if tagged != nil && !tagged[vm.Self.Value] {
+			continue
+		}
+		list = append(list, sum)
+	}
+	return list, nil
+}
+
+func vmSummary(vm mo.VirtualMachine, netNames, hostNames map[string]string) VmSummary {
+	sum := VmSummary{
+		Ref:        vm.Self,
+		Name:       vm.Name,
+		PowerState: vm.Runtime.PowerState,
+	}
+	if vm.Runtime.Host != nil {
+		sum.Host = hostNames[vm.Runtime.Host.Value]
+	}
+	if c := vm.Config; c != nil {
+		sum.Uuid = c.Uuid
+		sum.GuestOS = c.GuestFullName
+		sum.Annotation = c.Annotation
+		sum.NumCpus = c.Hardware.NumCPU
+		sum.MemoryMB = c.Hardware.MemoryMB
+		devices := object.VirtualDeviceList(c.Hardware.Device)
+		for i, d := range vmDevices(devices, netNames) {
+			switch devices[i].(type) {
+			case *types.VirtualDisk:
+				sum.Disks = append(sum.Disks, d)
+			case types.BaseVirtualEthernetCard:
+				sum.Nics = append(sum.Nics, d)
+			}
+		}
+		for _, ds := range c.DatastoreUrl {
+			sum.Datastores = append(sum.Datastores, ds.Name)
+		}
+		if len(sum.Datastores) == 0 && c.Files.VmPathName != "" {
+			var dsPath object.DatastorePath
+			if dsPath.FromString(c.Files.VmPathName) {
+				sum.Datastores = []string{dsPath.Datastore}
+			}
+		}
+	}
+	if g := vm.Guest; g != nil {
+		for _, n := range g.Net {
+			sum.IPs = append(sum.IPs, n.IpAddress...)
+		}
+		if len(sum.IPs) == 0 && g.IpAddress != "" {
+			sum.IPs = []string{g.IpAddress}
+		}
+	}
+	return sum
+}
+
+// hostNames maps host moref values to host names.
+func (s *EsxiService) hostNames(ctx context.Context) (map[string]string, error) {
+	v, err := s.getView(ctx, "HostSystem")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var hosts []mo.HostSystem
+	if err = v.Retrieve(ctx, []string{"HostSystem"}, []string{"name"}, &hosts); err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, h := range hosts {
+		names[h.Self.Value] = h.Name
+	}
+	return names, nil
+}
+
+// taggedObjects returns the moref values of the objects carrying tag,
+// through the vCenter REST API session the service shares across calls.
+func (s *EsxiService) taggedObjects(ctx context.Context, tag string) (map[string]bool, error) {
+	if s.EsxiClient.ServiceContent.About.ApiType != "VirtualCenter" {
+		return nil, fmt.Errorf("tags need vCenter")
+	}
+	var refs []mo.Reference
+	err := s.EsxiClient.withVapi(ctx, func(rc *rest.Client) error {
+		var err error
+		refs, err = tags.NewManager(rc).ListAttachedObjects(ctx, tag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects := map[string]bool{}
+	for _, ref := range refs {
+		objects[ref.Reference().Value] = true
+	}
+	return objects, nil
+}
+
+// withProps adds the paths missing from props, leaving the caller's slice
+// alone.
+func withProps(props []string, paths ...string) []string {
+	for _, p := range paths {
+		if !hasProp(props, p) {
+			props = append(props[:len(props):len(props)], p)
+		}
+	}
+	return props
+}
+
+// hasProp reports whether retrieving props fetches p, either itself or as
+// part of a parent path.
+func hasProp(props []string, p string) bool {
+	for _, prop := range props {
+		if prop == p || strings.HasPrefix(p, prop+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package gesxi
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestHasProp(t *testing.T) {
+	props := []string{"name", "config.hardware", "runtime.powerState"}
+	tests := []struct {
+		p    string
+		want bool
+	}{
+		{"name", true},
+		{"config.hardware", true},
+		{"config.hardware.device", true},
+		{"config", false},
+		{"config.hardwareVersion", false},
+		{"runtime.powerState", true},
+		{"runtime.host", false},
+		{"nam", false},
+	}
+	for _, tt := range tests {
+		if got := hasProp(props, tt.p); got != tt.want {
+			t.Errorf("hasProp(%s) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestWithProps(t *testing.T) {
+	tests := []struct {
+		name  string
+		props []string
+		paths []string
+		want  []string
+	}{
+		{"adds missing", []string{"name"}, []string{"runtime.powerState"}, []string{"name", "runtime.powerState"}},
+		{"keeps present", []string{"name", "config"}, []string{"name", "config.annotation"}, []string{"name", "config"}},
+		{"adds each once", nil, []string{"name", "name"}, []string{"name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withProps(tt.props, tt.paths...); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Spare capacity in the caller's slice must not be written to, or
+	// two ListVms calls sharing a slice would see each other's paths
+	backing := make([]string, 1, 4)
+	backing[0] = "name"
+	a := withProps(backing, "runtime.powerState")
+	b := withProps(backing, "config.annotation")
+	if a[1] != "runtime.powerState" || b[1] != "config.annotation" {
+		t.Fatalf("results share the caller's array: %v %v", a, b)
+	}
+	if got := backing[:cap(backing)][1]; got != "" {
+		t.Fatalf("caller's array was written: %q", got)
+	}
+	// VmSummaryProps itself is what ListVms extends by default
+	before := append([]string(nil), VmSummaryProps...)
+	withProps(VmSummaryProps, "summary.quickStats")
+	if !reflect.DeepEqual(VmSummaryProps, before) {
+		t.Fatal("VmSummaryProps was modified")
+	}
+}
+
+func TestListVmsFilters(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.VPX())
+	all, err := esx.ListVms(ctx, VmQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no vms")
+	}
+	// Tag one VM with notes and power another off
+	noted := testVm(t, esx, "DC0_H0_VM1")
+	notes := "Web tier, owned by ops"
+	if err = esx.ReconfigureVm(ctx, noted, ReconfigureVmParams{Annotation: &notes}); err != nil {
+		t.Fatal(err)
+	}
+	off := testVm(t, esx, "DC0_C0_RP0_VM0")
+	if err = esx.Power(ctx, PowerParams{Action: PowerOff, Ref: off.Self}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(list []VmSummary) []string {
+		var n []string
+		for _, vm := range list {
+			n = append(n, vm.Name)
+		}
+		sort.Strings(n)
+		return n
+	}
+	tests := []struct {
+		name string
+		q    VmQuery
+		want []string
+	}{
+		{"name glob", VmQuery{Name: "DC0_H0_*"}, []string{"DC0_H0_VM0", "DC0_H0_VM1"}},
+		{"exact name", VmQuery{Name: "DC0_C0_RP0_VM1"}, []string{"DC0_C0_RP0_VM1"}},
+		{"no name match", VmQuery{Name: "web-*"}, nil},
+		{"powered off", VmQuery{PowerState: types.VirtualMachinePowerStatePoweredOff}, []string{"DC0_C0_RP0_VM0"}},
+		{"annotation is case insensitive", VmQuery{Annotation: "WEB TIER"}, []string{"DC0_H0_VM1"}},
+		{"filters combine", VmQuery{Name: "DC0_H0_*", PowerState: types.VirtualMachinePowerStatePoweredOff}, nil},
+		// The filters' properties are retrieved even when Props leaves them out
+		{"filters with props", VmQuery{Annotation: "ops", PowerState: types.VirtualMachinePowerStatePoweredOn, Props: []string{"config.uuid"}}, []string{"DC0_H0_VM1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := esx.ListVms(ctx, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(list); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	list, err := esx.ListVms(ctx, VmQuery{Name: "DC0_H0_VM1", Props: []string{"config.uuid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Uuid != noted.Config.Uuid || list[0].Annotation != "" || list[0].PowerState != "" {
+		t.Fatalf("props not honored: %+v", list)
+	}
+	if _, err = esx.ListVms(ctx, VmQuery{Name: "["}); err == nil {
+		t.Fatal("bad glob accepted")
+	}
+	if _, err = esx.ListVms(ctx, VmQuery{Tag: "prod"}); err == nil {
+		t.Fatal("unknown tag accepted")
+	}
+}
+
+func TestListVmsTag(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.VPX())
+	vm := testVm(t, esx, "DC0_H0_VM0")
+	var tagID string
+	err := esx.EsxiClient.withVapi(ctx, func(rc *rest.Client) error {
+		m := tags.NewManager(rc)
+		cat, err := m.CreateCategory(ctx, &tags.Category{Name: "env", Cardinality: "SINGLE"})
+		if err != nil {
+			return err
+		}
+		if tagID, err = m.CreateTag(ctx, &tags.Tag{Name: "prod", CategoryID: cat}); err != nil {
+			return err
+		}
+		return m.AttachTag(ctx, tagID, vm.Self)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"prod", tagID} {
+		list, err := esx.ListVms(ctx, VmQuery{Tag: tag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Ref != vm.Self {
+			t.Fatalf("tag %s: got %+v, want only %s", tag, list, vm.Name)
+		}
+	}
+	// The tag filter combines with the others
+	list, err := esx.ListVms(ctx, VmQuery{Tag: "prod", Name: "DC0_H0_VM1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("got %+v, want none", list)
+	}
+}
+
+func TestListVmsTagStandalone(t *testing.T) {
+	esx, _ := testService(t, simulator.ESX())
+	if _, err := esx.ListVms(context.Background(), VmQuery{Tag: "prod"}); err == nil {
+		t.Fatal("tag filter on standalone esxi succeeded")
+	}
+}
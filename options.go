@@ -0,0 +1,107 @@
+package gesxi
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options configure how NewEsxiService connects to a host. The zero value
+// verifies the host certificate against the system root CAs.
+type Options struct {
+	// CAFile is a PEM bundle (or several, separated by os.PathListSeparator)
+	// used instead of the system roots to verify the host certificate
+	CAFile string
+	// Thumbprint pins the host certificate by its SHA-1 or SHA-256
+	// fingerprint in hex, with or without colons (as shown in the host
+	// client). When set the certificate chain isn't verified, which is
+	// what ESXi hosts with self-signed certs need.
+	Thumbprint string
+	// Insecure disables certificate verification entirely
+	Insecure bool
+	// KeepAlive, when set, pings the host after this long without a
+	// request so the session doesn't expire. ESXi drops sessions idle for
+	// 30 minutes
+	KeepAlive time.Duration
+	// OnSessionRenew is called whenever a call finds the session expired
+	// and the service logs back in, with the login's error if it failed
+	OnSessionRenew func(err error)
+}
+
+var errThumbprintMismatch = errors.New("certificate thumbprint mismatch")
+
+// tlsConfig builds the TLS policy shared by the SOAP client and the
+// datastore/NFC HTTP transfers.
+func (o Options) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if o.Insecure {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+	if o.CAFile != "" {
+		pool := x509.NewCertPool()
+		for _, name := range filepath.SplitList(o.CAFile) {
+			pem, err := os.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", name)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+	if o.Thumbprint != "" {
+		want, err := parseThumbprint(o.Thumbprint)
+		if err != nil {
+			return nil, err
+		}
+		// The chain is replaced by the pin, so skip the default
+		// verification and only check the leaf fingerprint
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errThumbprintMismatch
+			}
+			var got []byte
+			if len(want) == sha1.Size {
+				sum := sha1.Sum(rawCerts[0])
+				got = sum[:]
+			} else {
+				sum := sha256.Sum256(rawCerts[0])
+				got = sum[:]
+			}
+			if !bytes.Equal(got, want) {
+				return fmt.Errorf("%w: got %s", errThumbprintMismatch, formatThumbprint(got))
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+func parseThumbprint(s string) ([]byte, error) {
+	clean := strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(s))
+	b, err := hex.DecodeString(clean)
+	if err != nil || (len(b) != sha1.Size && len(b) != sha256.Size) {
+		return nil, fmt.Errorf("invalid thumbprint %q: want a SHA-1 or SHA-256 hex fingerprint", s)
+	}
+	return b, nil
+}
+
+func formatThumbprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,243 @@
+package gesxi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// PowerAction is a power operation for Power
+type PowerAction string
+
+const (
+	PowerOn      PowerAction = "on"
+	PowerOff     PowerAction = "off"
+	PowerReset   PowerAction = "reset"
+	PowerSuspend PowerAction = "suspend"
+	// Ask the guest OS through VMware Tools
+	PowerShutdownGuest PowerAction = "shutdown"
+	PowerRebootGuest   PowerAction = "reboot"
+)
+
+type PowerParams struct {
+	Action PowerAction
+	// A VirtualMachine, or a VirtualApp for on, off and suspend
+	Ref types.ManagedObjectReference
+	// Guest shutdown and reboot only: how long the guest gets to power
+	// off, or to go down for its reboot. Zero waits as long as ctx allows
+	// when Wait is set
+	GuestTimeout time.Duration
+	// Fall back to a hard power off (shutdown) or reset (reboot) when
+	// Tools can't reach the guest or it outlives GuestTimeout
+	Force bool
+	// Wait for the guest to power off after a shutdown, or for Tools to
+	// report it running again after a reboot. The other actions always
+	// return once the VM is in its new state
+	Wait bool
+}
+
+// Power runs p.Action on a VM or vApp. Hard power operations wait for
+// their task; guest shutdown and reboot wait as set by p.Wait and
+// p.GuestTimeout.
+func (s *EsxiService) Power(ctx context.Context, p PowerParams) error {
+	switch p.Ref.Type {
+	case "VirtualMachine":
+		switch p.Action {
+		case PowerShutdownGuest:
+			return s.shutdownGuest(ctx, p)
+		case PowerRebootGuest:
+			return s.rebootGuest(ctx, p)
+		}
+	case "VirtualApp":
+		switch p.Action {
+		case PowerOn, PowerOff, PowerSuspend:
+		default:
+			return fmt.Errorf("power %s %s: not supported for vApps", p.Action, p.Ref.Value)
+		}
+	default:
+		return fmt.Errorf("power %s %s: unsupported object type %q", p.Action, p.Ref.Value, p.Ref.Type)
+	}
+	return s.powerTask(ctx, p.Action, p.Ref)
+}
+
+// WaitForPowerState blocks until vm is in state or ctx is done.
+func (s *EsxiService) WaitForPowerState(ctx context.Context, vm types.ManagedObjectReference, state types.VirtualMachinePowerState) error {
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	return property.Wait(ctx, pc, vm, []string{"runtime.powerState"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if c.Val == state {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *EsxiService) shutdownGuest(ctx context.Context, p PowerParams) error {
+	_, err := methods.ShutdownGuest(ctx, s.EsxiClient.Client, &types.ShutdownGuest{This: p.Ref})
+	if err != nil {
+		if p.Force && isToolsUnavailable(err) {
+			return s.powerTask(ctx, PowerOff, p.Ref)
+		}
+		return err
+	}
+	if !p.Wait && p.GuestTimeout == 0 {
+		return nil
+	}
+	waitCtx := ctx
+	if p.GuestTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.GuestTimeout)
+		defer cancel()
+	}
+	err = s.WaitForPowerState(waitCtx, p.Ref, types.VirtualMachinePowerStatePoweredOff)
+	if err == nil || ctx.Err() != nil || !errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if !p.Force {
+		return fmt.Errorf("shutdown %s: guest still running after %s", p.Ref.Value, p.GuestTimeout)
+	}
+	return s.powerTask(ctx, PowerOff, p.Ref)
+}
+
+// rebootGuest asks the guest to restart. The reboot counts as started once
+// Tools stop reporting the guest running; a guest that is still up after
+// p.GuestTimeout is reset when p.Force is set.
+func (s *EsxiService) rebootGuest(ctx context.Context, p PowerParams) error {
+	_, err := methods.RebootGuest(ctx, s.EsxiClient.Client, &types.RebootGuest{This: p.Ref})
+	if err != nil {
+		if p.Force && isToolsUnavailable(err) {
+			return s.powerTask(ctx, PowerReset, p.Ref)
+		}
+		return err
+	}
+	if !p.Wait && p.GuestTimeout == 0 {
+		return nil
+	}
+	waitCtx := ctx
+	if p.GuestTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.GuestTimeout)
+		defer cancel()
+	}
+	running := string(types.VirtualMachineGuestStateRunning)
+	err = s.waitGuestState(waitCtx, p.Ref, func(state string) bool { return state != running })
+	switch {
+	case err == nil:
+	case ctx.Err() != nil || !errors.Is(waitCtx.Err(), context.DeadlineExceeded):
+		return err
+	case !p.Force:
+		return fmt.Errorf("reboot %s: guest still running after %s", p.Ref.Value, p.GuestTimeout)
+	default:
+		return s.powerTask(ctx, PowerReset, p.Ref)
+	}
+	if !p.Wait {
+		return nil
+	}
+	return s.waitGuestState(ctx, p.Ref, func(state string) bool { return state == running })
+}
+
+// waitGuestState blocks until the guest state Tools report for vm
+// satisfies match, or ctx is done.
+func (s *EsxiService) waitGuestState(ctx context.Context, vm types.ManagedObjectReference, match func(state string) bool) error {
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	return property.Wait(ctx, pc, vm, []string{"guest.guestState"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if state, ok := c.Val.(string); ok && match(state) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// powerTask starts the task for a hard power action and waits on it.
+func (s *EsxiService) powerTask(ctx context.Context, action PowerAction, ref types.ManagedObjectReference) error {
+	var (
+		task types.ManagedObjectReference
+		err  error
+	)
+	c := s.EsxiClient.Client
+	vapp := ref.Type == "VirtualApp"
+	switch {
+	case action == PowerOn && vapp:
+		var res *types.PowerOnVApp_TaskResponse
+		if res, err = methods.PowerOnVApp_Task(ctx, c, &types.PowerOnVApp_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerOff && vapp:
+		var res *types.PowerOffVApp_TaskResponse
+		if res, err = methods.PowerOffVApp_Task(ctx, c, &types.PowerOffVApp_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerSuspend && vapp:
+		var res *types.SuspendVApp_TaskResponse
+		if res, err = methods.SuspendVApp_Task(ctx, c, &types.SuspendVApp_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerOn:
+		var res *types.PowerOnVM_TaskResponse
+		if res, err = methods.PowerOnVM_Task(ctx, c, &types.PowerOnVM_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerOff:
+		var res *types.PowerOffVM_TaskResponse
+		if res, err = methods.PowerOffVM_Task(ctx, c, &types.PowerOffVM_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerReset:
+		var res *types.ResetVM_TaskResponse
+		if res, err = methods.ResetVM_Task(ctx, c, &types.ResetVM_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	case action == PowerSuspend:
+		var res *types.SuspendVM_TaskResponse
+		if res, err = methods.SuspendVM_Task(ctx, c, &types.SuspendVM_Task{This: ref}); err == nil {
+			task = res.Returnval
+		}
+	default:
+		return fmt.Errorf("power %s %s: unknown action", action, ref.Value)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task)
+	return err
+}
+
+// isToolsUnavailable reports whether err is the fault returned for guest
+// operations when VMware Tools isn't running.
+func isToolsUnavailable(err error) bool {
+	if err == nil || !soap.IsSoapFault(err) {
+		return false
+	}
+	switch soap.ToSoapFault(err).VimFault().(type) {
+	case types.ToolsUnavailable, *types.ToolsUnavailable:
+		return true
+	}
+	return false
+}
+
+// isInvalidPowerState reports whether err is the fault of a power
+// operation on a VM already in the target state, from the call or its task.
+func isInvalidPowerState(err error) bool {
+	var fault interface{}
+	var taskErr *TaskError
+	switch {
+	case errors.As(err, &taskErr) && taskErr.Fault != nil:
+		fault = taskErr.Fault.Fault
+	case err != nil && soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	}
+	switch fault.(type) {
+	case types.InvalidPowerState, *types.InvalidPowerState:
+		return true
+	}
+	return false
+}
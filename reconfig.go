@@ -0,0 +1,156 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vim25/xml"
+)
+
+// ReconfigureVmParams lists the settings to change; zero values and nil
+// pointers leave a setting as it is.
+type ReconfigureVmParams struct {
+	NumCpus        int32
+	CoresPerSocket int32
+	MemoryMB       int64
+	// Reservations and limits; -1 removes a limit
+	CpuReservationMHz *int64
+	CpuLimitMHz       *int64
+	MemReservationMB  *int64
+	MemLimitMB        *int64
+	// Reserve all guest memory, needed for SR-IOV and passthrough devices
+	MemReserveAll *bool
+	CpuHotAdd     *bool
+	CpuHotRemove  *bool
+	MemoryHotAdd  *bool
+	// VM notes; "" clears them
+	Annotation *string
+	// Advanced settings, e.g. "guestinfo.hostname". An empty value removes
+	// the key
+	ExtraConfig map[string]string
+}
+
+// ReconfigureVm applies p to vm. Most settings other than hot-add and
+// extraConfig need the VM powered off.
+func (s *EsxiService) ReconfigureVm(ctx context.Context, vm mo.VirtualMachine, p ReconfigureVmParams) error {
+	spec := reconfigSpec(p)
+	var err error
+	if p.Annotation != nil && *p.Annotation == "" {
+		err = s.reconfigVmClearNotes(ctx, vm, spec)
+	} else {
+		err = s.reconfigVm(ctx, vm, spec)
+	}
+	if err != nil {
+		return fmt.Errorf("reconfigure %s: %w", vm.Name, err)
+	}
+	return nil
+}
+
+// reconfigSpec builds the config spec ReconfigureVm applies for p.
+func reconfigSpec(p ReconfigureVmParams) types.VirtualMachineConfigSpec {
+	spec := types.VirtualMachineConfigSpec{
+		NumCPUs:                      p.NumCpus,
+		NumCoresPerSocket:            p.CoresPerSocket,
+		MemoryMB:                     p.MemoryMB,
+		MemoryReservationLockedToMax: p.MemReserveAll,
+		CpuHotAddEnabled:             p.CpuHotAdd,
+		CpuHotRemoveEnabled:          p.CpuHotRemove,
+		MemoryHotAddEnabled:          p.MemoryHotAdd,
+	}
+	if p.Annotation != nil {
+		spec.Annotation = *p.Annotation
+	}
+	if p.CpuReservationMHz != nil || p.CpuLimitMHz != nil {
+		spec.CpuAllocation = &types.ResourceAllocationInfo{
+			Reservation: p.CpuReservationMHz,
+			Limit:       p.CpuLimitMHz,
+		}
+	}
+	if p.MemReservationMB != nil || p.MemLimitMB != nil {
+		spec.MemoryAllocation = &types.ResourceAllocationInfo{
+			Reservation: p.MemReservationMB,
+			Limit:       p.MemLimitMB,
+		}
+	}
+	keys := make([]string, 0, len(p.ExtraConfig))
+	for k := range p.ExtraConfig {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		spec.ExtraConfig = append(spec.ExtraConfig, &types.OptionValue{Key: k, Value: p.ExtraConfig[k]})
+	}
+	return spec
+}
+
+// reconfigVm runs ReconfigVM_Task with spec and waits for it.
+func (s *EsxiService) reconfigVm(ctx context.Context, vm mo.VirtualMachine, spec types.VirtualMachineConfigSpec) error {
+	task, err := methods.ReconfigVM_Task(ctx, s.EsxiClient.Client, &types.ReconfigVM_Task{
+		This: vm.Reference(),
+		Spec: spec,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// notesMarker stands in for the cleared notes while clearNotesXml encodes
+// a spec.
+const notesMarker = "gesxi-cleared-notes"
+
+// reconfigVmClearNotes is reconfigVm for a spec that also clears the VM's
+// notes.
+func (s *EsxiService) reconfigVmClearNotes(ctx context.Context, vm mo.VirtualMachine, spec types.VirtualMachineConfigSpec) error {
+	inner, err := clearNotesXml(spec)
+	if err != nil {
+		return err
+	}
+	req := reconfigVmBody{Req: &reconfigVmRequest{This: vm.Reference()}}
+	req.Req.Spec.Xml = inner
+	var res reconfigVmBody
+	if err := s.EsxiClient.RoundTrip(ctx, &req, &res); err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, res.Res.Returnval)
+	return err
+}
+
+// clearNotesXml encodes spec with an empty annotation, returning the
+// contents of its element. The generated types leave an empty annotation
+// out, which the API takes as "unchanged"; an empty element clears it.
+func clearNotesXml(spec types.VirtualMachineConfigSpec) (string, error) {
+	spec.Annotation = notesMarker
+	b, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"spec"`
+		types.VirtualMachineConfigSpec
+	}{VirtualMachineConfigSpec: spec})
+	if err != nil {
+		return "", err
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(string(b), "<spec>"), "</spec>")
+	return strings.Replace(inner, "<annotation>"+notesMarker+"</annotation>", "<annotation></annotation>", 1), nil
+}
+
+// reconfigVmBody is methods.ReconfigVM_TaskBody with the spec as raw XML.
+type reconfigVmBody struct {
+	Req    *reconfigVmRequest             `xml:"urn:vim25 ReconfigVM_Task,omitempty"`
+	Res    *types.ReconfigVM_TaskResponse `xml:"ReconfigVM_TaskResponse,omitempty"`
+	Fault_ *soap.Fault                    `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault,omitempty"`
+}
+
+func (b *reconfigVmBody) Fault() *soap.Fault { return b.Fault_ }
+
+type reconfigVmRequest struct {
+	This types.ManagedObjectReference `xml:"_this"`
+	Spec struct {
+		Xml string `xml:",innerxml"`
+	} `xml:"spec"`
+}
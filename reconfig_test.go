@@ -0,0 +1,135 @@
+package gesxi
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestReconfigSpec(t *testing.T) {
+	i64 := func(v int64) *int64 { return &v }
+	str := func(v string) *string { return &v }
+	tests := []struct {
+		name string
+		p    ReconfigureVmParams
+		want types.VirtualMachineConfigSpec
+	}{
+		{"nothing", ReconfigureVmParams{}, types.VirtualMachineConfigSpec{}},
+		{
+			"cpu and memory",
+			ReconfigureVmParams{NumCpus: 4, CoresPerSocket: 2, MemoryMB: 8192},
+			types.VirtualMachineConfigSpec{NumCPUs: 4, NumCoresPerSocket: 2, MemoryMB: 8192},
+		},
+		{
+			"cpu allocation",
+			ReconfigureVmParams{CpuReservationMHz: i64(1000), CpuLimitMHz: i64(-1)},
+			types.VirtualMachineConfigSpec{CpuAllocation: &types.ResourceAllocationInfo{Reservation: i64(1000), Limit: i64(-1)}},
+		},
+		{
+			"memory limit only",
+			ReconfigureVmParams{MemLimitMB: i64(2048)},
+			types.VirtualMachineConfigSpec{MemoryAllocation: &types.ResourceAllocationInfo{Limit: i64(2048)}},
+		},
+		{
+			"hot add and reserve all",
+			ReconfigureVmParams{CpuHotAdd: types.NewBool(true), CpuHotRemove: types.NewBool(false), MemoryHotAdd: types.NewBool(true), MemReserveAll: types.NewBool(true)},
+			types.VirtualMachineConfigSpec{
+				CpuHotAddEnabled:             types.NewBool(true),
+				CpuHotRemoveEnabled:          types.NewBool(false),
+				MemoryHotAddEnabled:          types.NewBool(true),
+				MemoryReservationLockedToMax: types.NewBool(true),
+			},
+		},
+		{"notes", ReconfigureVmParams{Annotation: str("web tier")}, types.VirtualMachineConfigSpec{Annotation: "web tier"}},
+		{"clear notes", ReconfigureVmParams{Annotation: str("")}, types.VirtualMachineConfigSpec{}},
+		{
+			"extra config sorted, empty removes",
+			ReconfigureVmParams{ExtraConfig: map[string]string{"guestinfo.hostname": "lab01", "disk.EnableUUID": "TRUE", "guestinfo.old": ""}},
+			types.VirtualMachineConfigSpec{ExtraConfig: []types.BaseOptionValue{
+				&types.OptionValue{Key: "disk.EnableUUID", Value: "TRUE"},
+				&types.OptionValue{Key: "guestinfo.hostname", Value: "lab01"},
+				&types.OptionValue{Key: "guestinfo.old", Value: ""},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reconfigSpec(tt.p); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconfigureVmNotes(t *testing.T) {
+	ctx := context.Background()
+	esx, _ := testService(t, simulator.ESX())
+	vms, err := esx.GetVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := vms[0]
+	notes := func(want string) {
+		t.Helper()
+		got, err := esx.GetVmByUuid(ctx, vm.Config.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Config.Annotation != want {
+			t.Errorf("GetVmByUuid: notes %q, want %q", got.Config.Annotation, want)
+		}
+		all, err := esx.GetVms(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range all {
+			if v.Self == vm.Self && v.Config.Annotation != want {
+				t.Errorf("GetVms: notes %q, want %q", v.Config.Annotation, want)
+			}
+		}
+		list, err := esx.ListVms(ctx, VmQuery{Name: vm.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Annotation != want {
+			t.Errorf("ListVms: %+v, want notes %q", list, want)
+		}
+	}
+
+	set := "web tier"
+	if err = esx.ReconfigureVm(ctx, vm, ReconfigureVmParams{Annotation: &set}); err != nil {
+		t.Fatal(err)
+	}
+	notes(set)
+	// Unset notes are left alone
+	if err = esx.ReconfigureVm(ctx, vm, ReconfigureVmParams{NumCpus: 2}); err != nil {
+		t.Fatal(err)
+	}
+	notes(set)
+	// vcsim ignores an empty annotation, so all that shows is that the
+	// rest of the spec still goes through with it
+	cleared := ""
+	if err = esx.ReconfigureVm(ctx, vm, ReconfigureVmParams{NumCpus: 4, Annotation: &cleared}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := esx.GetVmByUuid(ctx, vm.Config.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Config.Hardware.NumCPU != 4 {
+		t.Errorf("cpus %d, want 4", got.Config.Hardware.NumCPU)
+	}
+}
+
+func TestClearNotesXml(t *testing.T) {
+	got, err := clearNotesXml(types.VirtualMachineConfigSpec{Name: "web01", NumCPUs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<name>web01</name><annotation></annotation><numCPUs>2</numCPUs>"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
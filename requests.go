@@ -1,10 +1,11 @@
 package gesxi
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -13,14 +14,12 @@ type Service struct {
 	BaseURL string
 }
 
-func newHttpService(host string, jar *http.CookieJar) *Service {
+func newHttpService(host string, jar *http.CookieJar, tlsConfig *tls.Config) *Service {
 	return &Service{
 		BaseURL: fmt.Sprintf("https://%s/folder", host),
 		http: &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
+				TLSClientConfig: tlsConfig.Clone(),
 			},
 			Timeout: 12000 * time.Second,
 			Jar:     *jar,
@@ -28,8 +27,8 @@ func newHttpService(host string, jar *http.CookieJar) *Service {
 	}
 }
 
-func (s *Service) GenerateRequest(method, url string, file *os.File) (*http.Request, error) {
-	return http.NewRequest(method, url, file)
+func (s *Service) GenerateRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, url, body)
 }
 
 func (s *Service) MakeRequest(req *http.Request) (*http.Response, error) {
@@ -0,0 +1,190 @@
+package gesxi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+var errNotLoggedIn = errors.New("not logged in")
+
+// reloginRoundTripper retries calls that fail with NotAuthenticated once,
+// after logging back in the way the last successful Login did.
+type reloginRoundTripper struct {
+	soap.RoundTripper
+	onRenew func(error)
+
+	// renewMu serializes logins; mu guards login and generation and is
+	// never held across a call, as the login itself goes through RoundTrip
+	renewMu sync.Mutex
+	mu      sync.Mutex
+	login   func(context.Context) error
+	// Bumped on every login, so concurrent calls failing on the same
+	// expired session only log in again once
+	generation int
+}
+
+func (r *reloginRoundTripper) setLogin(login func(context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.login = login
+	r.generation++
+}
+
+func (r *reloginRoundTripper) state() (func(context.Context) error, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.login, r.generation
+}
+
+func (r *reloginRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	_, generation := r.state()
+	err := r.RoundTripper.RoundTrip(ctx, req, res)
+	if !isNotAuthenticated(err) {
+		return err
+	}
+	switch req.(type) {
+	case *methods.LoginBody, *methods.LoginByTokenBody, *methods.CloneSessionBody, *methods.LogoutBody:
+		return err
+	}
+	if lerr := r.renew(ctx, generation); lerr != nil {
+		return err
+	}
+	clearFault(res)
+	return r.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+// renew logs in again unless another call already has since generation.
+func (r *reloginRoundTripper) renew(ctx context.Context, generation int) error {
+	r.renewMu.Lock()
+	defer r.renewMu.Unlock()
+	login, current := r.state()
+	if login == nil {
+		return errNotLoggedIn
+	}
+	if current != generation {
+		return nil
+	}
+	err := login(ctx)
+	if err == nil {
+		r.mu.Lock()
+		r.generation++
+		r.mu.Unlock()
+	}
+	if r.onRenew != nil {
+		r.onRenew(err)
+	}
+	return err
+}
+
+func isNotAuthenticated(err error) bool {
+	if err == nil || !soap.IsSoapFault(err) {
+		return false
+	}
+	switch soap.ToSoapFault(err).VimFault().(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+	return false
+}
+
+// clearFault resets the fault a failed call left in res, which decoding
+// the retry's response wouldn't overwrite.
+func clearFault(res soap.HasFault) {
+	v := reflect.ValueOf(res)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	if f := v.Elem().FieldByName("Fault_"); f.IsValid() && f.CanSet() {
+		f.Set(reflect.Zero(f.Type()))
+	}
+}
+
+// Session is a logged in session saved for a later process to resume,
+// instead of each short-lived run opening (and using up) a new one.
+type Session struct {
+	Host string `json:"host"`
+	User string `json:"user"`
+	// Value of the vmware_soap_session cookie
+	Cookie string `json:"cookie"`
+}
+
+// Session returns the current session for saving. It fails before Login.
+func (s *EsxiService) Session() (Session, error) {
+	cookie := s.EsxiClient.sessionCookie()
+	if cookie == "" {
+		return Session{}, errNotLoggedIn
+	}
+	return Session{Host: s.EsxHostIp, User: s.EsxiClient.Userinfo.Username(), Cookie: cookie}, nil
+}
+
+// ResumeSession continues sess in place of Login. It fails with
+// ErrSessionExpired when the host no longer knows the session, and with
+// ErrSessionMismatch when sess belongs to another host or user, since
+// re-logins would then use different credentials.
+func (s *EsxiService) ResumeSession(ctx context.Context, sess Session) error {
+	if sess.Host != s.EsxHostIp || sess.User != s.EsxiClient.Userinfo.Username() {
+		return fmt.Errorf("resume session of %s@%s as %s@%s: %w",
+			sess.User, sess.Host, s.EsxiClient.Userinfo.Username(), s.EsxHostIp, ErrSessionMismatch)
+	}
+	return s.EsxiClient.Resume(ctx, sess.Cookie, s.EsxiClient.Userinfo)
+}
+
+// SaveSessionFile writes the current session to path as JSON, readable by
+// the owner only since the cookie is as good as the password while the
+// session lasts.
+func (s *EsxiService) SaveSessionFile(path string) error {
+	sess, err := s.Session()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// ResumeSessionFile resumes the session saved at path by SaveSessionFile.
+func (s *EsxiService) ResumeSessionFile(ctx context.Context, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sess Session
+	if err = json.Unmarshal(b, &sess); err != nil {
+		return fmt.Errorf("session file %s: %w", path, err)
+	}
+	return s.ResumeSession(ctx, sess)
+}
+
+// LoginWithSessionFile resumes the session saved at path, or logs in and
+// saves the new session there when there is none or it has expired. A
+// file holding another host's or user's session is left alone and
+// ErrSessionMismatch returned. Don't Logout afterwards if the session is
+// meant to be reused.
+func (s *EsxiService) LoginWithSessionFile(ctx context.Context, path string) error {
+	err := s.ResumeSessionFile(ctx, path)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, ErrSessionExpired) && !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	if err = s.Login(ctx); err != nil {
+		return err
+	}
+	return s.SaveSessionFile(path)
+}
@@ -0,0 +1,347 @@
+package gesxi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// expireSession ends esx's session from admin's, as the host does when a
+// session times out.
+func expireSession(t *testing.T, admin, esx *EsxiService) {
+	t.Helper()
+	ctx := context.Background()
+	us, err := esx.EsxiClient.SessionManager.UserSession(ctx)
+	if err != nil || us == nil {
+		t.Fatalf("UserSession: %v %v", us, err)
+	}
+	if err = admin.EsxiClient.SessionManager.TerminateSession(ctx, []string{us.Key}); err != nil {
+		t.Fatalf("TerminateSession: %v", err)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	admin := testLogin(t, vcsim, Options{Insecure: true})
+	var renewals int32
+	var renewErr error
+	esx := testLogin(t, vcsim, Options{Insecure: true, OnSessionRenew: func(err error) {
+		atomic.AddInt32(&renewals, 1)
+		renewErr = err
+	}})
+	if _, err := esx.GetHosts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if renewals != 0 {
+		t.Fatalf("%d renewals on a live session", renewals)
+	}
+
+	expireSession(t, admin, esx)
+	hosts, err := esx.GetHosts(ctx)
+	if err != nil {
+		t.Fatalf("call on an expired session: %v", err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("got %d hosts, want 1", len(hosts))
+	}
+	if renewals != 1 || renewErr != nil {
+		t.Fatalf("%d renewals, last error %v; want 1 successful", renewals, renewErr)
+	}
+	if us, err := esx.EsxiClient.SessionManager.UserSession(ctx); err != nil || us == nil {
+		t.Fatalf("no session after renewal: %v", err)
+	}
+}
+
+func TestReloginConcurrent(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	admin := testLogin(t, vcsim, Options{Insecure: true})
+	var renewals int32
+	esx := testLogin(t, vcsim, Options{Insecure: true, OnSessionRenew: func(err error) {
+		atomic.AddInt32(&renewals, 1)
+	}})
+	vms, err := esx.GetVms(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 1; round <= 3; round++ {
+		expireSession(t, admin, esx)
+		start := make(chan struct{})
+		errs := make(chan error, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				// Each call is a single round trip, so all of them can
+				// fail on the expired session before any logs back in
+				_, err := esx.getVmByMo(ctx, vms[0].Self)
+				errs <- err
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+		if n := atomic.LoadInt32(&renewals); n != int32(round) {
+			t.Fatalf("round %d: %d renewals, want one per expiry", round, n)
+		}
+	}
+}
+
+func TestReloginFails(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	admin := testLogin(t, vcsim, Options{Insecure: true})
+	var renewErr error
+	esx := testLogin(t, vcsim, Options{Insecure: true, OnSessionRenew: func(err error) {
+		renewErr = err
+	}})
+	// The password has since changed
+	esx.EsxiClient.sessions.setLogin(func(ctx context.Context) error {
+		return esx.EsxiClient.SessionManager.Login(ctx, url.UserPassword("user", ""))
+	})
+	expireSession(t, admin, esx)
+
+	_, err := esx.GetHosts(ctx)
+	if !isNotAuthenticated(err) {
+		t.Fatalf("got %v, want the call's NotAuthenticated", err)
+	}
+	if renewErr == nil {
+		t.Fatal("renewal hook wasn't told the login failed")
+	}
+}
+
+func TestReloginAfterLogout(t *testing.T) {
+	ctx := context.Background()
+	var renewals int32
+	esx, _ := testService(t, simulator.ESX())
+	esx.EsxiClient.sessions.onRenew = func(error) { atomic.AddInt32(&renewals, 1) }
+	if err := esx.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := esx.GetHosts(ctx); !isNotAuthenticated(err) {
+		t.Fatalf("got %v, want NotAuthenticated after Logout", err)
+	}
+	if renewals != 0 {
+		t.Fatalf("logged back in %d times after Logout", renewals)
+	}
+}
+
+func TestClearFault(t *testing.T) {
+	res := &methods.RetrievePropertiesExBody{
+		Res:    nil,
+		Fault_: &soap.Fault{Code: "ServerFaultCode", String: "The session is not authenticated."},
+	}
+	clearFault(res)
+	if res.Fault() != nil {
+		t.Fatalf("fault left: %v", res.Fault())
+	}
+
+	// Responses clearFault can't reset are left alone, not panicked on
+	clearFault(nil)
+	clearFault(noFault{})
+	var body *methods.LoginBody
+	clearFault(body)
+}
+
+type noFault struct{}
+
+func (noFault) Fault() *soap.Fault { return nil }
+
+func TestIsNotAuthenticated(t *testing.T) {
+	fault := func(f types.AnyType) error {
+		return soap.WrapSoapFault(&soap.Fault{Detail: struct {
+			Fault types.AnyType `xml:",any,typeattr"`
+		}{Fault: f}})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"other error", errors.New("boom"), false},
+		{"not authenticated", fault(&types.NotAuthenticated{}), true},
+		{"not authenticated value", fault(types.NotAuthenticated{}), true},
+		{"other fault", fault(&types.InvalidLogin{}), false},
+	}
+	for _, tt := range tests {
+		if got := isNotAuthenticated(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSessionFileResume(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	esx := testLogin(t, vcsim, Options{Insecure: true})
+	path := filepath.Join(t.TempDir(), "sessions", "esx.json")
+	if err := esx.SaveSessionFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("session file: %v %v, want mode 0600", fi, err)
+	}
+	saved, err := esx.EsxiClient.SessionManager.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later process picks the session up without logging in
+	next := testConnect(t, vcsim, Options{Insecure: true})
+	if _, err = next.Session(); err == nil {
+		t.Fatal("Session before login succeeded")
+	}
+	if err = next.ResumeSessionFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := next.EsxiClient.SessionManager.UserSession(ctx)
+	if err != nil || resumed == nil {
+		t.Fatalf("UserSession: %v %v", resumed, err)
+	}
+	if resumed.Key != saved.Key {
+		t.Fatalf("resumed session %s, want the saved %s", resumed.Key, saved.Key)
+	}
+	if _, err = next.GetHosts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Resuming again reuses the same session rather than opening another
+	if err = testConnect(t, vcsim, Options{Insecure: true}).LoginWithSessionFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if again := readSession(t, path); again.Cookie != mustSession(t, esx).Cookie {
+		t.Fatal("LoginWithSessionFile replaced a live session")
+	}
+}
+
+func TestSessionFileExpired(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	admin := testLogin(t, vcsim, Options{Insecure: true})
+	esx := testLogin(t, vcsim, Options{Insecure: true})
+	path := filepath.Join(t.TempDir(), "esx.json")
+	if err := esx.SaveSessionFile(path); err != nil {
+		t.Fatal(err)
+	}
+	old := readSession(t, path)
+	expireSession(t, admin, esx)
+
+	next := testConnect(t, vcsim, Options{Insecure: true})
+	if err := next.ResumeSessionFile(ctx, path); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if err := next.LoginWithSessionFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if sess := readSession(t, path); sess.Cookie == old.Cookie || sess.Cookie != mustSession(t, next).Cookie {
+		t.Fatal("LoginWithSessionFile didn't save the new session")
+	}
+	if _, err := next.GetHosts(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// No file yet is the same as an expired one
+	fresh := filepath.Join(t.TempDir(), "new.json")
+	if err := testConnect(t, vcsim, Options{Insecure: true}).LoginWithSessionFile(ctx, fresh); err != nil {
+		t.Fatal(err)
+	}
+	readSession(t, fresh)
+}
+
+func TestSessionFileGarbled(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	path := filepath.Join(t.TempDir(), "esx.json")
+	garbled := []byte("{\"host\": \"127.0.0.1")
+	if err := os.WriteFile(path, garbled, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	esx := testConnect(t, vcsim, Options{Insecure: true})
+	err := esx.ResumeSessionFile(ctx, path)
+	if err == nil || errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want a decode error", err)
+	}
+	if err = esx.LoginWithSessionFile(ctx, path); err == nil {
+		t.Fatal("LoginWithSessionFile logged in over a garbled file")
+	}
+	if b, _ := os.ReadFile(path); string(b) != string(garbled) {
+		t.Fatalf("garbled file overwritten: %s", b)
+	}
+}
+
+func TestSessionFileMismatch(t *testing.T) {
+	ctx := context.Background()
+	vcsim := testServer(t, simulator.ESX())
+	esx := testLogin(t, vcsim, Options{Insecure: true})
+	path := filepath.Join(t.TempDir(), "esx.json")
+	if err := esx.SaveSessionFile(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+
+	other, err := NewEsxiService(ctx, vcsim.URL.Host, "other", "pass", Options{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.ResumeSessionFile(ctx, path); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("other user: got %v, want ErrSessionMismatch", err)
+	}
+	if err = other.LoginWithSessionFile(ctx, path); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("other user login: got %v, want ErrSessionMismatch", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != string(saved) {
+		t.Fatal("another user's session file was overwritten")
+	}
+
+	sess := mustSession(t, esx)
+	sess.Host = "esx02.example.com"
+	err = testConnect(t, vcsim, Options{Insecure: true}).ResumeSession(ctx, sess)
+	if !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("other host: got %v, want ErrSessionMismatch", err)
+	}
+}
+
+func mustSession(t *testing.T, esx *EsxiService) Session {
+	t.Helper()
+	sess, err := esx.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func readSession(t *testing.T, path string) Session {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sess Session
+	if err = json.Unmarshal(b, &sess); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Cookie == "" {
+		t.Fatalf("%s holds no session", path)
+	}
+	return sess
+}
@@ -0,0 +1,209 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type SnapshotParams struct {
+	Name        string
+	Description string
+	// Include the VM's memory so reverting resumes it running
+	Memory bool
+	// Quiesce the guest file systems through VMware Tools; ignored with Memory
+	Quiesce bool
+}
+
+// Snapshot is a node of a VM's snapshot tree
+type Snapshot struct {
+	Ref         types.ManagedObjectReference `json:"ref"`
+	Name        string                       `json:"name"`
+	Description string                       `json:"description,omitempty"`
+	Created     time.Time                    `json:"created"`
+	// Power state of the VM when the snapshot was taken
+	PowerState types.VirtualMachinePowerState `json:"powerState"`
+	Quiesced   bool                           `json:"quiesced"`
+	// Whether this is the snapshot the VM is currently running from
+	Current  bool       `json:"current"`
+	Children []Snapshot `json:"children,omitempty"`
+}
+
+// CreateSnapshot snapshots vm and returns the new snapshot's reference.
+func (s *EsxiService) CreateSnapshot(ctx context.Context, vm mo.VirtualMachine, p SnapshotParams) (types.ManagedObjectReference, error) {
+	var ref types.ManagedObjectReference
+	if p.Name == "" {
+		return ref, fmt.Errorf("snapshot %s: name is required", vm.Name)
+	}
+	task, err := methods.CreateSnapshot_Task(ctx, s.EsxiClient.Client, &types.CreateSnapshot_Task{
+		This:        vm.Self,
+		Name:        p.Name,
+		Description: p.Description,
+		Memory:      p.Memory,
+		Quiesce:     p.Quiesce && !p.Memory,
+	})
+	if err != nil {
+		return ref, err
+	}
+	result, err := s.waitTask(ctx, task.Returnval)
+	if err != nil {
+		return ref, err
+	}
+	ref, ok := result.(types.ManagedObjectReference)
+	if !ok {
+		return ref, fmt.Errorf("snapshot %s: unexpected task result %T", vm.Name, result)
+	}
+	return ref, nil
+}
+
+// GetSnapshots returns vm's snapshot tree, roots first. A VM without
+// snapshots returns an empty list.
+func (s *EsxiService) GetSnapshots(ctx context.Context, vm mo.VirtualMachine) ([]Snapshot, error) {
+	vm, err := s.getVmByMo(ctx, vm.Self)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Snapshot == nil {
+		return nil, nil
+	}
+	return snapshotTree(vm.Snapshot.RootSnapshotList, vm.Snapshot.CurrentSnapshot), nil
+}
+
+// RevertToSnapshot reverts vm to the snapshot named name. name can also be
+// a path from a root snapshot ("base/patched") or a snapshot id
+// ("snapshot-12"), which disambiguates snapshots sharing a name.
+func (s *EsxiService) RevertToSnapshot(ctx context.Context, vm mo.VirtualMachine, name string) error {
+	snap, err := s.findSnapshot(ctx, vm, name)
+	if err != nil {
+		return err
+	}
+	task, err := methods.RevertToSnapshot_Task(ctx, s.EsxiClient.Client, &types.RevertToSnapshot_Task{
+		This: snap.Ref,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// RevertToCurrentSnapshot reverts vm to the snapshot it's running from.
+func (s *EsxiService) RevertToCurrentSnapshot(ctx context.Context, vm mo.VirtualMachine) error {
+	task, err := methods.RevertToCurrentSnapshot_Task(ctx, s.EsxiClient.Client, &types.RevertToCurrentSnapshot_Task{
+		This: vm.Self,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// RemoveSnapshot deletes the snapshot named name (see RevertToSnapshot),
+// merging its changes into its children or the running disks. With
+// removeChildren its whole subtree is deleted.
+func (s *EsxiService) RemoveSnapshot(ctx context.Context, vm mo.VirtualMachine, name string, removeChildren bool) error {
+	snap, err := s.findSnapshot(ctx, vm, name)
+	if err != nil {
+		return err
+	}
+	task, err := methods.RemoveSnapshot_Task(ctx, s.EsxiClient.Client, &types.RemoveSnapshot_Task{
+		This:           snap.Ref,
+		RemoveChildren: removeChildren,
+		Consolidate:    types.NewBool(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// RemoveAllSnapshots deletes every snapshot of vm, keeping its current
+// state.
+func (s *EsxiService) RemoveAllSnapshots(ctx context.Context, vm mo.VirtualMachine) error {
+	task, err := methods.RemoveAllSnapshots_Task(ctx, s.EsxiClient.Client, &types.RemoveAllSnapshots_Task{
+		This:        vm.Self,
+		Consolidate: types.NewBool(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// ConsolidateVmDisks merges redundant delta disks left behind by failed
+// snapshot removals, i.e. when vm.Runtime.ConsolidationNeeded is set.
+func (s *EsxiService) ConsolidateVmDisks(ctx context.Context, vm mo.VirtualMachine) error {
+	task, err := methods.ConsolidateVMDisks_Task(ctx, s.EsxiClient.Client, &types.ConsolidateVMDisks_Task{
+		This: vm.Self,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// findSnapshot looks name up in vm's current snapshot tree by id, path or
+// name, erroring when a name matches more than one snapshot.
+func (s *EsxiService) findSnapshot(ctx context.Context, vm mo.VirtualMachine, name string) (Snapshot, error) {
+	tree, err := s.GetSnapshots(ctx, vm)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap, err := lookupSnapshot(tree, name)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot %q of %s: %w", name, vm.Name, err)
+	}
+	return snap, nil
+}
+
+// lookupSnapshot is findSnapshot over an already retrieved tree.
+func lookupSnapshot(tree []Snapshot, name string) (Snapshot, error) {
+	var matches []Snapshot
+	var walk func(nodes []Snapshot, parent string)
+	walk = func(nodes []Snapshot, parent string) {
+		for _, n := range nodes {
+			path := n.Name
+			if parent != "" {
+				path = parent + "/" + n.Name
+			}
+			if n.Ref.Value == name || path == name || (!strings.Contains(name, "/") && n.Name == name) {
+				matches = append(matches, n)
+			}
+			walk(n.Children, path)
+		}
+	}
+	walk(tree, "")
+	switch len(matches) {
+	case 0:
+		return Snapshot{}, ErrNotFound
+	case 1:
+		return matches[0], nil
+	}
+	return Snapshot{}, fmt.Errorf("%d snapshots match, use its path or id: %w", len(matches), ErrAmbiguous)
+}
+
+func snapshotTree(nodes []types.VirtualMachineSnapshotTree, current *types.ManagedObjectReference) []Snapshot {
+	var tree []Snapshot
+	for _, n := range nodes {
+		tree = append(tree, Snapshot{
+			Ref:         n.Snapshot,
+			Name:        n.Name,
+			Description: n.Description,
+			Created:     n.CreateTime,
+			PowerState:  n.State,
+			Quiesced:    n.Quiesced,
+			Current:     current != nil && *current == n.Snapshot,
+			Children:    snapshotTree(n.ChildSnapshotList, current),
+		})
+	}
+	return tree
+}
@@ -0,0 +1,72 @@
+package gesxi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func testSnapshot(id, name string, children ...types.VirtualMachineSnapshotTree) types.VirtualMachineSnapshotTree {
+	return types.VirtualMachineSnapshotTree{
+		Snapshot:          types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: id},
+		Name:              name,
+		ChildSnapshotList: children,
+	}
+}
+
+func TestLookupSnapshot(t *testing.T) {
+	// base ─┬─ patched ── patched
+	//       └─ test
+	// other ── test
+	roots := []types.VirtualMachineSnapshotTree{
+		testSnapshot("snapshot-1", "base",
+			testSnapshot("snapshot-2", "patched",
+				testSnapshot("snapshot-3", "patched")),
+			testSnapshot("snapshot-4", "test")),
+		testSnapshot("snapshot-5", "other",
+			testSnapshot("snapshot-6", "test")),
+	}
+	current := roots[0].ChildSnapshotList[1].Snapshot
+	tree := snapshotTree(roots, &current)
+
+	tests := []struct {
+		name    string
+		lookup  string
+		want    string
+		wantErr error
+	}{
+		{"unique name", "base", "snapshot-1", nil},
+		{"nested unique name", "other", "snapshot-5", nil},
+		{"path", "base/test", "snapshot-4", nil},
+		{"other path", "other/test", "snapshot-6", nil},
+		{"deep path", "base/patched/patched", "snapshot-3", nil},
+		{"path to a parent sharing its name", "base/patched", "snapshot-2", nil},
+		{"id", "snapshot-6", "snapshot-6", nil},
+		{"ambiguous name", "test", "", ErrAmbiguous},
+		{"ambiguous name in a chain", "patched", "", ErrAmbiguous},
+		{"unknown name", "golden", "", ErrNotFound},
+		{"unknown path", "other/patched", "", ErrNotFound},
+		{"path not from a root", "patched/patched", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap, err := lookupSnapshot(tree, tt.lookup)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snap.Ref.Value != tt.want {
+				t.Fatalf("got %s, want %s", snap.Ref.Value, tt.want)
+			}
+			if snap.Current != (snap.Ref == current) {
+				t.Fatalf("%s current = %v", snap.Ref.Value, snap.Current)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// TaskProgressFunc is called with the task's info each time it changes
+// while WaitForTask is waiting on it. info.Progress holds the percentage
+// done when the host reports one.
+type TaskProgressFunc func(info types.TaskInfo)
+
+// TaskError is returned when a vSphere task finishes in the error state.
+type TaskError struct {
+	Task types.ManagedObjectReference
+	// Name of the method the task ran, e.g. VirtualMachine.reconfigure
+	Name  string
+	Fault *types.LocalizedMethodFault
+}
+
+func (e *TaskError) Error() string {
+	msg := "unknown error"
+	if e.Fault != nil {
+		msg = e.Fault.LocalizedMessage
+		if msg == "" && e.Fault.Fault != nil {
+			msg = reflect.TypeOf(e.Fault.Fault).Elem().Name()
+		}
+	}
+	return fmt.Sprintf("%s %s: %s", e.Task.Value, e.Name, msg)
+}
+
+// WaitForTask blocks until task succeeds, fails or ctx is done, calling
+// progress (if not nil) on every update. It returns the task's result,
+// e.g. the VirtualMachine reference for CreateVM_Task, or a *TaskError
+// carrying the task's fault.
+func (s *EsxiService) WaitForTask(ctx context.Context, task types.ManagedObjectReference, progress TaskProgressFunc) (types.AnyType, error) {
+	var info types.TaskInfo
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	err := property.Wait(ctx, pc, task, []string{"info"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if c.Name != "info" || c.Op != types.PropertyChangeOpAssign {
+				continue
+			}
+			ti, ok := c.Val.(types.TaskInfo)
+			if !ok {
+				continue
+			}
+			info = ti
+			if progress != nil {
+				progress(info)
+			}
+		}
+		return info.State == types.TaskInfoStateSuccess || info.State == types.TaskInfoStateError
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.State == types.TaskInfoStateError {
+		return nil, &TaskError{Task: task, Name: info.DescriptionId, Fault: info.Error}
+	}
+	return info.Result, nil
+}
+
+// waitTask waits on a task started by one of the EsxiService methods,
+// reporting progress to s.TaskProgress.
+func (s *EsxiService) waitTask(ctx context.Context, task types.ManagedObjectReference) (types.AnyType, error) {
+	return s.WaitForTask(ctx, task, s.TaskProgress)
+}
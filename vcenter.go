@@ -0,0 +1,272 @@
+package gesxi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Placement is where a new VM goes. Its fields fill in the DcVmFolder,
+// RsrcPool and HostSystem of CreateVmParams and HandleImportVAppParams.
+type Placement struct {
+	Datacenter types.ManagedObjectReference
+	// The datacenter's root VM folder
+	DcVmFolder types.ManagedObjectReference
+	// Root resource pool of the host or cluster
+	RsrcPool types.ManagedObjectReference
+	// Empty when placing on a cluster, where DRS picks the host
+	HostSystem types.ManagedObjectReference
+}
+
+// FindByPath resolves an inventory path such as "/DC1/vm/lab" or
+// "DC1/host/cluster1/esx01" to the object's reference.
+func (s *EsxiService) FindByPath(ctx context.Context, inventoryPath string) (types.ManagedObjectReference, error) {
+	res, err := methods.FindByInventoryPath(ctx, s.EsxiClient.Client, &types.FindByInventoryPath{
+		This:          *s.EsxiClient.ServiceContent.SearchIndex,
+		InventoryPath: strings.Trim(inventoryPath, "/"),
+	})
+	if err != nil {
+		return types.ManagedObjectReference{}, err
+	}
+	if res.Returnval == nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("%s: %w", inventoryPath, ErrNotFound)
+	}
+	return *res.Returnval, nil
+}
+
+func (s *EsxiService) ListClusters(ctx context.Context) ([]mo.ClusterComputeResource, error) {
+	v, err := s.getView(ctx, "ClusterComputeResource")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var clusters []mo.ClusterComputeResource
+	if err = v.Retrieve(ctx, []string{"ClusterComputeResource"}, nil, &clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// FindCluster returns the cluster called name, or at inventory path name
+// when it contains a "/".
+func (s *EsxiService) FindCluster(ctx context.Context, name string) (mo.ClusterComputeResource, error) {
+	var cluster mo.ClusterComputeResource
+	ref, err := s.findEntity(ctx, "ClusterComputeResource", name)
+	if err != nil {
+		return cluster, err
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &cluster)
+	return cluster, err
+}
+
+// GetClusterHosts returns the hosts in cluster.
+func (s *EsxiService) GetClusterHosts(ctx context.Context, cluster mo.ClusterComputeResource) ([]mo.HostSystem, error) {
+	var hosts []mo.HostSystem
+	if len(cluster.Host) == 0 {
+		return hosts, nil
+	}
+	err := property.DefaultCollector(s.EsxiClient.Client).Retrieve(ctx, cluster.Host, nil, &hosts)
+	return hosts, err
+}
+
+// FindHost returns the host called name, or at inventory path name when it
+// contains a "/".
+func (s *EsxiService) FindHost(ctx context.Context, name string) (mo.HostSystem, error) {
+	var host mo.HostSystem
+	ref, err := s.findEntity(ctx, "HostSystem", name)
+	if err != nil {
+		return host, err
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &host)
+	return host, err
+}
+
+// GetPlacement resolves target, a cluster or host name or inventory path,
+// to the folder and resource pool a new VM should use. An empty target
+// places on the only host of a standalone ESXi.
+func (s *EsxiService) GetPlacement(ctx context.Context, target string) (Placement, error) {
+	var p Placement
+	var ref types.ManagedObjectReference
+	var err error
+	switch {
+	case target == "":
+		hosts, err := s.hostNames(ctx)
+		if err != nil {
+			return p, err
+		}
+		if err = onlyOne("HostSystem", len(hosts)); err != nil {
+			return p, fmt.Errorf("placement: %w", err)
+		}
+		for value := range hosts {
+			ref = types.ManagedObjectReference{Type: "HostSystem", Value: value}
+		}
+	case strings.Contains(target, "/"):
+		ref, err = s.FindByPath(ctx, target)
+	default:
+		ref, err = s.findEntity(ctx, "ClusterComputeResource", target)
+		if errors.Is(err, ErrNotFound) {
+			ref, err = s.findEntity(ctx, "HostSystem", target)
+		}
+	}
+	if err != nil {
+		return p, fmt.Errorf("placement %s: %w", target, err)
+	}
+
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	var compute mo.ComputeResource
+	switch ref.Type {
+	case "HostSystem":
+		var host mo.HostSystem
+		if err = pc.RetrieveOne(ctx, ref, []string{"parent"}, &host); err != nil {
+			return p, err
+		}
+		p.HostSystem = ref
+		err = pc.RetrieveOne(ctx, *host.Parent, []string{"resourcePool"}, &compute)
+	case "ClusterComputeResource", "ComputeResource":
+		err = pc.RetrieveOne(ctx, ref, []string{"resourcePool"}, &compute)
+	default:
+		return p, fmt.Errorf("placement %s: is a %s, not a host or cluster", target, ref.Type)
+	}
+	if err != nil {
+		return p, err
+	}
+	if compute.ResourcePool == nil {
+		return p, fmt.Errorf("placement %s: no resource pool", target)
+	}
+	p.RsrcPool = *compute.ResourcePool
+	dc, err := s.datacenterOf(ctx, ref)
+	if err != nil {
+		return p, fmt.Errorf("placement %s: %w", target, err)
+	}
+	p.Datacenter, p.DcVmFolder = dc.Self, dc.VmFolder
+	return p, nil
+}
+
+// datacenterOf walks up from ref to its datacenter.
+func (s *EsxiService) datacenterOf(ctx context.Context, ref types.ManagedObjectReference) (mo.Datacenter, error) {
+	var dc mo.Datacenter
+	pc := property.DefaultCollector(s.EsxiClient.Client)
+	for ref.Type != "Datacenter" {
+		var e mo.ManagedEntity
+		if err := pc.RetrieveOne(ctx, ref, []string{"parent"}, &e); err != nil {
+			return dc, err
+		}
+		if e.Parent == nil {
+			return dc, fmt.Errorf("%s isn't in a datacenter", ref)
+		}
+		ref = *e.Parent
+	}
+	err := pc.RetrieveOne(ctx, ref, []string{"name", "vmFolder"}, &dc)
+	return dc, err
+}
+
+// ListVmFolders returns every folder that holds VMs, the datacenters' root
+// vm folders included.
+func (s *EsxiService) ListVmFolders(ctx context.Context) ([]mo.Folder, error) {
+	v, err := s.getView(ctx, "Folder")
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+	var all, folders []mo.Folder
+	if err = v.Retrieve(ctx, []string{"Folder"}, []string{"name", "parent", "childType", "childEntity"}, &all); err != nil {
+		return nil, err
+	}
+	for _, f := range all {
+		for _, t := range f.ChildType {
+			if t == "VirtualMachine" {
+				folders = append(folders, f)
+				break
+			}
+		}
+	}
+	return folders, nil
+}
+
+// FindFolder returns the folder at inventory path, e.g. "/DC1/vm/lab".
+func (s *EsxiService) FindFolder(ctx context.Context, inventoryPath string) (mo.Folder, error) {
+	var folder mo.Folder
+	ref, err := s.FindByPath(ctx, inventoryPath)
+	if err != nil {
+		return folder, err
+	}
+	if ref.Type != "Folder" {
+		return folder, fmt.Errorf("%s is a %s, not a folder", inventoryPath, ref.Type)
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, ref, nil, &folder)
+	return folder, err
+}
+
+// CreateFolder creates the folder at inventory path, e.g. "/DC1/vm/lab/web"
+// creates web in /DC1/vm/lab, which must exist.
+func (s *EsxiService) CreateFolder(ctx context.Context, inventoryPath string) (mo.Folder, error) {
+	var folder mo.Folder
+	dir, name := path.Split(strings.TrimRight(inventoryPath, "/"))
+	parent, err := s.FindFolder(ctx, dir)
+	if err != nil {
+		return folder, fmt.Errorf("create folder %s: %w", inventoryPath, err)
+	}
+	res, err := methods.CreateFolder(ctx, s.EsxiClient.Client, &types.CreateFolder{
+		This: parent.Self,
+		Name: name,
+	})
+	if err != nil {
+		return folder, fmt.Errorf("create folder %s: %w", inventoryPath, err)
+	}
+	err = property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, res.Returnval, nil, &folder)
+	return folder, err
+}
+
+// MoveToFolder moves VMs (or other folders) into folder.
+func (s *EsxiService) MoveToFolder(ctx context.Context, folder types.ManagedObjectReference, refs ...types.ManagedObjectReference) error {
+	task, err := methods.MoveIntoFolder_Task(ctx, s.EsxiClient.Client, &types.MoveIntoFolder_Task{
+		This: folder,
+		List: refs,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// RenameFolder renames folder to name.
+func (s *EsxiService) RenameFolder(ctx context.Context, folder types.ManagedObjectReference, name string) error {
+	task, err := methods.Rename_Task(ctx, s.EsxiClient.Client, &types.Rename_Task{
+		This:    folder,
+		NewName: name,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
+
+// RemoveFolder deletes folder, which must be empty; destroying a folder
+// would otherwise delete the VMs in it too.
+func (s *EsxiService) RemoveFolder(ctx context.Context, folder types.ManagedObjectReference) error {
+	var f mo.Folder
+	err := property.DefaultCollector(s.EsxiClient.Client).RetrieveOne(ctx, folder, []string{"name", "childEntity"}, &f)
+	if err != nil {
+		return err
+	}
+	if len(f.ChildEntity) > 0 {
+		return fmt.Errorf("remove folder %s: not empty, %d items left", f.Name, len(f.ChildEntity))
+	}
+	task, err := methods.Destroy_Task(ctx, s.EsxiClient.Client, &types.Destroy_Task{
+		This: folder,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.waitTask(ctx, task.Returnval)
+	return err
+}
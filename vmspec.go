@@ -0,0 +1,447 @@
+package gesxi
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ControllerType is a storage controller model
+type ControllerType string
+
+const (
+	ControllerPVSCSI      ControllerType = "pvscsi"
+	ControllerLsiLogic    ControllerType = "lsilogic"
+	ControllerLsiLogicSAS ControllerType = "lsilogic-sas"
+	ControllerBusLogic    ControllerType = "buslogic"
+	ControllerNVMe        ControllerType = "nvme"
+	ControllerSATA        ControllerType = "sata"
+	ControllerIDE         ControllerType = "ide"
+)
+
+// Firmware is the VM boot firmware
+type Firmware string
+
+const (
+	FirmwareBIOS Firmware = "bios"
+	FirmwareEFI  Firmware = "efi"
+)
+
+// NicAdapter is a virtual network adapter model
+type NicAdapter string
+
+const (
+	NicVmxnet3 NicAdapter = "vmxnet3"
+	NicE1000e  NicAdapter = "e1000e"
+	NicE1000   NicAdapter = "e1000"
+	NicSriov   NicAdapter = "sriov"
+)
+
+// DiskProvisioning is how a disk's blocks are allocated
+type DiskProvisioning string
+
+const (
+	DiskThin        DiskProvisioning = "thin"
+	DiskLazyZeroed  DiskProvisioning = "lazyZeroedThick"
+	DiskEagerZeroed DiskProvisioning = "eagerZeroedThick"
+)
+
+// BootDevice is an entry of CreateVmParams.BootOrder
+type BootDevice string
+
+const (
+	BootDisk  BootDevice = "disk"
+	BootCdrom BootDevice = "cdrom"
+	BootNet   BootDevice = "ethernet"
+)
+
+// DiskSpec describes a new virtual disk
+type DiskSpec struct {
+	// Size, CapacityGB wins when both are set
+	CapacityGB int64
+	CapacityMB int64
+	// Default thin
+	Provisioning DiskProvisioning
+	// Default persistent
+	Mode types.VirtualDiskMode
+	// Datastore name to place the disk on, default the VM's datastore
+	Datastore string
+	// Controller to attach to; an existing controller of this type with a
+	// free unit is used, otherwise one is created. AddDiskToVm defaults to
+	// the type of the VM's existing disk controller, CreateVm to the first
+	// of CreateVmParams.Controllers; both fall back to lsilogic
+	Controller ControllerType
+	// Unit on the controller, default the first free one
+	UnitNumber *int32
+}
+
+// NicSpec describes a new network adapter
+type NicSpec struct {
+	// Port group name
+	Network string
+	// Default vmxnet3. sriov also needs the VM's memory fully reserved
+	Adapter NicAdapter
+	// Static MAC, e.g. 00:50:56:01:02:03; default one is generated
+	MacAddress string
+	// Connected applies to a running VM, StartConnected to power on.
+	// Both default to true
+	Connected      *bool
+	StartConnected *bool
+}
+
+// CdromSpec describes a new CD-ROM drive
+type CdromSpec struct {
+	// ide (default) or sata
+	Controller ControllerType
+	// Datastore path of an ISO to mount, e.g. "[datastore1] ISOs/ubuntu.iso".
+	// Empty leaves the drive as an empty client device
+	IsoPath string
+}
+
+func (d DiskSpec) capacityKB() int64 {
+	if d.CapacityGB > 0 {
+		return d.CapacityGB * 1024 * 1024
+	}
+	return d.CapacityMB * 1024
+}
+
+// deviceChanges builds the device part of a VM config spec for the
+// controllers, disks, nics and cdrom in p.
+func (s *EsxiService) deviceChanges(ctx context.Context, p CreateVmParams) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	var devices object.VirtualDeviceList
+	for _, t := range p.Controllers {
+		c, err := newController(devices, t)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, c)
+	}
+	defaultController := ControllerLsiLogic
+	if len(p.Controllers) > 0 {
+		defaultController = p.Controllers[0]
+	}
+	for i, d := range p.Disks {
+		if d.capacityKB() <= 0 {
+			return nil, fmt.Errorf("disk %d: capacity is required", i)
+		}
+		if d.Controller == "" {
+			d.Controller = defaultController
+		}
+		ctrl, added, err := pickController(devices, d.Controller)
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: %w", i, err)
+		}
+		devices = append(devices, added...)
+		disk, err := newDisk(devices, ctrl, p.DatastoreName, d)
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: %w", i, err)
+		}
+		devices = append(devices, disk)
+	}
+	if len(p.Nics) > 0 {
+		networks, err := s.GetNetworks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range p.Nics {
+			nic, err := s.newNic(ctx, networks, n)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, nic)
+		}
+	}
+	if p.Cdrom != nil {
+		cdrom, added, err := newCdrom(devices, *p.Cdrom)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, added...)
+		devices = append(devices, cdrom)
+	}
+	return devices.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+}
+
+// newDisk creates a disk on ctrl, placed in the VM's folder on
+// spec.Datastore or else dsName.
+func newDisk(devices object.VirtualDeviceList, ctrl types.BaseVirtualController, dsName string, spec DiskSpec) (*types.VirtualDisk, error) {
+	backing := &types.VirtualDiskFlatVer2BackingInfo{
+		DiskMode: string(types.VirtualDiskModePersistent),
+	}
+	if spec.Mode != "" {
+		backing.DiskMode = string(spec.Mode)
+	}
+	switch spec.Provisioning {
+	case DiskThin, "":
+		backing.ThinProvisioned = types.NewBool(true)
+	case DiskLazyZeroed:
+		backing.ThinProvisioned = types.NewBool(false)
+		backing.EagerlyScrub = types.NewBool(false)
+	case DiskEagerZeroed:
+		backing.ThinProvisioned = types.NewBool(false)
+		backing.EagerlyScrub = types.NewBool(true)
+	default:
+		return nil, fmt.Errorf("unknown disk provisioning %q", spec.Provisioning)
+	}
+	if spec.Datastore != "" {
+		dsName = spec.Datastore
+	}
+	backing.FileName = fmt.Sprintf("[%s]", dsName)
+	disk := &types.VirtualDisk{
+		VirtualDevice: types.VirtualDevice{
+			Key:     devices.NewKey(),
+			Backing: backing,
+		},
+		CapacityInKB: spec.capacityKB(),
+	}
+	devices.AssignController(disk, ctrl)
+	if spec.UnitNumber != nil {
+		unit := *spec.UnitNumber
+		if unit < 0 || int(unit) >= controllerUnits(ctrl.(types.BaseVirtualDevice)) {
+			return nil, fmt.Errorf("unit %d out of range for %s", unit, devices.Name(ctrl.(types.BaseVirtualDevice)))
+		}
+		if scsi, ok := ctrl.(types.BaseVirtualSCSIController); ok && unit == scsi.GetVirtualSCSIController().ScsiCtlrUnitNumber {
+			return nil, fmt.Errorf("unit %d is reserved for the scsi controller", unit)
+		}
+		key := ctrl.GetVirtualController().Key
+		for _, d := range devices {
+			v := d.GetVirtualDevice()
+			if v.ControllerKey == key && v.UnitNumber != nil && *v.UnitNumber == unit {
+				return nil, fmt.Errorf("unit %d on %s is in use", unit, devices.Name(ctrl.(types.BaseVirtualDevice)))
+			}
+		}
+		disk.UnitNumber = &unit
+	}
+	if *disk.UnitNumber < 0 || int(*disk.UnitNumber) >= controllerUnits(ctrl.(types.BaseVirtualDevice)) {
+		return nil, fmt.Errorf("no free unit on %s", devices.Name(ctrl.(types.BaseVirtualDevice)))
+	}
+	return disk, nil
+}
+
+// diskControllerType returns the type of the controller holding the VM's
+// first disk, lsilogic when it has none. Controllers without disks, e.g. a
+// SATA one for the CD-ROM, say nothing about where disks belong.
+func diskControllerType(devices object.VirtualDeviceList) ControllerType {
+	for _, d := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		if c := devices.FindByKey(d.GetVirtualDevice().ControllerKey); c != nil {
+			return controllerType(devices, c)
+		}
+	}
+	return ControllerLsiLogic
+}
+
+// newController creates a controller of type t numbered after the ones
+// already in devices. A VM has at most 2 IDE controllers and 4 each of
+// SCSI, SATA and NVMe.
+func newController(devices object.VirtualDeviceList, t ControllerType) (types.BaseVirtualDevice, error) {
+	if bus, name, max := controllerBus(t); bus != nil {
+		if n := len(devices.SelectByType(bus)); n >= max {
+			return nil, fmt.Errorf("no free %s slot: the vm already has %d %s controllers", name, n, name)
+		}
+	}
+	switch t {
+	case ControllerPVSCSI, ControllerLsiLogic, ControllerLsiLogicSAS, ControllerBusLogic:
+		return devices.CreateSCSIController(string(t))
+	case ControllerNVMe:
+		return devices.CreateNVMEController()
+	case ControllerSATA:
+		sata := &types.VirtualAHCIController{}
+		sata.Key = devices.NewKey()
+		sata.BusNumber = int32(len(devices.SelectByType((*types.VirtualSATAController)(nil))))
+		return sata, nil
+	case ControllerIDE:
+		ide := &types.VirtualIDEController{}
+		ide.Key = devices.NewKey()
+		ide.BusNumber = int32(len(devices.SelectByType((*types.VirtualIDEController)(nil))))
+		return ide, nil
+	}
+	return nil, fmt.Errorf("unknown controller type %q", t)
+}
+
+// controllerBus returns the controller kind t belongs to, as a type for
+// SelectByType and a name, and how many of that kind a VM can have.
+func controllerBus(t ControllerType) (bus types.BaseVirtualDevice, name string, max int) {
+	switch t {
+	case ControllerPVSCSI, ControllerLsiLogic, ControllerLsiLogicSAS, ControllerBusLogic:
+		return (*types.VirtualSCSIController)(nil), "SCSI", 4
+	case ControllerNVMe:
+		return (*types.VirtualNVMEController)(nil), "NVMe", 4
+	case ControllerSATA:
+		return (*types.VirtualSATAController)(nil), "SATA", 4
+	case ControllerIDE:
+		return (*types.VirtualIDEController)(nil), "IDE", 2
+	}
+	return nil, "", 0
+}
+
+// controllerType maps a controller device to its ControllerType
+func controllerType(devices object.VirtualDeviceList, d types.BaseVirtualDevice) ControllerType {
+	if _, ok := d.(types.BaseVirtualSATAController); ok {
+		return ControllerSATA
+	}
+	return ControllerType(devices.Type(d))
+}
+
+// controllerUnits is the number of unit numbers on each controller kind
+func controllerUnits(c types.BaseVirtualDevice) int {
+	switch c.(type) {
+	case types.BaseVirtualSCSIController:
+		return 16
+	case *types.VirtualIDEController:
+		return 2
+	case *types.VirtualNVMEController:
+		return 15
+	case types.BaseVirtualSATAController:
+		return 30
+	}
+	return 0
+}
+
+// controllerSlots is how many devices each controller kind takes
+func controllerSlots(c types.BaseVirtualDevice) int {
+	switch c.(type) {
+	case types.BaseVirtualSCSIController:
+		return 15
+	case *types.VirtualIDEController:
+		return 2
+	case *types.VirtualNVMEController:
+		return 15
+	case types.BaseVirtualSATAController:
+		return 30
+	}
+	return 0
+}
+
+// pickController returns a controller of type t in devices with a free
+// unit, creating one when there is none. Created devices are returned in
+// added and must be added to the spec along with the device using it.
+func pickController(devices object.VirtualDeviceList, t ControllerType) (ctrl types.BaseVirtualController, added []types.BaseVirtualDevice, err error) {
+	for _, d := range devices {
+		c, ok := d.(types.BaseVirtualController)
+		if !ok || controllerType(devices, d) != t {
+			continue
+		}
+		key := c.GetVirtualController().Key
+		used := len(devices.Select(func(d types.BaseVirtualDevice) bool {
+			return d.GetVirtualDevice().ControllerKey == key
+		}))
+		if used < controllerSlots(d) {
+			return c, nil, nil
+		}
+	}
+	d, err := newController(devices, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.(types.BaseVirtualController), []types.BaseVirtualDevice{d}, nil
+}
+
+// newNic creates an ethernet card of spec.Adapter backed by the named
+// standard, distributed or opaque network.
+func (s *EsxiService) newNic(ctx context.Context, networks []mo.Network, spec NicSpec) (types.BaseVirtualDevice, error) {
+	backing, err := s.nicBacking(ctx, networks, spec.Network)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Adapter == "" {
+		spec.Adapter = NicVmxnet3
+	}
+	device, err := object.VirtualDeviceList{}.CreateEthernetCard(string(spec.Adapter), backing)
+	if err != nil {
+		return nil, err
+	}
+	card := device.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+	if spec.MacAddress != "" {
+		mac, err := net.ParseMAC(spec.MacAddress)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid mac address %q", spec.MacAddress)
+		}
+		card.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+		card.MacAddress = mac.String()
+	} else {
+		card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+	}
+	card.Connectable = &types.VirtualDeviceConnectInfo{
+		AllowGuestControl: true,
+		Connected:         spec.Connected == nil || *spec.Connected,
+		StartConnected:    spec.StartConnected == nil || *spec.StartConnected,
+	}
+	return device, nil
+}
+
+// nicBacking returns the NIC backing for the network called name, which
+// must be unique.
+func (s *EsxiService) nicBacking(ctx context.Context, networks []mo.Network, name string) (types.BaseVirtualDeviceBackingInfo, error) {
+	var found []mo.Network
+	for _, n := range networks {
+		if n.Name == name {
+			found = append(found, n)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("network %q not found", name)
+	case 1:
+	default:
+		return nil, fmt.Errorf("network name %q matches %d networks", name, len(found))
+	}
+	netRef, ok := object.NewReference(s.EsxiClient.Client, found[0].Self).(object.NetworkReference)
+	if !ok {
+		return nil, fmt.Errorf("network %s: unsupported network type %s", name, found[0].Self.Type)
+	}
+	// For a DistributedVirtualPortgroup this looks up the switch uuid and
+	// port group key the port backing needs
+	backing, err := netRef.EthernetCardBackingInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %w", name, err)
+	}
+	return backing, nil
+}
+
+// newCdrom creates a CD-ROM on an IDE or SATA controller, with the ISO in
+// spec inserted.
+func newCdrom(devices object.VirtualDeviceList, spec CdromSpec) (*types.VirtualCdrom, []types.BaseVirtualDevice, error) {
+	if spec.Controller == "" {
+		spec.Controller = ControllerIDE
+	}
+	if spec.Controller != ControllerIDE && spec.Controller != ControllerSATA {
+		return nil, nil, fmt.Errorf("cdrom: unsupported controller %q", spec.Controller)
+	}
+	ctrl, added, err := pickController(devices, spec.Controller)
+	if err != nil {
+		return nil, nil, err
+	}
+	devices = append(devices, added...)
+	cdrom := &types.VirtualCdrom{}
+	cdrom.Key = devices.NewKey()
+	devices.AssignController(cdrom, ctrl)
+	cdrom.Backing = clientCdromBacking()
+	cdrom.Connectable = &types.VirtualDeviceConnectInfo{
+		AllowGuestControl: true,
+		StartConnected:    spec.IsoPath != "",
+	}
+	if spec.IsoPath != "" {
+		devices.InsertIso(cdrom, spec.IsoPath)
+	}
+	return cdrom, added, nil
+}
+
+// setBootOrder points the VM's boot options at its devices in order. It
+// runs after creation since boot entries need the devices' real keys.
+func (s *EsxiService) setBootOrder(ctx context.Context, vm mo.VirtualMachine, order []BootDevice) error {
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+	names := make([]string, len(order))
+	for i, o := range order {
+		names[i] = string(o)
+	}
+	boot := &types.VirtualMachineBootOptions{}
+	if vm.Config.BootOptions != nil {
+		*boot = *vm.Config.BootOptions
+	}
+	boot.BootOrder = devices.BootOrder(names)
+	return s.reconfigVm(ctx, vm, types.VirtualMachineConfigSpec{BootOptions: boot})
+}
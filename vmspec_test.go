@@ -0,0 +1,250 @@
+package gesxi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// testController returns a controller of type t with key and bus number
+// set, as it would read back from a VM.
+func testController(t *testing.T, devices object.VirtualDeviceList, ct ControllerType, key int32) types.BaseVirtualDevice {
+	t.Helper()
+	d, err := newController(devices, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.GetVirtualDevice().Key = key
+	return d
+}
+
+// testDisks returns n disks on ctrl at units 0 up, skipping 7 on SCSI.
+func testDisks(ctrl types.BaseVirtualDevice, n int, key int32) object.VirtualDeviceList {
+	var disks object.VirtualDeviceList
+	for unit := int32(0); len(disks) < n; unit++ {
+		if _, ok := ctrl.(types.BaseVirtualSCSIController); ok && unit == 7 {
+			continue
+		}
+		u := unit
+		disks = append(disks, &types.VirtualDisk{VirtualDevice: types.VirtualDevice{
+			Key:           key + unit,
+			ControllerKey: ctrl.GetVirtualDevice().Key,
+			UnitNumber:    &u,
+		}})
+	}
+	return disks
+}
+
+func TestPickController(t *testing.T) {
+	var full object.VirtualDeviceList
+	scsi0 := testController(t, full, ControllerPVSCSI, 1000)
+	full = append(full, scsi0)
+	full = append(full, testDisks(scsi0, 15, 2000)...)
+	ide0 := testController(t, full, ControllerIDE, 200)
+	full = append(full, ide0)
+	ide1 := testController(t, full, ControllerIDE, 201)
+	full = append(full, ide1)
+	full = append(full, testDisks(ide0, 2, 3000)...)
+	full = append(full, testDisks(ide1, 2, 3100)...)
+	sata0 := testController(t, full, ControllerSATA, 15000)
+	full = append(full, sata0)
+
+	var fourScsi object.VirtualDeviceList
+	for i := int32(0); i < 4; i++ {
+		c := testController(t, fourScsi, ControllerLsiLogic, 1000+i)
+		fourScsi = append(fourScsi, c)
+		fourScsi = append(fourScsi, testDisks(c, 15, 2000+100*i)...)
+	}
+
+	tests := []struct {
+		name    string
+		devices object.VirtualDeviceList
+		t       ControllerType
+		// Key of the existing controller wanted, or 0 for a new one
+		key     int32
+		bus     int32
+		wantErr string
+	}{
+		{"creates first", nil, ControllerPVSCSI, 0, 0, ""},
+		{"full scsi gets another", full, ControllerPVSCSI, 0, 1, ""},
+		{"other scsi model is not reused", full[:2], ControllerLsiLogic, 0, 1, ""},
+		{"sata with room", full, ControllerSATA, 15000, 0, ""},
+		{"nvme created", full, ControllerNVMe, 0, 0, ""},
+		{"ide with room", full[:17], ControllerIDE, 200, 0, ""},
+		{"both ide full", full, ControllerIDE, 0, 0, "no free IDE slot"},
+		{"four scsi full", fourScsi, ControllerPVSCSI, 0, 0, "no free SCSI slot"},
+		{"unknown", nil, "floppy", 0, 0, "unknown controller type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl, added, err := pickController(tt.devices, tt.t)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := ctrl.GetVirtualController()
+			if tt.key != 0 {
+				if c.Key != tt.key || len(added) != 0 {
+					t.Fatalf("got key %d with %d added, want existing %d", c.Key, len(added), tt.key)
+				}
+				return
+			}
+			if len(added) != 1 || added[0].(types.BaseVirtualController) != ctrl {
+				t.Fatalf("got %d added, want the new controller", len(added))
+			}
+			if got := controllerType(tt.devices, added[0]); got != tt.t {
+				t.Fatalf("created %s, want %s", got, tt.t)
+			}
+			if c.BusNumber != tt.bus {
+				t.Fatalf("bus %d, want %d", c.BusNumber, tt.bus)
+			}
+		})
+	}
+}
+
+func TestNewDiskUnit(t *testing.T) {
+	var devices object.VirtualDeviceList
+	scsi := testController(t, devices, ControllerPVSCSI, 1000)
+	ide := testController(t, devices, ControllerIDE, 200)
+	unit := func(u int32) *int32 { return &u }
+
+	tests := []struct {
+		name    string
+		devices object.VirtualDeviceList
+		ctrl    types.BaseVirtualDevice
+		unit    *int32
+		want    int32
+		wantErr string
+	}{
+		{"first free", object.VirtualDeviceList{scsi}, scsi, nil, 0, ""},
+		{"skips the scsi controller's unit", append(object.VirtualDeviceList{scsi}, testDisks(scsi, 7, 2000)...), scsi, nil, 8, ""},
+		{"fills a gap", append(object.VirtualDeviceList{scsi}, testDisks(scsi, 3, 2000)[1:]...), scsi, nil, 0, ""},
+		{"requested", object.VirtualDeviceList{scsi}, scsi, unit(3), 3, ""},
+		{"requested in use", append(object.VirtualDeviceList{scsi}, testDisks(scsi, 1, 2000)...), scsi, unit(0), 0, "in use"},
+		{"requested reserved", object.VirtualDeviceList{scsi}, scsi, unit(7), 0, "reserved"},
+		{"requested out of range", object.VirtualDeviceList{scsi}, scsi, unit(16), 0, "out of range"},
+		{"second ide unit", append(object.VirtualDeviceList{ide}, testDisks(ide, 1, 3000)...), ide, nil, 1, ""},
+		{"ide has two units", append(object.VirtualDeviceList{ide}, testDisks(ide, 2, 3000)...), ide, nil, 0, "no free unit"},
+		{"ide unit out of range", object.VirtualDeviceList{ide}, ide, unit(2), 0, "out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := DiskSpec{CapacityGB: 1, UnitNumber: tt.unit}
+			disk, err := newDisk(tt.devices, tt.ctrl.(types.BaseVirtualController), "datastore1", spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *disk.UnitNumber != tt.want {
+				t.Fatalf("unit %d, want %d", *disk.UnitNumber, tt.want)
+			}
+			if disk.ControllerKey != tt.ctrl.GetVirtualDevice().Key {
+				t.Fatalf("controller key %d, want %d", disk.ControllerKey, tt.ctrl.GetVirtualDevice().Key)
+			}
+		})
+	}
+}
+
+func TestNewDiskBacking(t *testing.T) {
+	scsi := testController(t, nil, ControllerPVSCSI, 1000)
+	devices := object.VirtualDeviceList{scsi}
+	tests := []struct {
+		name        string
+		spec        DiskSpec
+		thin, eager *bool
+		mode        string
+		file        string
+		kb          int64
+		wantErr     string
+	}{
+		{"defaults", DiskSpec{CapacityGB: 2}, types.NewBool(true), nil, "persistent", "[datastore1]", 2 * 1024 * 1024, ""},
+		{"thin", DiskSpec{CapacityMB: 512, Provisioning: DiskThin}, types.NewBool(true), nil, "persistent", "[datastore1]", 512 * 1024, ""},
+		{"lazy zeroed", DiskSpec{CapacityGB: 1, Provisioning: DiskLazyZeroed}, types.NewBool(false), types.NewBool(false), "persistent", "[datastore1]", 1024 * 1024, ""},
+		{"eager zeroed", DiskSpec{CapacityGB: 1, Provisioning: DiskEagerZeroed}, types.NewBool(false), types.NewBool(true), "persistent", "[datastore1]", 1024 * 1024, ""},
+		{"independent", DiskSpec{CapacityGB: 1, Mode: types.VirtualDiskModeIndependent_nonpersistent}, types.NewBool(true), nil, "independent_nonpersistent", "[datastore1]", 1024 * 1024, ""},
+		{"gb wins", DiskSpec{CapacityGB: 1, CapacityMB: 10}, types.NewBool(true), nil, "persistent", "[datastore1]", 1024 * 1024, ""},
+		{"other datastore", DiskSpec{CapacityGB: 1, Datastore: "ssd01"}, types.NewBool(true), nil, "persistent", "[ssd01]", 1024 * 1024, ""},
+		{"unknown provisioning", DiskSpec{CapacityGB: 1, Provisioning: "sparse"}, nil, nil, "", "", 0, "unknown disk provisioning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk, err := newDisk(devices, scsi.(types.BaseVirtualController), "datastore1", tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+			if !equalBoolPtr(b.ThinProvisioned, tt.thin) || !equalBoolPtr(b.EagerlyScrub, tt.eager) {
+				t.Errorf("thin %v eager %v, want %v %v", fmtBool(b.ThinProvisioned), fmtBool(b.EagerlyScrub), fmtBool(tt.thin), fmtBool(tt.eager))
+			}
+			if b.DiskMode != tt.mode {
+				t.Errorf("mode %s, want %s", b.DiskMode, tt.mode)
+			}
+			if b.FileName != tt.file {
+				t.Errorf("file %s, want %s", b.FileName, tt.file)
+			}
+			if disk.CapacityInKB != tt.kb {
+				t.Errorf("capacity %d KB, want %d", disk.CapacityInKB, tt.kb)
+			}
+		})
+	}
+}
+
+func equalBoolPtr(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func fmtBool(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+	if *b {
+		return "true"
+	}
+	return "false"
+}
+
+func TestDiskControllerType(t *testing.T) {
+	var none object.VirtualDeviceList
+	if got := diskControllerType(none); got != ControllerLsiLogic {
+		t.Errorf("no devices: got %s", got)
+	}
+
+	// The CD-ROM's SATA controller comes before the boot disk's NVMe one
+	sata := testController(t, nil, ControllerSATA, 15000)
+	nvme := testController(t, nil, ControllerNVMe, 31000)
+	devices := object.VirtualDeviceList{sata, nvme}
+	if got := diskControllerType(devices); got != ControllerLsiLogic {
+		t.Errorf("controllers without disks: got %s", got)
+	}
+	devices = append(devices, testDisks(nvme, 1, 2000)...)
+	if got := diskControllerType(devices); got != ControllerNVMe {
+		t.Errorf("nvme boot disk: got %s", got)
+	}
+
+	pvscsi := testController(t, nil, ControllerPVSCSI, 1000)
+	devices = append(object.VirtualDeviceList{sata, pvscsi}, testDisks(pvscsi, 2, 2000)...)
+	if got := diskControllerType(devices); got != ControllerPVSCSI {
+		t.Errorf("pvscsi disks: got %s", got)
+	}
+}